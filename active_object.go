@@ -5,8 +5,6 @@ import (
 	"encoding/binary"
 	"io"
 	"log"
-
-	"github.com/anon55555/mt/rudp"
 )
 
 const (
@@ -25,101 +23,103 @@ const (
 	AoCmdSetAnimSpeed
 )
 
-func processAoRmAdd(c *Conn, r *bytes.Reader) []byte {
-	w := &bytes.Buffer{}
+// AOPhysicsOverride is the message that changes the movement
+// of the player an active object belongs to
+type AOPhysicsOverride struct {
+	Speed, Jump, Gravity float32
 
-	countRm := ReadUint16(r)
-	WriteUint16(w, countRm)
+	NoSneak, NoSneakGlitch, OldMove bool
+}
 
-	var aoRm []uint16
-	for i := uint16(0); i < countRm; i++ {
-		id := ReadUint16(r)
+// DefaultPhysics is the movement of players without an override
+var DefaultPhysics = AOPhysicsOverride{
+	Speed:         1,
+	Jump:          1,
+	Gravity:       1,
+	NoSneakGlitch: true,
+}
 
-		if id == c.localPlayerCao {
-			id = c.currentPlayerCao
-		}
+func (msg *AOPhysicsOverride) marshal() []byte {
+	w := bytes.NewBuffer([]byte{AoCmdSetPhysicsOverride})
+	writeVec(w, msg.Speed, msg.Jump, msg.Gravity)
+	writeBool(w, msg.NoSneak)
+	writeBool(w, msg.NoSneakGlitch)
+	writeBool(w, msg.OldMove)
 
-		WriteUint16(w, id)
-		aoRm = append(aoRm, id)
+	return w.Bytes()
+}
+
+// swapPlayerCao replaces the ID of the player object
+// used by the current server with the one known to the client
+// and the other way round
+func (c *Conn) swapPlayerCao(id uint16) uint16 {
+	if id == c.currentPlayerCao {
+		return c.localPlayerCao
+	} else if id == c.localPlayerCao {
+		return c.currentPlayerCao
 	}
 
-	countAdd := ReadUint16(r)
-	WriteUint16(w, countAdd)
+	return id
+}
+
+func processAoRmAdd(c *Conn, cmd *ToCltAORmAdd) {
+	for i, id := range cmd.Remove {
+		if id == c.localPlayerCao {
+			cmd.Remove[i] = c.currentPlayerCao
+		}
+	}
 
+	var add []AOAdd
 	var aoAdd []uint16
-	for i := uint16(0); i < countAdd; i++ {
-		id := ReadUint16(r)
-		objType := ReadUint8(r)
-		initData := ReadBytes32(r)
-
-		dr := bytes.NewReader(initData)
+	for _, ao := range cmd.Add {
+		dr := bytes.NewReader(ao.InitData)
 		dr.Seek(1, io.SeekStart)
 
 		name := string(ReadBytes16(dr))
 
 		if name == c.Username() {
 			if c.initAoReceived {
-				// Read the messages from the packet
+				// Read the messages from the init data
 				// They need to be forwarded
 				dr.Seek(30, io.SeekCurrent)
 
-				msgcountByte, _ := dr.ReadByte()
-				msgcount := uint8(msgcountByte)
-
-				var msgs [][]byte
+				msgs := &ToCltAOMsgs{}
+				msgcount := ReadUint8(dr)
 				for j := uint8(0); j < msgcount; j++ {
-					dr.Seek(2, io.SeekCurrent)
-
-					msglenBytes := make([]byte, 2)
-					dr.Read(msglenBytes)
-					msglen := binary.BigEndian.Uint16(msglenBytes)
-
-					msg := make([]byte, msglen)
-					dr.Read(msg)
-
-					msgs = append(msgs, msg)
+					msgs.Msgs = append(msgs.Msgs, AOMsg{
+						ID:  c.localPlayerCao,
+						Msg: aoMsgReplaceIDs(c, ReadBytes32(dr)),
+					})
 				}
 
-				// Generate message packet
-				msgpkt := []byte{0x00, ToClientActiveObjectMessages}
-				for _, msg := range msgs {
-					msgdata := make([]byte, 4+len(msg))
-					binary.BigEndian.PutUint16(msgdata[0:2], c.localPlayerCao)
-					binary.BigEndian.PutUint16(msgdata[2:4], uint16(len(msg)))
-					copy(msgdata[4:], aoMsgReplaceIDs(c, msg))
-					msgpkt = append(msgpkt, msgdata...)
-				}
-
-				ack, err := c.Send(rudp.Pkt{Reader: bytes.NewReader(msgpkt)})
+				ack, err := c.SendCmd(msgs)
 				if err != nil {
 					log.Print(err)
+				} else {
+					<-ack
 				}
-				<-ack
-
-				data := w.Bytes()
-				binary.BigEndian.PutUint16(data[4+countRm*2:6+countRm*2], countAdd-1)
-				w = bytes.NewBuffer(data)
 
-				c.currentPlayerCao = id
+				// The client keeps its old player object
+				c.currentPlayerCao = ao.ID
 				continue
 			} else {
 				c.initAoReceived = true
-				c.localPlayerCao = id
-				c.currentPlayerCao = id
+				c.localPlayerCao = ao.ID
+				c.currentPlayerCao = ao.ID
+			}
+		} else {
+			if ao.ID == c.localPlayerCao {
+				ao.ID = c.currentPlayerCao
 			}
-		} else if id == c.localPlayerCao {
-			id = c.currentPlayerCao
-		}
 
-		if name != c.Username() {
-			aoAdd = append(aoAdd, id)
+			aoAdd = append(aoAdd, ao.ID)
 		}
 
-		WriteUint16(w, id)
-		WriteUint8(w, objType)
-		WriteBytes32(w, initData)
+		add = append(add, ao)
 	}
 
+	cmd.Add = add
+
 	c.redirectMu.Lock()
 	for i := range aoAdd {
 		if aoAdd[i] != 0 {
@@ -127,36 +127,30 @@ func processAoRmAdd(c *Conn, r *bytes.Reader) []byte {
 		}
 	}
 
-	for i := range aoRm {
-		c.aoIDs[aoRm[i]] = false
+	for i := range cmd.Remove {
+		c.aoIDs[cmd.Remove[i]] = false
 	}
 	c.redirectMu.Unlock()
-
-	return w.Bytes()
 }
 
-func processAoMsgs(c *Conn, r *bytes.Reader) []byte {
-	w := &bytes.Buffer{}
-
-	for r.Len() >= 4 {
-		id := ReadUint16(r)
+func processAoMsgs(c *Conn, cmd *ToCltAOMsgs) {
+	for i := range cmd.Msgs {
+		msg := &cmd.Msgs[i]
 
-		msg := aoMsgReplaceIDs(c, ReadBytes16(r))
+		msg.Msg = aoMsgReplaceIDs(c, msg.Msg)
+		msg.ID = c.swapPlayerCao(msg.ID)
 
-		if id == c.currentPlayerCao {
-			id = c.localPlayerCao
-		} else if id == c.localPlayerCao {
-			id = c.currentPlayerCao
+		if msg.ID == c.localPlayerCao && len(msg.Msg) > 0 && msg.Msg[0] == AoCmdSetPhysicsOverride {
+			c.state.physics = true
 		}
-
-		WriteUint16(w, id)
-		WriteBytes16(w, msg)
 	}
-
-	return w.Bytes()
 }
 
 func aoMsgReplaceIDs(c *Conn, data []byte) []byte {
+	if len(data) < 3 {
+		return data
+	}
+
 	switch cmd := data[0]; cmd {
 	case AoCmdAttachTo:
 		id := binary.BigEndian.Uint16(data[1:3])
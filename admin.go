@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/HimbeerserverDE/srp"
+)
+
+const adminGreeting = "MULTISERVER ADMIN 1"
+
+// errAdminAuth is the only error sent to clients whose login fails,
+// the reason is logged instead so that accounts can't be enumerated
+var errAdminAuth = errors.New("authentication failed")
+
+// adminDummySecret is used to make up the salts of unknown accounts
+var adminDummySecret = make([]byte, 32)
+
+// adminDummyVerifier is used in the SRP exchange with unknown accounts
+var adminDummyVerifier []byte
+
+// adminSession is an authenticated remote console connection
+// It receives the log output like the local console
+type adminSession struct {
+	conn  net.Conn
+	name  string
+	lines chan string
+}
+
+func (s *adminSession) Print(lines []string) {
+	for _, line := range lines {
+		select {
+		case s.lines <- line:
+		default:
+			// Drop lines the operator can't keep up with
+			// instead of blocking the logger
+		}
+	}
+}
+
+func (s *adminSession) Close() {
+	s.conn.Close()
+}
+
+// ListenAdmin starts the remote admin console listeners
+func ListenAdmin() {
+	path, ok := ConfKey("admin_socket").(string)
+	if !ok {
+		path = "admin.sock"
+	}
+
+	if path != "" {
+		os.Remove(path)
+
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			log.Print(err)
+		} else {
+			os.Chmod(path, 0600)
+
+			log.Print("Admin console listening on " + path)
+			closeOnHandoff(l)
+			go serveAdmin(l)
+		}
+	}
+
+	addr, ok := ConfKey("admin_tcp").(string)
+	if !ok || addr == "" {
+		return
+	}
+
+	cert, ok1 := ConfKey("admin_tls_cert").(string)
+	key, ok2 := ConfKey("admin_tls_key").(string)
+	if !ok1 || !ok2 {
+		log.Print("admin_tcp requires admin_tls_cert and admin_tls_key to be set")
+		return
+	}
+
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	l, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	log.Print("Admin console listening on " + addr)
+	closeOnHandoff(l)
+	go serveAdmin(l)
+}
+
+func serveAdmin(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Print(err)
+			continue
+		}
+
+		go handleAdminConn(conn)
+	}
+}
+
+func handleAdminConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	fmt.Fprintln(conn, adminGreeting)
+
+	host := adminHost(conn)
+	if wait := loginBackoff(host); wait > 0 {
+		log.Print("Admin console login from ", conn.RemoteAddr(), " rejected, retry allowed in ", wait.Round(time.Second))
+		fmt.Fprintln(conn, "ERR too many failed logins, try again later")
+		return
+	}
+
+	name, err := adminAuth(conn, r)
+	if err != nil {
+		log.Print("Admin console login from ", conn.RemoteAddr(), " failed: ", err)
+		loginFailed(host)
+
+		// Slow down concurrent attempts as well
+		time.Sleep(loginBaseBackoff)
+		fmt.Fprintln(conn, "ERR "+errAdminAuth.Error())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	loginSucceeded(host)
+
+	log.Print(name, " opened an admin console session")
+	fmt.Fprintln(conn, "OK")
+
+	s := &adminSession{
+		conn:  conn,
+		name:  name,
+		lines: make(chan string, 256),
+	}
+
+	// The channel may only be closed after the session
+	// has been removed from the logger
+	defer close(s.lines)
+
+	logger.AddFrontend(s)
+	defer logger.RemoveFrontend(s)
+
+	go func() {
+		for line := range s.lines {
+			if _, err := fmt.Fprintln(conn, line); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			log.Print(name, " closed the admin console session")
+			return
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		log.Print(name, " issued admin console command: ", line)
+		ExecuteConsoleCommand(name, line)
+	}
+}
+
+// adminAuth performs an SRP login using the proxy accounts
+// and returns the name of the authenticated player
+func adminAuth(conn net.Conn, r *bufio.Reader) (string, error) {
+	fields, err := readAdminLine(r, "AUTH", 3)
+	if err != nil {
+		return "", err
+	}
+
+	name := fields[1]
+
+	A, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return "", err
+	}
+
+	v, s, err := Password(name)
+	if err != nil {
+		return "", err
+	}
+
+	// Unknown players get a made up salt and verifier
+	// so that they can't be told apart from a wrong password
+	known := v != nil && s != nil
+	if !known {
+		s = srp.Hash(adminDummySecret, []byte(name))
+		v = adminDummyVerifier
+	}
+
+	B, _, K, err := srp.Handshake(A, v)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintln(conn, "SRP "+base64.StdEncoding.EncodeToString(s)+" "+base64.StdEncoding.EncodeToString(B))
+
+	fields, err = readAdminLine(r, "PROOF", 2)
+	if err != nil {
+		return "", err
+	}
+
+	M, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", err
+	}
+
+	M2 := srp.ClientProof([]byte(name), s, A, B, K)
+	if !known {
+		return "", fmt.Errorf("unknown player %s", name)
+	} else if subtle.ConstantTimeCompare(M, M2) != 1 {
+		return "", fmt.Errorf("wrong password for %s", name)
+	}
+
+	priv, ok := ConfKey("admin_priv").(string)
+	if !ok {
+		priv = "console"
+	}
+
+	allow, err := CheckPrivs(name, map[string]bool{priv: true})
+	if err != nil {
+		return "", err
+	}
+
+	if !allow {
+		return "", fmt.Errorf("%s is missing the %s privilege", name, priv)
+	}
+
+	return name, nil
+}
+
+// adminHost returns the address failed logins are counted for,
+// see loginBackoff
+func adminHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		// Unix socket
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
+
+func readAdminLine(r *bufio.Reader, cmd string, n int) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != n || fields[0] != cmd {
+		if len(fields) > 0 && fields[0] == "ERR" {
+			return nil, errors.New(strings.Join(fields[1:], " "))
+		}
+
+		return nil, fmt.Errorf("expected %s", cmd)
+	}
+
+	return fields, nil
+}
+
+func init() {
+	if _, err := rand.Read(adminDummySecret); err != nil {
+		log.Fatal(err)
+	}
+
+	var err error
+	_, adminDummyVerifier, err = srp.NewClient(adminDummySecret, adminDummySecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
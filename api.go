@@ -0,0 +1,498 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const apiMaxBodySize = 1 << 20
+
+type apiPlayer struct {
+	Name     string `json:"name"`
+	Server   string `json:"server"`
+	Address  string `json:"address"`
+	ProtoVer uint16 `json:"proto_ver"`
+}
+
+type apiServer struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Players int    `json:"players"`
+	Online  bool   `json:"online"`
+	Latency int64  `json:"latency_ms"`
+}
+
+type apiGroup struct {
+	Name    string   `json:"name"`
+	Servers []string `json:"servers"`
+	Players int      `json:"players"`
+}
+
+type apiBan struct {
+	Address string `json:"address"`
+	Name    string `json:"name"`
+}
+
+type apiRequest struct {
+	Server  string   `json:"server"`
+	Reason  string   `json:"reason"`
+	Target  string   `json:"target"`
+	Message string   `json:"message"`
+	Privs   []string `json:"privs"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func apiOK(w http.ResponseWriter) {
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+// decodeJSON decodes the JSON body of a request into v
+// and sends an error response if it is invalid
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBodySize))
+	if err := dec.Decode(v); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return false
+	}
+
+	return true
+}
+
+func readAPIRequest(w http.ResponseWriter, r *http.Request) (*apiRequest, bool) {
+	rq := &apiRequest{}
+	return rq, decodeJSON(w, r, rq)
+}
+
+// allowMethods sends an error response if the method
+// of the request isn't one of the specified methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+// serverExists reports whether a server or group
+// of the specified name is configured
+func serverExists(name string) bool {
+	if _, ok := ConfKey("servers:" + name + ":address").(string); ok {
+		return true
+	}
+
+	_, ok := ConfKey("groups:" + name).([]interface{})
+	return ok
+}
+
+// apiAuthorized reports whether a request carries the API token
+// Dashboard sessions may only read
+func apiAuthorized(r *http.Request) bool {
+	if _, ok := dashboardUser(r); ok && r.Method == http.MethodGet {
+		return true
+	}
+
+	token, ok := ConfKey("api_token").(string)
+	if !ok || token == "" {
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+func apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !apiAuthorized(r) {
+			apiError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			LogInfo(LogFields{"remote": r.RemoteAddr}, "API request: ", r.Method, " ", r.URL.Path)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apiPlayers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	players := []apiPlayer{}
+	for _, c := range Conns() {
+		players = append(players, apiPlayer{
+			Name:     c.Username(),
+			Server:   c.ServerName(),
+			Address:  c.Addr().String(),
+			ProtoVer: c.ProtoVer(),
+		})
+	}
+
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].Name < players[j].Name
+	})
+
+	writeJSON(w, http.StatusOK, players)
+}
+
+// apiPlayerAction serves /api/players/<name>[/kick|/send|/privs]
+func apiPlayerAction(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/players/"), "/")
+
+	name := path[0]
+	if name == "" || len(path) > 2 {
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	var action string
+	if len(path) == 2 {
+		action = path[1]
+	}
+
+	switch action {
+	case "":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+
+		c := ConnByUsername(name)
+		if c == nil {
+			apiError(w, http.StatusNotFound, name+" is not online")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, apiPlayer{
+			Name:     c.Username(),
+			Server:   c.ServerName(),
+			Address:  c.Addr().String(),
+			ProtoVer: c.ProtoVer(),
+		})
+	case "kick":
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+
+		rq, ok := readAPIRequest(w, r)
+		if !ok {
+			return
+		}
+
+		c := ConnByUsername(name)
+		if c == nil {
+			apiError(w, http.StatusNotFound, name+" is not online")
+			return
+		}
+
+		c.CloseWith(AccessDeniedCustomString, "Kicked. "+rq.Reason+".", false)
+		apiOK(w)
+	case "send":
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+
+		rq, ok := readAPIRequest(w, r)
+		if !ok {
+			return
+		}
+
+		c := ConnByUsername(name)
+		if c == nil {
+			apiError(w, http.StatusNotFound, name+" is not online")
+			return
+		}
+
+		if !serverExists(rq.Server) {
+			apiError(w, http.StatusBadRequest, "server or group "+rq.Server+" does not exist")
+			return
+		}
+
+		if err := c.Redirect(rq.Server); err != nil {
+			apiError(w, http.StatusConflict, err.Error())
+			return
+		}
+
+		apiOK(w)
+	case "privs":
+		if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			rq, ok := readAPIRequest(w, r)
+			if !ok {
+				return
+			}
+
+			if err := SetPrivs(name, privs(rq.Privs...)); err != nil {
+				log.Print(err)
+				apiError(w, http.StatusInternalServerError, "could not set privileges")
+				return
+			}
+		}
+
+		p, err := Privs(name)
+		if err != nil {
+			log.Print(err)
+			apiError(w, http.StatusInternalServerError, "could not get privileges")
+			return
+		}
+
+		list := []string{}
+		for priv, ok := range p {
+			if ok {
+				list = append(list, priv)
+			}
+		}
+		sort.Strings(list)
+
+		writeJSON(w, http.StatusOK, map[string][]string{"privs": list})
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func apiServers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	servers := []apiServer{}
+
+	srvs := ConfKey("servers").(map[interface{}]interface{})
+	for srv := range srvs {
+		addr, _ := ConfKey("servers:" + srv.(string) + ":address").(string)
+		health := Health(srv.(string))
+
+		servers = append(servers, apiServer{
+			Name:    srv.(string),
+			Address: addr,
+			Players: len(ConnsServer(srv.(string))),
+			Online:  health.Up,
+			Latency: health.Latency.Milliseconds(),
+		})
+	}
+
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Name < servers[j].Name
+	})
+
+	groups := []apiGroup{}
+
+	grps, _ := ConfKey("groups").(map[interface{}]interface{})
+	for grp, members := range grps {
+		g := apiGroup{Name: grp.(string), Servers: []string{}}
+
+		list, _ := members.([]interface{})
+		for _, srv := range list {
+			g.Servers = append(g.Servers, srv.(string))
+			g.Players += len(ConnsServer(srv.(string)))
+		}
+
+		groups = append(groups, g)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"servers": servers,
+		"groups":  groups,
+	})
+}
+
+func apiSendAll(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	rq, ok := readAPIRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !serverExists(rq.Server) {
+		apiError(w, http.StatusBadRequest, "server or group "+rq.Server+" does not exist")
+		return
+	}
+
+	for _, c := range Conns() {
+		if c.ServerName() != rq.Server {
+			go c.Redirect(rq.Server)
+		}
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]bool{"ok": true})
+}
+
+func apiAlert(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	rq, ok := readAPIRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if rq.Message == "" {
+		apiError(w, http.StatusBadRequest, "message is empty")
+		return
+	}
+
+	ChatSendAll("[ALERT] " + rq.Message)
+	apiOK(w)
+}
+
+func apiBans(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		rq, ok := readAPIRequest(w, r)
+		if !ok {
+			return
+		}
+
+		err := Ban(rq.Target, "not known")
+		if errors.Is(err, ErrInvalidAddress) {
+			c := ConnByUsername(rq.Target)
+			if c == nil {
+				apiError(w, http.StatusNotFound, rq.Target+" is not online")
+				return
+			}
+
+			err = c.Ban()
+		}
+
+		if err != nil {
+			log.Print(err)
+			apiError(w, http.StatusInternalServerError, "could not ban "+rq.Target)
+			return
+		}
+
+		apiOK(w)
+		return
+	}
+
+	bans, err := BanList()
+	if err != nil {
+		log.Print(err)
+		apiError(w, http.StatusInternalServerError, "could not read the ban list")
+		return
+	}
+
+	list := []apiBan{}
+	for addr, name := range bans {
+		list = append(list, apiBan{Address: addr, Name: name})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Address < list[j].Address
+	})
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// apiUnban serves /api/bans/<playername | IP address>
+func apiUnban(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodDelete) {
+		return
+	}
+
+	target := strings.TrimPrefix(r.URL.Path, "/api/bans/")
+	if target == "" {
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if err := Unban(target); err != nil {
+		log.Print(err)
+		apiError(w, http.StatusInternalServerError, "could not unban "+target)
+		return
+	}
+
+	apiOK(w)
+}
+
+func apiReloadMedia(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	go reconnectRPC(true)
+	writeJSON(w, http.StatusAccepted, map[string]bool{"ok": true})
+}
+
+// apiHandler returns the handler that serves the REST API
+func apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/players", apiPlayers)
+	mux.HandleFunc("/api/players/", apiPlayerAction)
+	mux.HandleFunc("/api/servers", apiServers)
+	mux.HandleFunc("/api/sendall", apiSendAll)
+	mux.HandleFunc("/api/alert", apiAlert)
+	mux.HandleFunc("/api/bans", apiBans)
+	mux.HandleFunc("/api/bans/", apiUnban)
+	mux.HandleFunc("/api/media/reload", apiReloadMedia)
+	mux.HandleFunc("/api/dashboard", apiDashboard)
+
+	return apiAuth(mux)
+}
+
+// ListenAPI starts the HTTP API and dashboard listener if enabled
+func ListenAPI() {
+	addr, ok := ConfKey("api_listen").(string)
+	if !ok || addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", apiHandler())
+	mux.HandleFunc("/api/login", apiLogin)
+	mux.HandleFunc("/api/logout", apiLogout)
+	mux.Handle("/", dashboardHandler())
+
+	log.Print("API listening on " + addr)
+
+	serveHTTP(addr, mux)
+}
+
+// serveHTTP serves an HTTP handler on addr in a new goroutine
+// The listener is closed if the socket is handed over to a new process
+func serveHTTP(addr string, handler http.Handler) {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	closeOnHandoff(srv)
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Print(err)
+		}
+	}()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+var headless bool
+var takeover bool
+
+// subcommands are run instead of the proxy
+// if the first argument matches their name
+var subcommands = map[string]func(args []string) int{
+	"ctl":    ctlMain,
+	"replay": replayMain,
+}
+
+// argsParsed makes sure the command line is parsed
+// before any init function runs
+var argsParsed = parseArgs()
+
+func parseArgs() bool {
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(subcommand(os.Args[2:]))
+		}
+	}
+
+	flag.BoolVar(&headless, "headless", !isTerminal(os.Stdin), "Disable the curses console, log to stdout and read console commands from stdin")
+	flag.BoolVar(&takeover, "takeover", false, "Take over the listening socket of the running proxy through handoff_socket")
+	flag.Parse()
+
+	return true
+}
+
+// isTerminal reports whether f is a character device
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
@@ -7,6 +7,8 @@ import (
 	"errors"
 	"log"
 	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -19,6 +21,22 @@ const (
 
 var passPhrase []byte
 
+// Failed logins to the admin console or the web dashboard
+// delay the next attempt from the same address on both,
+// the delay doubles with every failure up to loginMaxBackoff
+const (
+	loginBaseBackoff = time.Second
+	loginMaxBackoff  = 5 * time.Minute
+)
+
+type loginFailure struct {
+	count int
+	last  time.Time
+}
+
+var loginFailures = make(map[string]*loginFailure)
+var loginFailuresMu sync.Mutex
+
 func encodeVerifierAndSalt(s, v []byte) string {
 	return base64.StdEncoding.EncodeToString(s) + "#" + base64.StdEncoding.EncodeToString(v)
 }
@@ -158,6 +176,53 @@ func SetPassword(name string, verifier, salt []byte) error {
 	return err
 }
 
+// loginBackoff returns how long an address has to wait
+// until it may try to log in again
+func loginBackoff(host string) time.Duration {
+	loginFailuresMu.Lock()
+	defer loginFailuresMu.Unlock()
+
+	f, ok := loginFailures[host]
+	if !ok {
+		return 0
+	}
+
+	backoff := loginBaseBackoff << (f.count - 1)
+	if backoff > loginMaxBackoff || backoff <= 0 {
+		backoff = loginMaxBackoff
+	}
+
+	return time.Until(f.last.Add(backoff))
+}
+
+func loginFailed(host string) {
+	loginFailuresMu.Lock()
+	defer loginFailuresMu.Unlock()
+
+	// Forget addresses that haven't failed for a while
+	for h, f := range loginFailures {
+		if time.Since(f.last) > 2*loginMaxBackoff {
+			delete(loginFailures, h)
+		}
+	}
+
+	f, ok := loginFailures[host]
+	if !ok {
+		f = &loginFailure{}
+		loginFailures[host] = f
+	}
+
+	f.count++
+	f.last = time.Now()
+}
+
+func loginSucceeded(host string) {
+	loginFailuresMu.Lock()
+	defer loginFailuresMu.Unlock()
+
+	delete(loginFailures, host)
+}
+
 func init() {
 	pwd, err := StorageKey("auth:passphrase")
 	if err != nil {
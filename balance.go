@@ -0,0 +1,234 @@
+package main
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	StrategyLeastPlayers = "least_players"
+	StrategyWeighted     = "weighted"
+	StrategyRoundRobin   = "round_robin"
+	StrategyRandom       = "random"
+	StrategyHash         = "hash"
+	StrategyHealth       = "health"
+)
+
+// Number of points per unit of weight on the consistent hashing ring
+const hashRingPoints = 64
+
+var roundRobin = make(map[string]int)
+var roundRobinMu sync.Mutex
+
+// strategies order the members of a group for a player,
+// the first member is tried first
+var strategies = map[string]func(c *Conn, group string, members []string) []string{
+	StrategyLeastPlayers: leastPlayers,
+	StrategyWeighted:     weighted,
+	StrategyRoundRobin:   roundRobinOrder,
+	StrategyRandom:       randomOrder,
+	StrategyHash:         hashOrder,
+	StrategyHealth:       healthOrder,
+}
+
+// MaxPlayers returns the player limit of a server, -1 if there is none
+func MaxPlayers(server string) int {
+	max, ok := ConfKey("servers:" + server + ":max_players").(int)
+	if !ok {
+		return -1
+	}
+
+	return max
+}
+
+// ServerFull reports whether a server has reached its player limit
+func ServerFull(server string) bool {
+	max := MaxPlayers(server)
+	return max >= 0 && len(ConnsServer(server)) >= max
+}
+
+func serverWeight(server string) int {
+	weight, ok := ConfKey("servers:" + server + ":weight").(int)
+	if !ok || weight < 0 {
+		return 1
+	}
+
+	return weight
+}
+
+func leastPlayers(c *Conn, group string, members []string) []string {
+	cnt := make(map[string]int)
+	for _, srv := range members {
+		cnt[srv] = len(ConnsServer(srv))
+	}
+
+	sort.SliceStable(members, func(i, j int) bool {
+		return cnt[members[i]] < cnt[members[j]]
+	})
+
+	return members
+}
+
+// weighted picks servers at random, servers with
+// a higher weight are more likely to be picked first
+func weighted(c *Conn, group string, members []string) []string {
+	var r []string
+
+	for len(members) > 0 {
+		var total int
+		for _, srv := range members {
+			total += serverWeight(srv)
+		}
+
+		if total == 0 {
+			return append(r, members...)
+		}
+
+		n := rand.Intn(total)
+		for i, srv := range members {
+			n -= serverWeight(srv)
+			if n < 0 {
+				r = append(r, srv)
+				members = append(members[:i], members[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return r
+}
+
+func roundRobinOrder(c *Conn, group string, members []string) []string {
+	roundRobinMu.Lock()
+	i := roundRobin[group] % len(members)
+	roundRobin[group]++
+	roundRobinMu.Unlock()
+
+	return append(members[i:], members[:i]...)
+}
+
+func randomOrder(c *Conn, group string, members []string) []string {
+	rand.Shuffle(len(members), func(i, j int) {
+		members[i], members[j] = members[j], members[i]
+	})
+
+	return members
+}
+
+// hashOrder uses consistent hashing by player name so that
+// players keep being sent to the same server as long as
+// the members of the group don't change
+func hashOrder(c *Conn, group string, members []string) []string {
+	type point struct {
+		hash   uint32
+		server string
+	}
+
+	var ring []point
+	for _, srv := range members {
+		for i := 0; i < hashRingPoints*serverWeight(srv); i++ {
+			ring = append(ring, point{
+				hash:   crc32.ChecksumIEEE([]byte(srv + "#" + strconv.Itoa(i))),
+				server: srv,
+			})
+		}
+	}
+
+	if len(ring) == 0 {
+		return members
+	}
+
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	h := crc32.ChecksumIEEE([]byte(c.Username()))
+	start := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= h
+	})
+
+	var r []string
+	seen := make(map[string]bool)
+	for i := 0; i < len(ring) && len(r) < len(members); i++ {
+		srv := ring[(start+i)%len(ring)].server
+		if !seen[srv] {
+			seen[srv] = true
+			r = append(r, srv)
+		}
+	}
+
+	// Servers with a weight of 0 aren't on the ring
+	for _, srv := range members {
+		if !seen[srv] {
+			r = append(r, srv)
+		}
+	}
+
+	return r
+}
+
+// healthOrder prefers the servers that answered the latest
+// health check the fastest, then the ones with fewer players
+func healthOrder(c *Conn, group string, members []string) []string {
+	latency := make(map[string]time.Duration)
+	cnt := make(map[string]int)
+	for _, srv := range members {
+		latency[srv] = Health(srv).Latency
+		cnt[srv] = len(ConnsServer(srv))
+	}
+
+	sort.SliceStable(members, func(i, j int) bool {
+		if latency[members[i]] != latency[members[j]] {
+			return latency[members[i]] < latency[members[j]]
+		}
+
+		return cnt[members[i]] < cnt[members[j]]
+	})
+
+	return members
+}
+
+// GroupStrategy returns the load balancing strategy of a group
+func GroupStrategy(group string) string {
+	strategy, ok := ConfKey("group_strategies:" + group).(string)
+	if _, valid := strategies[strategy]; !ok || !valid {
+		return StrategyLeastPlayers
+	}
+
+	return strategy
+}
+
+// groupCandidates returns the members of a group a player can be sent to
+// in the order they should be tried. Servers that are down, full,
+// in maintenance mode or that the player is already connected to are left out
+func groupCandidates(c *Conn, group string) []string {
+	grp, ok := ConfKey("groups:" + group).([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var members []string
+	for _, srv := range grp {
+		name := srv.(string)
+		if name == c.ServerName() || !ServerUp(name) || ServerFull(name) || !c.mayJoin(name) {
+			continue
+		}
+
+		members = append(members, name)
+	}
+
+	if len(members) == 0 {
+		return nil
+	}
+
+	sort.Strings(members)
+	return strategies[GroupStrategy(group)](c, group, members)
+}
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
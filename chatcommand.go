@@ -0,0 +1,539 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parameter types understood by the chat command parser
+const (
+	// ParamString is a single word
+	ParamString = iota
+	// ParamPlayer is the name of a connected player
+	ParamPlayer
+	// ParamServer is the name of a configured server
+	ParamServer
+	// ParamServerOrGroup is the name of a configured server or server group
+	ParamServerOrGroup
+	// ParamDuration is a duration like 90s or 5m, plain numbers are seconds
+	ParamDuration
+	// ParamPrivs is a comma-separated list of privileges,
+	// like ParamRest it takes the rest of the line and has to be
+	// the last parameter, so "interact, shout" is a single list
+	ParamPrivs
+	// ParamRest is the rest of the line, it has to be the last parameter
+	ParamRest
+)
+
+// A ChatCommandParam describes a parameter of a ChatCommand
+type ChatCommandParam struct {
+	Name     string
+	Type     int
+	Optional bool
+}
+
+// A ChatCommand is a proxy command that can be executed by clients
+// and (if enabled) the console
+type ChatCommand struct {
+	Name        string
+	Aliases     []string
+	Help        string
+	Params      []ChatCommandParam
+	Subcommands []*ChatCommand
+	Privs       map[string]bool
+	Console     bool
+	Cooldown    time.Duration
+	Func        func(*Conn, *ChatCommandArgs)
+
+	parent *ChatCommand
+
+	lastUseMu sync.Mutex
+	lastUse   map[string]time.Time
+}
+
+// ChatCommandArgs contains the parsed parameters of a command invocation
+type ChatCommandArgs struct {
+	raw    string
+	values map[string]interface{}
+}
+
+// A UsageError is returned if a command has been invoked with
+// missing or invalid parameters
+type UsageError struct {
+	Cmd *ChatCommand
+	Msg string
+}
+
+func (e *UsageError) Error() string {
+	return e.Msg + ". Usage: " + e.Cmd.Usage()
+}
+
+// privListSep matches a comma in a privilege list
+// together with the whitespace around it
+var privListSep = regexp.MustCompile(`\s*,\s*`)
+
+var chatCommands map[string]*ChatCommand
+var chatCommandAliases map[string]string
+
+// RegisterCommand registers a ChatCommand, replacing any existing
+// command with the same name
+func RegisterCommand(cmd *ChatCommand) {
+	cmd.init(nil)
+
+	chatCommands[cmd.Name] = cmd
+	for _, alias := range cmd.Aliases {
+		chatCommandAliases[alias] = cmd.Name
+	}
+}
+
+// RegisterChatCommand registers a callback function that is called
+// when a client executes the command and has the required privileges
+// The callback receives the unparsed rest of the line
+func RegisterChatCommand(name, help string, privs map[string]bool, console bool, function func(*Conn, string)) {
+	RegisterCommand(&ChatCommand{
+		Name:    name,
+		Help:    help,
+		Params:  []ChatCommandParam{{Name: "param", Type: ParamRest, Optional: true}},
+		Privs:   privs,
+		Console: console,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			function(c, args.Raw())
+		},
+	})
+}
+
+// ChatCommandByName returns the ChatCommand that has the specified
+// name or alias
+func ChatCommandByName(name string) *ChatCommand {
+	if cmd, ok := chatCommands[name]; ok {
+		return cmd
+	}
+
+	return chatCommands[chatCommandAliases[name]]
+}
+
+// ChatCommandNames returns the sorted names of all registered commands
+func ChatCommandNames() []string {
+	var names []string
+	for name := range chatCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (cmd *ChatCommand) init(parent *ChatCommand) {
+	cmd.parent = parent
+	cmd.lastUse = make(map[string]time.Time)
+
+	for _, sub := range cmd.Subcommands {
+		sub.init(cmd)
+	}
+}
+
+// FullName returns the name of the command including the names
+// of its parent commands
+func (cmd *ChatCommand) FullName() string {
+	if cmd.parent != nil {
+		return cmd.parent.FullName() + " " + cmd.Name
+	}
+
+	return cmd.Name
+}
+
+// Usage returns a usage string like "send <player> <server>"
+func (cmd *ChatCommand) Usage() string {
+	r := cmd.FullName()
+
+	if len(cmd.Subcommands) > 0 {
+		var subs []string
+		for _, sub := range cmd.Subcommands {
+			subs = append(subs, sub.Name)
+		}
+
+		r += " <" + strings.Join(subs, " | ") + ">"
+	}
+
+	for _, param := range cmd.Params {
+		name := param.Name
+		if param.Type == ParamRest {
+			name += "..."
+		}
+
+		if param.Optional {
+			r += " [" + name + "]"
+		} else {
+			r += " <" + name + ">"
+		}
+	}
+
+	return r
+}
+
+// HelpText returns the help string including the usage and aliases
+func (cmd *ChatCommand) HelpText() string {
+	r := cmd.Help
+	if r != "" && !strings.HasSuffix(r, ".") {
+		r += "."
+	}
+
+	r += " Usage: " + cmd.Usage()
+
+	if len(cmd.Aliases) > 0 {
+		r += " | Aliases: " + strings.Join(cmd.Aliases, ", ")
+	}
+
+	return strings.TrimSpace(r)
+}
+
+// RequiredPrivs returns the privileges required to run the command
+// including the ones required by its parent commands
+func (cmd *ChatCommand) RequiredPrivs() map[string]bool {
+	r := make(map[string]bool)
+	for c := cmd; c != nil; c = c.parent {
+		for priv, req := range c.Privs {
+			if req {
+				r[priv] = true
+			}
+		}
+	}
+
+	return r
+}
+
+func (cmd *ChatCommand) subcommand(name string) *ChatCommand {
+	for _, sub := range cmd.Subcommands {
+		if sub.Name == name {
+			return sub
+		}
+
+		for _, alias := range sub.Aliases {
+			if alias == name {
+				return sub
+			}
+		}
+	}
+
+	return nil
+}
+
+// cooldownLeft reports how long the player has to wait
+// before using the command again and records the use if
+// no waiting is required
+func (cmd *ChatCommand) cooldownLeft(name string) time.Duration {
+	if cmd.Cooldown <= 0 {
+		return 0
+	}
+
+	cmd.lastUseMu.Lock()
+	defer cmd.lastUseMu.Unlock()
+
+	if left := cmd.Cooldown - time.Since(cmd.lastUse[name]); left > 0 {
+		return left
+	}
+
+	cmd.lastUse[name] = time.Now()
+	return 0
+}
+
+func (cmd *ChatCommand) parse(param string) (*ChatCommandArgs, error) {
+	args := &ChatCommandArgs{
+		raw:    param,
+		values: make(map[string]interface{}),
+	}
+
+	// Spaces around the commas of a privilege list don't separate
+	// parameters, "#grant alice interact, shout" grants both
+	if n := len(cmd.Params); n > 0 && cmd.Params[n-1].Type == ParamPrivs {
+		param = privListSep.ReplaceAllString(param, ",")
+	}
+
+	words := strings.Fields(param)
+
+	required := 0
+	for _, p := range cmd.Params {
+		if !p.Optional {
+			required++
+		}
+	}
+
+	if len(words) < required {
+		return nil, &UsageError{Cmd: cmd, Msg: "Missing parameters"}
+	}
+
+	optional := len(words) - required
+	for i, p := range cmd.Params {
+		if p.Optional {
+			if optional <= 0 {
+				continue
+			}
+			optional--
+		} else {
+			required--
+		}
+
+		if p.Type == ParamRest || p.Type == ParamPrivs {
+			if i != len(cmd.Params)-1 {
+				return nil, fmt.Errorf("rest parameter %s of command %s is not the last parameter", p.Name, cmd.FullName())
+			}
+
+			if len(words) > 0 {
+				// Keep the original spacing of the remaining words
+				rest := skipWords(param, len(strings.Fields(param))-len(words))
+
+				v, err := parseParam(p, rest)
+				if err != nil {
+					return nil, &UsageError{Cmd: cmd, Msg: err.Error()}
+				}
+
+				args.values[p.Name] = v
+			}
+
+			words = nil
+			break
+		}
+
+		if len(words) == 0 {
+			break
+		}
+
+		v, err := parseParam(p, words[0])
+		if err != nil {
+			// An optional parameter followed by a rest parameter
+			// is left out if the word isn't valid for it,
+			// e.g. the delay in "#shutdown server update"
+			if p.Optional && i == len(cmd.Params)-2 && cmd.Params[i+1].Type == ParamRest {
+				optional++
+				continue
+			}
+
+			return nil, &UsageError{Cmd: cmd, Msg: err.Error()}
+		}
+
+		args.values[p.Name] = v
+		words = words[1:]
+	}
+
+	if len(words) > 0 {
+		return nil, &UsageError{Cmd: cmd, Msg: "Too many parameters"}
+	}
+
+	return args, nil
+}
+
+// skipWords removes the first n words from s
+func skipWords(s string, n int) string {
+	s = strings.TrimSpace(s)
+	for i := 0; i < n; i++ {
+		idx := strings.IndexAny(s, " \t")
+		if idx < 0 {
+			return ""
+		}
+
+		s = strings.TrimSpace(s[idx:])
+	}
+
+	return s
+}
+
+func parseParam(p ChatCommandParam, word string) (interface{}, error) {
+	switch p.Type {
+	case ParamPlayer:
+		c := ConnByUsername(word)
+		if c == nil {
+			return nil, fmt.Errorf("%s is not online", word)
+		}
+		return c, nil
+	case ParamServer:
+		if _, ok := ConfKey("servers:" + word + ":address").(string); !ok {
+			return nil, fmt.Errorf("Unknown servername %s", word)
+		}
+		return word, nil
+	case ParamServerOrGroup:
+		_, isSrv := ConfKey("servers:" + word + ":address").(string)
+		_, isGrp := ConfKey("groups:" + word).([]interface{})
+		if !isSrv && !isGrp {
+			return nil, fmt.Errorf("Unknown servername %s", word)
+		}
+		return word, nil
+	case ParamDuration:
+		if secs, err := strconv.Atoi(word); err == nil {
+			return time.Duration(secs) * time.Second, nil
+		}
+
+		d, err := time.ParseDuration(word)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid duration %s", word)
+		}
+		return d, nil
+	case ParamPrivs:
+		privs := make(map[string]bool)
+		for _, priv := range strings.Split(strings.Join(strings.Fields(word), ""), ",") {
+			if priv != "" {
+				privs[priv] = true
+			}
+		}
+
+		if len(privs) == 0 {
+			return nil, fmt.Errorf("No privileges specified")
+		}
+		return privs, nil
+	default:
+		return word, nil
+	}
+}
+
+// Raw returns the unparsed parameters
+func (a *ChatCommandArgs) Raw() string { return a.raw }
+
+// Has reports whether an optional parameter has been specified
+func (a *ChatCommandArgs) Has(name string) bool {
+	_, ok := a.values[name]
+	return ok
+}
+
+// String returns the value of a ParamString, ParamServer,
+// ParamServerOrGroup or ParamRest parameter
+func (a *ChatCommandArgs) String(name string) string {
+	s, _ := a.values[name].(string)
+	return s
+}
+
+// Conn returns the value of a ParamPlayer parameter
+func (a *ChatCommandArgs) Conn(name string) *Conn {
+	c, _ := a.values[name].(*Conn)
+	return c
+}
+
+// Duration returns the value of a ParamDuration parameter
+func (a *ChatCommandArgs) Duration(name string) time.Duration {
+	d, _ := a.values[name].(time.Duration)
+	return d
+}
+
+// Privs returns the value of a ParamPrivs parameter
+func (a *ChatCommandArgs) Privs(name string) map[string]bool {
+	privs, _ := a.values[name].(map[string]bool)
+	return privs
+}
+
+// ExecuteChatCommand runs a command line (without the command prefix)
+// on behalf of a Conn or the console if c is nil
+func ExecuteChatCommand(c *Conn, line string) {
+	var operator string
+	if c != nil {
+		operator = c.Username()
+	}
+
+	executeCommand(c, operator, line)
+}
+
+// ExecuteConsoleCommand runs a console command line on behalf
+// of the player with the specified name, the output is logged
+func ExecuteConsoleCommand(operator, line string) {
+	executeCommand(nil, operator, line)
+}
+
+// executeCommand runs a command line, privileges and cooldowns
+// are checked for the operator unless it is empty
+func executeCommand(c *Conn, operator, line string) {
+	line = strings.TrimSpace(line)
+
+	name := strings.SplitN(line, " ", 2)[0]
+	param := strings.TrimSpace(strings.TrimPrefix(line, name))
+
+	cmd := ChatCommandByName(name)
+	if cmd == nil {
+		var suggestions []string
+		for _, cmdname := range ChatCommandNames() {
+			if name == "" || !strings.HasPrefix(cmdname, name) {
+				continue
+			}
+
+			if c == nil && !chatCommands[cmdname].Console {
+				continue
+			}
+
+			if operator != "" {
+				if has, err := CheckPrivs(operator, chatCommands[cmdname].RequiredPrivs()); err != nil || !has {
+					continue
+				}
+			}
+
+			suggestions = append(suggestions, cmdname)
+		}
+
+		if len(suggestions) > 0 {
+			SendChatMsg(c, "Unknown command "+name+". Did you mean: "+strings.Join(suggestions, ", ")+"?")
+		} else {
+			SendChatMsg(c, "Unknown command "+name+".")
+		}
+		return
+	}
+
+	if c == nil && !cmd.Console {
+		log.Print("This command is not available to the console!")
+		return
+	}
+
+	// Descend into subcommands
+	for len(cmd.Subcommands) > 0 {
+		subname := strings.SplitN(param, " ", 2)[0]
+
+		sub := cmd.subcommand(subname)
+		if sub == nil {
+			if subname == "" {
+				SendChatMsg(c, (&UsageError{Cmd: cmd, Msg: "Missing subcommand"}).Error())
+			} else {
+				SendChatMsg(c, (&UsageError{Cmd: cmd, Msg: "Unknown subcommand " + subname}).Error())
+			}
+			return
+		}
+
+		cmd = sub
+		param = strings.TrimSpace(strings.TrimPrefix(param, subname))
+	}
+
+	if operator != "" {
+		privs := cmd.RequiredPrivs()
+
+		allow, err := CheckPrivs(operator, privs)
+		if err != nil {
+			log.Print(err)
+			SendChatMsg(c, "An internal error occured while attempting to check your privileges")
+			return
+		}
+
+		if !allow {
+			SendChatMsg(c, "You do not have permission to run this command! Required privileges: "+strings.Replace(encodePrivs(privs), "|", " ", -1))
+			return
+		}
+	}
+
+	args, err := cmd.parse(param)
+	if err != nil {
+		SendChatMsg(c, err.Error())
+		return
+	}
+
+	if operator != "" {
+		if left := cmd.cooldownLeft(operator); left > 0 {
+			SendChatMsg(c, "Please wait "+strconv.Itoa(int(left.Seconds())+1)+"s before using this command again.")
+			return
+		}
+	}
+
+	if cmd.Func == nil {
+		SendChatMsg(c, (&UsageError{Cmd: cmd, Msg: "Missing subcommand"}).Error())
+		return
+	}
+
+	cmd.Func(c, args)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+)
+
+// clientState records the state servers have set on a client
+// that lasts until it is changed again, so that Redirect
+// can restore the defaults before the next server takes over
+// ToClientPlayerSpeed isn't recorded, it only adds to the velocity once
+type clientState struct {
+	changed          map[uint16]bool
+	particleSpawners map[uint32]bool
+	players          map[string]bool
+	physics          bool
+}
+
+func newClientState() clientState {
+	return clientState{
+		changed:          make(map[uint16]bool),
+		particleSpawners: make(map[uint32]bool),
+		players:          make(map[string]bool),
+	}
+}
+
+// stateResets build the commands that restore the default state
+// after a command has been received from a server
+var stateResets = map[uint16]func() Cmd{
+	ToClientShowFormspec: func() Cmd {
+		// An empty formspec closes the open one
+		return &ToCltShowFormspec{}
+	},
+	ToClientInventoryFormspec: func() Cmd { return &ToCltInvFormspec{} },
+	ToClientFOV:               func() Cmd { return &ToCltFOV{} },
+	ToClientBreath:            func() Cmd { return &ToCltBreath{Breath: 10} },
+	ToClientLocalPlayerAnimations: func() Cmd {
+		return &ToCltLocalPlayerAnim{}
+	},
+	ToClientMinimapModes: func() Cmd {
+		// The labels are chosen by the client
+		modes := &ToCltMinimapModes{}
+		for _, mode := range []MinimapMode{
+			{Type: 0},
+			{Type: 1, Size: 256}, {Type: 1, Size: 128}, {Type: 1, Size: 64},
+			{Type: 2, Size: 512}, {Type: 2, Size: 256}, {Type: 2, Size: 128},
+		} {
+			mode.Scale = 1
+			modes.Modes = append(modes.Modes, mode)
+		}
+		return modes
+	},
+	ToClientHudSetFlags: func() Cmd {
+		// Hotbar, healthbar, crosshair, wielditem, breathbar, minimap, radar
+		return &ToCltHUDSetFlags{Flags: 0x7F, Mask: 0x7F}
+	},
+	ToClientOverrideDayNightRatio: func() Cmd { return &ToCltOverrideDayNightRatio{} },
+	ToClientEyeOffset:             func() Cmd { return &ToCltEyeOffset{} },
+	ToClientSetSky: func() Cmd {
+		return &ToCltSetSky{
+			Type:        "regular",
+			Clouds:      true,
+			SunFogTint:  Color{255, 255, 255, 255},
+			MoonFogTint: Color{255, 255, 255, 255},
+			FogTintType: "default",
+			Colors:      DefaultSkyColors,
+			FogDistance: -1,
+			FogStart:    -1,
+		}
+	},
+	ToClientSetSun: func() Cmd {
+		return &ToCltSetSun{
+			Visible:        true,
+			Texture:        "sun.png",
+			ToneMap:        "sun_tonemap.png",
+			Sunrise:        "sunrisebg.png",
+			SunriseVisible: true,
+			Scale:          1,
+		}
+	},
+	ToClientSetMoon: func() Cmd {
+		return &ToCltSetMoon{
+			Visible: true,
+			Texture: "moon.png",
+			ToneMap: "moon_tonemap.png",
+			Scale:   1,
+		}
+	},
+	ToClientSetStars: func() Cmd {
+		return &ToCltSetStars{
+			Visible: true,
+			Count:   1000,
+			Color:   Color{105, 235, 235, 255},
+			Scale:   1,
+		}
+	},
+	ToClientSetLighting: func() Cmd {
+		return &ToCltSetLighting{
+			Saturation: 1,
+			Exposure:   DefaultExposure,
+		}
+	},
+	ToClientCloudParams: func() Cmd {
+		return &ToCltCloudParams{
+			Density:      0.4,
+			DiffuseColor: Color{229, 240, 240, 255},
+			AmbientColor: Color{255, 0, 0, 0},
+			Height:       120,
+			Thickness:    16,
+			Speed:        [2]float32{0, -2},
+		}
+	},
+}
+
+// recordState updates the clientState of a client
+// after a server using protocol version proto has sent a command to it
+func (c *Conn) recordState(cmd uint16, r *bytes.Reader, proto uint16) {
+	switch cmd {
+	case ToClientShowFormspec:
+		show := &ToCltShowFormspec{}
+		if decode(show, r, proto) {
+			// An empty formspec closes the open one
+			c.state.changed[cmd] = show.Formspec != ""
+		}
+	case ToClientDeleteParticleSpawner:
+		del := &ToCltDeleteParticleSpawner{}
+		if decode(del, r, proto) {
+			delete(c.state.particleSpawners, del.ID)
+		}
+	case ToClientUpdatePlayerList:
+		list := &ToCltUpdatePlayerList{}
+		if !decode(list, r, proto) {
+			return
+		}
+
+		for _, name := range list.Players {
+			if list.Type == PlayerListRemove {
+				delete(c.state.players, name)
+			} else {
+				c.state.players[name] = true
+			}
+		}
+	default:
+		c.state.changed[cmd] = true
+	}
+}
+
+// resetState restores the defaults of everything
+// the current server has changed on the client
+func (c *Conn) resetState() error {
+	var cmds []Cmd
+
+	var changed []int
+	for cmd, ok := range c.state.changed {
+		if ok {
+			changed = append(changed, int(cmd))
+		}
+	}
+	sort.Ints(changed)
+
+	for _, cmd := range changed {
+		cmds = append(cmds, stateResets[uint16(cmd)]())
+	}
+
+	for id := range c.state.particleSpawners {
+		cmds = append(cmds, &ToCltDeleteParticleSpawner{ID: id})
+	}
+
+	if len(c.state.players) > 0 {
+		list := &ToCltUpdatePlayerList{Type: PlayerListRemove}
+		for name := range c.state.players {
+			list.Players = append(list.Players, name)
+		}
+		cmds = append(cmds, list)
+	}
+
+	if c.state.physics {
+		cmds = append(cmds, &ToCltAOMsgs{
+			Msgs: []AOMsg{{ID: c.localPlayerCao, Msg: DefaultPhysics.marshal()}},
+		})
+	}
+
+	for _, cmd := range cmds {
+		if _, err := c.SendCmd(cmd); err != nil {
+			return err
+		}
+	}
+
+	c.state = newClientState()
+	return nil
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"crypto/subtle"
 	"encoding/binary"
-	"io"
 	"log"
 
 	"github.com/HimbeerserverDE/srp"
@@ -67,34 +66,38 @@ const (
 	ToClientSetSun                = 0x5A
 	ToClientSetMoon               = 0x5B
 	ToClientSetStars              = 0x5C
+	ToClientMovePlayerRel         = 0x5D
 	ToClientSrpBytesSB            = 0x60
 	ToClientFormspecPrepend       = 0x61
 	ToClientMinimapModes          = 0x62
+	ToClientSetLighting           = 0x63
 )
 
 const (
-	ToServerInit            = 0x02
-	ToServerInit2           = 0x11
-	ToServerModChannelJoin  = 0x17
-	ToServerModChannelLeave = 0x18
-	ToServerModChannelMsg   = 0x19
-	ToServerPlayerPos       = 0x23
-	ToServerGotBlocks       = 0x24
-	ToServerDeletedBlocks   = 0x25
-	ToServerInventoryAction = 0x31
-	ToServerChatMessage     = 0x32
-	ToServerDamage          = 0x35
-	ToServerPlayerItem      = 0x37
-	ToServerRespawn         = 0x38
-	ToServerInteract        = 0x39
-	ToServerRemovedSounds   = 0x3A
-	ToServerNodeMetaFields  = 0x3B
-	ToServerInventoryFields = 0x3C
-	ToServerRequestMedia    = 0x40
-	ToServerClientReady     = 0x43
-	ToServerFirstSRP        = 0x50
-	ToServerSRPBytesA       = 0x51
-	ToServerSRPBytesM       = 0x52
+	ToServerInit             = 0x02
+	ToServerInit2            = 0x11
+	ToServerModChannelJoin   = 0x17
+	ToServerModChannelLeave  = 0x18
+	ToServerModChannelMsg    = 0x19
+	ToServerPlayerPos        = 0x23
+	ToServerGotBlocks        = 0x24
+	ToServerDeletedBlocks    = 0x25
+	ToServerInventoryAction  = 0x31
+	ToServerChatMessage      = 0x32
+	ToServerDamage           = 0x35
+	ToServerPlayerItem       = 0x37
+	ToServerRespawn          = 0x38
+	ToServerInteract         = 0x39
+	ToServerRemovedSounds    = 0x3A
+	ToServerNodeMetaFields   = 0x3B
+	ToServerInventoryFields  = 0x3C
+	ToServerRequestMedia     = 0x40
+	ToServerClientReady      = 0x43
+	ToServerHaveMedia        = 0x44
+	ToServerFirstSRP         = 0x50
+	ToServerSRPBytesA        = 0x51
+	ToServerSRPBytesM        = 0x52
+	ToServerUpdateClientInfo = 0x53
 )
 
 const (
@@ -114,6 +117,10 @@ const (
 )
 
 func processPktCommand(src, dst *Conn, pkt *rudp.Pkt) bool {
+	if processPktHooks(src, dst, pkt) {
+		return true
+	}
+
 	r := ByteReader(*pkt)
 
 	origReader := *r
@@ -125,41 +132,43 @@ func processPktCommand(src, dst *Conn, pkt *rudp.Pkt) bool {
 	if src.IsSrv() {
 		switch cmd := binary.BigEndian.Uint16(cmdBytes); cmd {
 		case ToClientActiveObjectRemoveAdd:
-			pkt.Reader = bytes.NewReader(append(cmdBytes, processAoRmAdd(dst, r)...))
+			rmAdd := &ToCltAORmAdd{}
+			if !decode(rmAdd, r, src.ProtoVer()) {
+				return false
+			}
+
+			processAoRmAdd(dst, rmAdd)
+			pkt.Reader = bytes.NewReader(EncodeCmd(rmAdd, src.ProtoVer()))
 			return false
 		case ToClientActiveObjectMessages:
-			pkt.Reader = bytes.NewReader(append(cmdBytes, processAoMsgs(dst, r)...))
+			msgs := &ToCltAOMsgs{}
+			if !decode(msgs, r, src.ProtoVer()) {
+				return false
+			}
+
+			processAoMsgs(dst, msgs)
+			pkt.Reader = bytes.NewReader(EncodeCmd(msgs, src.ProtoVer()))
 			return false
 		case ToClientChatMessage:
-			r.Seek(2, io.SeekCurrent)
-
-			ReadBytes16(r)
-			msg := ReadBytes16(r)
-
-			w := bytes.NewBuffer([]byte{0x00, ToServerChatMessage})
-			WriteBytes16(w, msg)
+			msg := &ToCltChatMsg{}
+			if !decode(msg, r, src.ProtoVer()) {
+				return false
+			}
 
-			return processServerChatMessage(dst, rudp.Pkt{
-				Reader: w,
-				PktInfo: rudp.PktInfo{
-					Channel: pkt.Channel,
-				},
-			})
+			return processServerChatMessage(dst, msg)
 		case ToClientModChannelSignal:
-			r.Seek(1, io.SeekCurrent)
-
-			ch := string(ReadBytes16(r))
-
-			state := ReadUint8(r)
-
-			r.Seek(2, io.SeekStart)
+			sig := &ToCltModChanSig{}
+			if !decode(sig, r, src.ProtoVer()) {
+				return false
+			}
 
-			if ch == rpcCh {
-				switch sig := ReadUint8(r); sig {
+			if sig.Channel == rpcCh {
+				switch sig.Signal {
 				case ModChSigJoinOk:
 					src.SetUseRPC(true)
+					go src.doRPC("->CMDS "+rpcCommandList(), "--")
 				case ModChSigSetState:
-					if state == ModChStateRO {
+					if sig.State == ModChStateRO {
 						src.SetUseRPC(false)
 					}
 				}
@@ -170,70 +179,70 @@ func processPktCommand(src, dst *Conn, pkt *rudp.Pkt) bool {
 		case ToClientModChannelMSG:
 			return processRPC(src, r)
 		case ToClientBlockdata:
-			data, drop := processBlockdata(dst, r)
-			if drop {
+			blk := &ToCltBlkData{}
+			if !decode(blk, r, src.ProtoVer()) {
 				return true
 			}
 
-			pkt.Reader = bytes.NewReader(append(cmdBytes, data...))
+			processBlockdata(dst, blk)
+			pkt.Reader = bytes.NewReader(EncodeCmd(blk, src.ProtoVer()))
 			return false
 		case ToClientAddNode:
-			pkt.Reader = bytes.NewReader(append(cmdBytes, processAddnode(dst, r)...))
+			add := &ToCltAddNode{}
+			if !decode(add, r, src.ProtoVer()) {
+				return true
+			}
+
+			processAddnode(dst, add)
+			pkt.Reader = bytes.NewReader(EncodeCmd(add, src.ProtoVer()))
 			return false
 		case ToClientHudAdd:
-			id := ReadUint32(r)
-			dst.huds[id] = true
+			hud := &ToCltHUDAdd{}
+			if decode(hud, r, src.ProtoVer()) {
+				dst.huds[hud.ID] = true
+			}
 			return false
 		case ToClientHudRM:
-			id := ReadUint32(r)
-			dst.huds[id] = false
+			hud := &ToCltRmHUD{}
+			if decode(hud, r, src.ProtoVer()) {
+				dst.huds[hud.ID] = false
+			}
 			return false
 		case ToClientPlaySound:
-			id := int32(ReadUint32(r))
-			namelen := ReadUint16(r)
-			r.Seek(int64(17+namelen), io.SeekStart)
-			objID := ReadUint16(r)
-
-			if objID == dst.currentPlayerCao {
-				objID = dst.localPlayerCao
-			} else if objID == dst.localPlayerCao {
-				objID = dst.currentPlayerCao
+			sound := &ToCltPlaySound{}
+			if !decode(sound, r, src.ProtoVer()) {
+				return false
 			}
 
-			r.Seek(2, io.SeekStart)
-
-			data := make([]byte, r.Len())
-			r.Read(data)
+			sound.SrcAOID = dst.swapPlayerCao(sound.SrcAOID)
+			pkt.Reader = bytes.NewReader(EncodeCmd(sound, src.ProtoVer()))
 
-			binary.BigEndian.PutUint16(data[17+namelen:19+namelen], objID)
-
-			pkt.Reader = bytes.NewReader(append(cmdBytes, data...))
-
-			if loop := ReadUint8(r); loop > 0 {
-				dst.sounds[id] = true
+			if sound.Loop {
+				dst.sounds[sound.ID] = true
 			}
 		case ToClientStopSound:
-			id := int32(ReadUint32(r))
-			dst.sounds[id] = false
+			sound := &ToCltStopSound{}
+			if decode(sound, r, src.ProtoVer()) {
+				dst.sounds[sound.ID] = false
+			}
 		case ToClientAddParticleSpawner:
-			r.Seek(97, io.SeekStart)
-			texturelen := ReadUint32(r)
-			r.Seek(int64(6+texturelen), io.SeekCurrent)
-			id := ReadUint16(r)
-
-			if id == dst.currentPlayerCao {
-				id = dst.localPlayerCao
-			} else if id == dst.localPlayerCao {
-				id = dst.currentPlayerCao
+			spawner := &ToCltAddParticleSpawner{}
+			if !decode(spawner, r, src.ProtoVer()) {
+				return false
 			}
 
-			r.Seek(2, io.SeekStart)
-
-			data := make([]byte, r.Len())
-			r.Read(data)
-
-			binary.BigEndian.PutUint16(data[107+texturelen:109+texturelen], id)
-			pkt.Reader = bytes.NewReader(append(cmdBytes, data...))
+			dst.state.particleSpawners[spawner.ID] = true
+
+			spawner.AttachedAO = dst.swapPlayerCao(spawner.AttachedAO)
+			pkt.Reader = bytes.NewReader(EncodeCmd(spawner, src.ProtoVer()))
+		case ToClientShowFormspec, ToClientInventoryFormspec, ToClientFOV,
+			ToClientBreath, ToClientLocalPlayerAnimations, ToClientMinimapModes,
+			ToClientHudSetFlags, ToClientOverrideDayNightRatio, ToClientEyeOffset,
+			ToClientSetSky, ToClientSetSun, ToClientSetMoon, ToClientSetStars,
+			ToClientCloudParams, ToClientDeleteParticleSpawner, ToClientUpdatePlayerList,
+			ToClientSetLighting:
+			dst.recordState(cmd, r, src.ProtoVer())
+			return false
 		case ToClientInventory:
 			old := *dst.Inv()
 
@@ -255,55 +264,83 @@ func processPktCommand(src, dst *Conn, pkt *rudp.Pkt) bool {
 				return false
 			}
 
-			reason := ReadUint8(r)
+			denied := &ToCltAccessDenied{}
+			if !decode(denied, r, src.ProtoVer()) {
+				return false
+			}
 
-			if reason != uint8(AccessDeniedShutdown) && reason != uint8(AccessDeniedCrash) {
+			if denied.Reason != AccessDeniedShutdown && denied.Reason != AccessDeniedCrash {
 				return false
 			}
 
 			msg := "shut down"
-			if reason == uint8(AccessDeniedCrash) {
+			if denied.Reason == AccessDeniedCrash {
 				msg = "crashed"
 			}
 
-			defsrv, ok := ConfKey("default_server").(string)
-			if !ok {
-				log.Print("Default server name not set or not a string")
+			server := dst.ServerName()
+			markServerDown(server)
+
+			fallback := FallbackServer(server)
+			if fallback == "" {
 				return false
 			}
 
-			if dst.ServerName() == defsrv {
+			// The kick may come from a prewarmed connection
+			// that is being attached by Redirect, so the fallback
+			// can't be redirected to from here
+			// Stop forwarding so that the disconnect
+			// of the server doesn't close the client
+			src.haltForwarding()
+			go fallbackAfterCrash(dst, server, fallback, msg, denied)
+			return true
+		case ToClientMedia:
+			// Only files requested by the proxy are sent after joining
+			if len(src.mediaPushes) == 0 {
 				return false
 			}
 
-			dst.SendChatMsg("The minetest server has " + msg + ", connecting you to the default server...")
-
-			go dst.Redirect(defsrv)
-
-			for src.Forward() {
+			files := &ToCltMedia{}
+			if !decode(files, r, src.ProtoVer()) {
+				return false
 			}
 
-			return true
+			return src.pushRequestedMedia(dst, files)
 		case ToClientMediaPush:
-			digest := ReadBytes16(r)
-			name := string(ReadBytes16(r))
-			cacheByte := ReadUint8(r)
-			cache := cacheByte == uint8(1)
+			push := &ToCltMediaPush{}
 
-			r.Seek(5, io.SeekCurrent)
-			data := make([]byte, r.Len())
-			r.Read(data)
+			// Newer servers only send a token, the client requests
+			// the file from the server it is connected to
+			if src.ProtoVer() >= Proto40 {
+				if dst.ProtoVer() >= Proto40 {
+					return false
+				}
 
-			media[string(name)] = &mediaFile{
-				digest:  digest,
-				data:    data,
-				noCache: !cache,
+				// Older clients expect the file itself
+				if decode(push, r, src.ProtoVer()) {
+					src.requestPushedMedia(dst, push)
+				} else {
+					LogWarn(dst.LogFields(), "Dropping a pushed file the client can't request")
+				}
+				return true
 			}
 
+			if !decode(push, r, src.ProtoVer()) {
+				return true
+			}
+
+			f := &mediaFile{
+				digest:  push.Digest,
+				data:    push.Data,
+				noCache: !push.Cache,
+			}
+			media[push.Name] = f
+
 			for _, conn := range Conns() {
-				ack, err := conn.Send(*pkt)
+				ack, err := conn.pushMedia(push.Name, f)
 				if err != nil {
 					log.Print(err)
+					continue
 				}
 				<-ack
 			}
@@ -316,17 +353,56 @@ func processPktCommand(src, dst *Conn, pkt *rudp.Pkt) bool {
 		}
 	} else {
 		switch cmd := binary.BigEndian.Uint16(cmdBytes); cmd {
+		case ToServerPlayerPos, ToServerInteract, ToServerInventoryAction:
+			src.markActive()
+			return false
 		case ToServerChatMessage:
-			return processChatMessage(src, r)
+			src.markActive()
+			msg := &ToSrvChatMsg{}
+			if !decode(msg, r, src.ProtoVer()) {
+				return true
+			}
+
+			return processChatMessage(src, msg)
+		case ToServerInventoryFields:
+			return processFormFields(src, r)
+		case ToServerRequestMedia:
+			rq := &ToSrvReqMedia{}
+			if !decode(rq, r, src.ProtoVer()) {
+				return true
+			}
+
+			// Files pushed by the proxy are sent by the proxy
+			for _, name := range rq.Files {
+				if f, ok := media[name]; !ok || f.data == nil {
+					return false
+				}
+			}
+
+			src.sendMedia(rq.Files)
+			return true
+		case ToServerHaveMedia:
+			have := &ToSrvHaveMedia{}
+			if !decode(have, r, src.ProtoVer()) {
+				return true
+			}
+
+			for _, token := range have.Tokens {
+				if token&proxyMediaToken == 0 {
+					return false
+				}
+			}
+
+			return true
 		case ToServerFirstSRP:
 			if src.sudoMode {
 				src.sudoMode = false
 
 				// This is a password change, save verifier and salt
-				s := ReadBytes16(r)
-				v := ReadBytes16(r)
-
-				SetPassword(src.Username(), v, s)
+				srp := &ToSrvFirstSRP{}
+				if decode(srp, r, src.ProtoVer()) {
+					SetPassword(src.Username(), srp.Verifier, srp.Salt)
+				}
 			} else {
 				log.Print("User " + src.Username() + " at " + src.Addr().String() + " did not enter sudo mode before attempting to change the password")
 			}
@@ -334,7 +410,10 @@ func processPktCommand(src, dst *Conn, pkt *rudp.Pkt) bool {
 			return true
 		case ToServerSRPBytesA:
 			if !src.sudoMode {
-				A := ReadBytes16(r)
+				bytesA := &ToSrvSRPBytesA{}
+				if !decode(bytesA, r, src.ProtoVer()) {
+					return true
+				}
 
 				v, s, err := Password(src.Username())
 				if err != nil {
@@ -342,31 +421,18 @@ func processPktCommand(src, dst *Conn, pkt *rudp.Pkt) bool {
 					return true
 				}
 
-				B, _, K, err := srp.Handshake(A, v)
+				B, _, K, err := srp.Handshake(bytesA.A, v)
 				if err != nil {
 					log.Print(err)
 					return true
 				}
 
 				src.srp_s = s
-				src.srp_A = A
+				src.srp_A = bytesA.A
 				src.srp_B = B
 				src.srp_K = K
 
-				// Send SRP_BYTES_S_B
-				data := make([]byte, 6+len(s)+len(B))
-				data[0] = uint8(0x00)
-				data[1] = uint8(ToClientSrpBytesSB)
-				binary.BigEndian.PutUint16(data[2:4], uint16(len(s)))
-				copy(data[4:4+len(s)], s)
-				binary.BigEndian.PutUint16(data[4+len(s):6+len(s)], uint16(len(B)))
-				copy(data[6+len(s):6+len(s)+len(B)], B)
-
-				w := bytes.NewBuffer([]byte{0x00, ToClientSrpBytesSB})
-				WriteBytes16(w, s)
-				WriteBytes16(w, B)
-
-				ack, err := src.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
+				ack, err := src.SendCmd(&ToCltSRPBytesSaltB{Salt: s, B: B})
 				if err != nil {
 					log.Print(err)
 					return true
@@ -376,98 +442,71 @@ func processPktCommand(src, dst *Conn, pkt *rudp.Pkt) bool {
 			return true
 		case ToServerSRPBytesM:
 			if !src.sudoMode {
-				M := ReadBytes16(r)
+				bytesM := &ToSrvSRPBytesM{}
+				if !decode(bytesM, r, src.ProtoVer()) {
+					return true
+				}
+
 				M2 := srp.ClientProof([]byte(src.Username()), src.srp_s, src.srp_A, src.srp_B, src.srp_K)
 
-				if subtle.ConstantTimeCompare(M, M2) == 1 {
+				var answer Cmd
+				if subtle.ConstantTimeCompare(bytesM.M, M2) == 1 {
 					// Password is correct
 					// Enter sudo mode
 					src.sudoMode = true
-
-					// Send ACCEPT_SUDO_MODE
-					data := []byte{0, ToClientAcceptSudoMode}
-
-					ack, err := src.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
-					if err != nil {
-						log.Print(err)
-						return true
-					}
-					<-ack
+					answer = &ToCltAcceptSudoMode{}
 				} else {
 					// Client supplied wrong password
 					log.Print("User " + src.Username() + " at " + src.Addr().String() + " supplied wrong password for sudo mode")
+					answer = &ToCltDenySudoMode{}
+				}
 
-					// Send DENY_SUDO_MODE
-					data := []byte{0, ToClientDenySudoMode}
-
-					ack, err := src.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
-					if err != nil {
-						log.Print(err)
-						return true
-					}
-					<-ack
+				ack, err := src.SendCmd(answer)
+				if err != nil {
+					log.Print(err)
+					return true
 				}
+				<-ack
 			}
 			return true
-		case ToServerModChannelJoin:
-			deny := func() {
-				data := make([]byte, 5+len(rpcCh))
-				data[0] = uint8(0x00)
-				data[1] = uint8(ToClientModChannelSignal)
-				data[2] = uint8(ModChSigJoinFail)
-				binary.BigEndian.PutUint16(data[3:5], uint16(len(rpcCh)))
-				copy(data[5:], []byte(rpcCh))
-
-				ack, err := src.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
+		case ToServerModChannelJoin, ToServerModChannelLeave:
+			deny := func(sig uint8) {
+				ack, err := src.SendCmd(&ToCltModChanSig{
+					Signal:  sig,
+					Channel: rpcCh,
+				})
 				if err != nil {
 					log.Print(err)
+					return
 				}
 				<-ack
 			}
 
-			chAllowed, ok := ConfKey("modchannels").(bool)
-			if ok && !chAllowed {
-				deny()
-				return true
-			}
+			join := cmd == ToServerModChannelJoin
 
-			ch := string(ReadBytes16(r))
-			if ch == rpcCh {
-				deny()
-				return true
-			}
-
-			src.modChs[ch] = true
-			return false
-		case ToServerModChannelLeave:
-			deny := func() {
-				data := make([]byte, 5+len(rpcCh))
-				data[0] = uint8(0x00)
-				data[1] = uint8(ToClientModChannelSignal)
-				data[2] = uint8(ModChSigLeaveFail)
-				binary.BigEndian.PutUint16(data[3:5], uint16(len(rpcCh)))
-				copy(data[5:], []byte(rpcCh))
-
-				ack, err := src.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
-				if err != nil {
-					log.Print(err)
-				}
-				<-ack
+			failSig := uint8(ModChSigLeaveFail)
+			if join {
+				failSig = ModChSigJoinFail
 			}
 
 			chAllowed, ok := ConfKey("modchannels").(bool)
 			if ok && !chAllowed {
-				deny()
+				deny(failSig)
 				return true
 			}
 
-			ch := string(ReadBytes16(r))
-			if ch == rpcCh {
-				deny()
+			// ToSrvLeaveModChan has the same layout
+			ch := &ToSrvJoinModChan{}
+			if !decode(ch, r, src.ProtoVer()) {
+				return true
+			}
+
+			if ch.Channel == rpcCh {
+				deny(failSig)
 				return true
 			}
 
-			src.modChs[ch] = false
+			src.modChs[ch.Channel] = join
 			return false
 		case ToServerModChannelMsg:
 			chAllowed, ok := ConfKey("modchannels").(bool)
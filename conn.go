@@ -32,6 +32,7 @@ type Conn struct {
 
 	stopforward bool
 	forwardMu   sync.RWMutex
+	pktMu       sync.Mutex
 
 	redirectMu sync.Mutex
 	srvMu      sync.RWMutex
@@ -51,6 +52,20 @@ type Conn struct {
 	sounds map[int32]bool
 	blocks [][3]int16
 	inv    *mt.Inv
+	state  clientState
+
+	// Files pushed by the server that the proxy requests
+	// for a client using a version before Proto40
+	mediaPushes map[string]*ToCltMediaPush
+
+	helpFilter string
+	helpCmds   []string
+
+	lastActive int64
+
+	prewarmMu      sync.Mutex
+	prewarmed      *prewarmConn
+	redirectCancel chan struct{}
 }
 
 // ProtoVer returns the protocol version of the Conn
@@ -68,6 +83,17 @@ func (c *Conn) Addr() net.Addr {
 // if it isn't a server
 func (c *Conn) Username() string { return c.username }
 
+// Send sends a packet to the Conn
+// Packets sent to a client are captured here, so that the packets
+// the proxy generates itself end up in the capture as well
+func (c *Conn) Send(pkt rudp.Pkt) (<-chan struct{}, error) {
+	if !c.IsSrv() {
+		capturePkt(c, c, true, &pkt)
+	}
+
+	return c.Conn.Send(pkt)
+}
+
 // Forward reports whether the Proxy func should continue or stop
 func (c *Conn) Forward() bool {
 	c.forwardMu.RLock()
@@ -77,11 +103,20 @@ func (c *Conn) Forward() bool {
 }
 
 // stopForwarding tells the Proxy func to stop
+// and waits until it has forwarded the current packet
 func (c *Conn) stopForwarding() {
-	c.forwardMu.Lock()
-	defer c.forwardMu.Unlock()
+	c.haltForwarding()
+
+	c.pktMu.Lock()
+	c.pktMu.Unlock()
+}
 
+// haltForwarding tells the Proxy func to stop without waiting,
+// so it can be called while a packet of the Conn is being forwarded
+func (c *Conn) haltForwarding() {
+	c.forwardMu.Lock()
 	c.stopforward = true
+	c.forwardMu.Unlock()
 }
 
 // Server returns the Conn this Conn is connected to
@@ -96,9 +131,27 @@ func (c *Conn) Server() *Conn {
 // ServerName returns the name of the Conn this Conn is connected to
 // if this Conn is not a server
 func (c *Conn) ServerName() string {
+	srv := c.Server()
+	if srv == nil {
+		return ""
+	}
+
+	servers := ConfKey("servers").(map[interface{}]interface{})
+	for server := range servers {
+		if ConfKey("servers:"+server.(string)+":address") == srv.Addr().String() {
+			return server.(string)
+		}
+	}
+
+	return ""
+}
+
+// ServerNameByAddr returns the name of the server
+// running at the specified address
+func ServerNameByAddr(addr string) string {
 	servers := ConfKey("servers").(map[interface{}]interface{})
 	for server := range servers {
-		if ConfKey("servers:"+server.(string)+":address") == c.Server().Addr().String() {
+		if ConfKey("servers:"+server.(string)+":address") == addr {
 			return server.(string)
 		}
 	}
@@ -146,16 +199,11 @@ func (c *Conn) Inv() *mt.Inv { return c.inv }
 func (c *Conn) CloseWith(reason uint8, custom string, reconnect bool) error {
 	defer c.Close()
 
-	w := bytes.NewBuffer([]byte{0x00, ToClientAccessDenied})
-	WriteUint8(w, reason)
-	WriteBytes16(w, []byte(custom))
-	if reconnect {
-		WriteUint8(w, 1)
-	} else {
-		WriteUint8(w, 0)
-	}
-
-	_, err := c.Send(rudp.Pkt{Reader: w})
+	_, err := c.SendCmd(&ToCltAccessDenied{
+		Reason:    reason,
+		Custom:    custom,
+		Reconnect: reconnect,
+	})
 	if err != nil {
 		return err
 	}
@@ -1,9 +1,8 @@
 package main
 
 import (
-	"log"
-	"sort"
 	"strings"
+	"sync"
 	"unicode/utf8"
 
 	"github.com/tncardoso/gocurses"
@@ -12,6 +11,47 @@ import (
 var consoleInput []rune
 var cursorPos int
 
+// cursesFrontend is the interactive curses console
+type cursesFrontend struct {
+	mu     sync.Mutex
+	lines  []string
+	offset int
+}
+
+func newCursesFrontend() *cursesFrontend {
+	f := &cursesFrontend{}
+	initCurses(f)
+	return f
+}
+
+func (f *cursesFrontend) Print(lines []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lines = appendPop(MaxLogMSGs, f.lines, lines...)
+	if f.offset > 0 {
+		f.offset += len(lines)
+	}
+
+	f.redraw()
+}
+
+func (f *cursesFrontend) Close() {
+	gocurses.End()
+}
+
+// redraw draws the visible part of the log
+// The caller must hold f.mu
+func (f *cursesFrontend) redraw() {
+	rows, _ := gocurses.Getmaxyx()
+	start := len(f.lines) - rows + 1 - f.offset
+	if start < 0 {
+		start = 0
+	}
+
+	draw(f.lines[start : len(f.lines)-f.offset])
+}
+
 func draw(msgs []string) {
 	prompt, ok := ConfKey("console_prompt").(string)
 	if !ok {
@@ -86,17 +126,16 @@ func autoCompleteName(input []rune) []rune {
 
 func autoCompleteCommand(input []rune) []rune {
 	var cmds []string
-	for cmd := range chatCommands {
-		if chatCommands[cmd].console {
+	for _, cmd := range ChatCommandNames() {
+		if chatCommands[cmd].Console {
 			cmds = append(cmds, cmd)
 		}
 	}
-	sort.Strings(cmds)
 
 	return []rune(autoComplete(cmds, string(input)))
 }
 
-func initCurses(l *Logger) {
+func initCurses(f *cursesFrontend) {
 	gocurses.Initscr()
 	gocurses.Cbreak()
 	gocurses.Noecho()
@@ -119,6 +158,8 @@ func initCurses(l *Logger) {
 				}
 			}
 
+			f.mu.Lock()
+
 			switch ch {
 			case 3:
 				consoleInput = h.Next()
@@ -136,21 +177,21 @@ func initCurses(l *Logger) {
 				}
 			case 339:
 				rows, _ := gocurses.Getmaxyx()
-				start := len(l.lines) - rows + 1 - l.offset
+				start := len(f.lines) - rows + 1 - f.offset
 				if start < 0 {
 					start = 0
 				}
 
 				if start > 0 {
-					l.offset += 1
-					if l.offset > len(l.lines)-1 {
-						l.offset = len(l.lines) - 1
+					f.offset += 1
+					if f.offset > len(f.lines)-1 {
+						f.offset = len(f.lines) - 1
 					}
 				}
 			case 338:
-				l.offset -= 1
-				if l.offset < 0 {
-					l.offset = 0
+				f.offset -= 1
+				if f.offset < 0 {
+					f.offset = 0
 				}
 			case '\b':
 				if len(consoleInput) > 0 {
@@ -167,21 +208,14 @@ func initCurses(l *Logger) {
 					consoleInput = autoCompleteCommand(consoleInput)
 				}
 			case '\n':
-				params := strings.Split(string(consoleInput), " ")
+				line := string(consoleInput)
 				h.Add(consoleInput)
 				consoleInput = []rune{}
 
-				if chatCommands[params[0]].function == nil {
-					log.Print("Unknown command ", params[0])
-					continue
-				}
-
-				if !chatCommands[params[0]].console {
-					log.Print("This command is not available to the console!")
-					continue
-				}
-
-				chatCommands[params[0]].function(nil, strings.Join(params[1:], " "))
+				// The command may log, which requires f.mu
+				f.mu.Unlock()
+				ExecuteChatCommand(nil, line)
+				f.mu.Lock()
 			default:
 				if cursorPos > 0 {
 					consoleInput = append(consoleInput[:len(consoleInput)-cursorPos], append([]rune{ch}, consoleInput[len(consoleInput)-cursorPos:]...)...)
@@ -190,13 +224,8 @@ func initCurses(l *Logger) {
 				}
 			}
 
-			rows, _ := gocurses.Getmaxyx()
-			start := len(l.lines) - rows + 1 - l.offset
-			if start < 0 {
-				start = 0
-			}
-
-			draw(l.lines[start : len(l.lines)-l.offset])
+			f.redraw()
+			f.mu.Unlock()
 		}
 	}()
 }
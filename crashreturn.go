@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// A crashReturn is the server a player has been moved away from
+// because it shut down or crashed
+type crashReturn struct {
+	server   string
+	fallback string
+	auto     bool
+}
+
+var crashReturns = make(map[*Conn]*crashReturn)
+var crashReturnsMu sync.Mutex
+
+// fallbackAfterCrash moves a Conn whose server has shut down or crashed
+// to the fallback server. The kick is passed on to the client
+// if the fallback is full or the redirect fails, the player
+// can't wait for a slot without a server
+// It runs in its own goroutine because Redirect waits for the packet
+// that contained the kick to be forwarded
+func fallbackAfterCrash(c *Conn, server, fallback, msg string, denied *ToCltAccessDenied) {
+	c.SendChatMsg("The minetest server has " + msg + ", connecting you to " + fallback + "...")
+
+	err := c.Redirect(fallback)
+	if errors.Is(err, ErrQueued) {
+		dequeue(c)
+	}
+
+	if err != nil {
+		LogWarn(c.LogFields(), "Moving ", c.Username(), " to ", fallback, " failed: ", err)
+
+		// Forwarding from the old server has been stopped,
+		// so Proxy doesn't handle the disconnect
+		c.CloseWith(denied.Reason, denied.Custom, denied.Reconnect)
+		processLeave(c)
+		return
+	}
+
+	parkAfterCrash(c, server, c.ServerName(), denied.Reconnect)
+}
+
+// parkAfterCrash remembers the server a Conn has been moved away from
+// The Conn is sent back automatically once the server is up again
+// if the server asked its clients to reconnect and the Conn
+// is still on the fallback server. Otherwise it is offered to return
+func parkAfterCrash(c *Conn, server, fallback string, reconnect bool) {
+	crashReturnsMu.Lock()
+	crashReturns[c] = &crashReturn{
+		server:   server,
+		fallback: fallback,
+		auto:     reconnect,
+	}
+	crashReturnsMu.Unlock()
+
+	if reconnect {
+		c.SendChatMsg("You will be sent back to " + server + " once it is up again.")
+	}
+}
+
+// ReturnServer returns the server the Conn has been moved away from
+// because it shut down or crashed or an empty string
+func (c *Conn) ReturnServer() string {
+	crashReturnsMu.Lock()
+	defer crashReturnsMu.Unlock()
+
+	if ret, ok := crashReturns[c]; ok {
+		return ret.server
+	}
+
+	return ""
+}
+
+func returnAfterCrash(server string) {
+	var back, offer []*Conn
+
+	// SendChatMsg blocks, so the players are messaged after unlocking
+	crashReturnsMu.Lock()
+	for c, ret := range crashReturns {
+		if ret.server != server {
+			continue
+		}
+
+		if ret.auto && c.ServerName() == ret.fallback {
+			delete(crashReturns, c)
+			back = append(back, c)
+			continue
+		}
+
+		offer = append(offer, c)
+	}
+	crashReturnsMu.Unlock()
+
+	for _, c := range back {
+		LogInfo(c.LogFields(), "Sending ", c.Username(), " back to ", server)
+
+		go func(c *Conn) {
+			c.SendChatMsg(server + " is up again, sending you back...")
+			c.Redirect(server)
+		}(c)
+	}
+
+	for _, c := range offer {
+		go c.SendChatMsg(server + " is up again. Use #return to go back.")
+	}
+}
+
+func init() {
+	RegisterOnServerHealthChange(func(server string, up bool) {
+		if up {
+			go returnAfterCrash(server)
+		}
+	})
+
+	RegisterOnLeavePlayer(func(c *Conn) {
+		crashReturnsMu.Lock()
+		defer crashReturnsMu.Unlock()
+
+		delete(crashReturns, c)
+	})
+
+	RegisterCommand(&ChatCommand{
+		Name: "return",
+		Help: "Sends you back to the server you were on when it shut down or crashed",
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			server := c.ReturnServer()
+			if server == "" {
+				c.SendChatMsg("There is no server to return to.")
+				return
+			}
+
+			go func() {
+				if err := c.Redirect(server); err != nil {
+					c.SendChatMsg("Could not return to " + server + ": " + err.Error())
+					return
+				}
+
+				crashReturnsMu.Lock()
+				delete(crashReturns, c)
+				crashReturnsMu.Unlock()
+			}()
+		},
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/HimbeerserverDE/srp"
+)
+
+// ctlMain implements the "multiserver ctl" subcommand,
+// a client for the remote admin console
+func ctlMain(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: multiserver ctl [flags] [command]")
+		fmt.Fprintln(fs.Output(), "Runs a single command if specified, opens an interactive session otherwise.")
+		fmt.Fprintln(fs.Output(), "The password is read from MULTISERVER_PASSWORD if set.")
+		fs.PrintDefaults()
+	}
+
+	socket := fs.String("socket", "admin.sock", "Path of the admin console socket")
+	addr := fs.String("tcp", "", "Connect to a TLS admin console at this address instead of the socket")
+	insecure := fs.Bool("insecure", false, "Don't verify the TLS certificate of the proxy")
+	user := fs.String("user", os.Getenv("USER"), "Name of the player to log in as")
+	fs.Parse(args)
+
+	var conn net.Conn
+	var err error
+	if *addr != "" {
+		conn, err = tls.Dial("tcp", *addr, &tls.Config{InsecureSkipVerify: *insecure})
+	} else {
+		conn, err = net.Dial("unix", *socket)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	password, ok := os.LookupEnv("MULTISERVER_PASSWORD")
+	if !ok {
+		password = readPassword("Password for " + *user + ": ")
+	}
+
+	r := bufio.NewReader(conn)
+	if err := ctlAuth(conn, r, *user, password); err != nil {
+		fmt.Fprintln(os.Stderr, "Authentication failed:", err)
+		return 1
+	}
+
+	if cmd := strings.Join(fs.Args(), " "); cmd != "" {
+		fmt.Fprintln(conn, cmd)
+
+		// The output is part of the log stream, print it
+		// until the proxy has been quiet for a moment
+		for {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return 0
+			}
+
+			fmt.Print(line)
+		}
+	}
+
+	go func() {
+		io.Copy(os.Stdout, r)
+		fmt.Fprintln(os.Stderr, "Connection closed")
+		os.Exit(0)
+	}()
+
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		if _, err := fmt.Fprintln(conn, s.Text()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func ctlAuth(conn net.Conn, r *bufio.Reader, name, password string) error {
+	greeting, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(greeting) != adminGreeting {
+		return errors.New("not a multiserver admin console")
+	}
+
+	A, a, err := srp.InitiateHandshake()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(conn, "AUTH "+name+" "+base64.StdEncoding.EncodeToString(A))
+
+	fields, err := readAdminLine(r, "SRP", 3)
+	if err != nil {
+		return err
+	}
+
+	s, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return err
+	}
+
+	B, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return err
+	}
+
+	K, err := srp.CompleteHandshake(A, a, []byte(strings.ToLower(name)), []byte(password), s, B)
+	if err != nil {
+		return err
+	}
+
+	M := srp.ClientProof([]byte(name), s, A, B, K)
+	fmt.Fprintln(conn, "PROOF "+base64.StdEncoding.EncodeToString(M))
+
+	_, err = readAdminLine(r, "OK", 1)
+	return err
+}
+
+// readPassword prompts for a password on the terminal
+// and disables echoing if possible
+func readPassword(prompt string) string {
+	fmt.Fprint(os.Stderr, prompt)
+
+	stty := func(arg string) {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		cmd.Run()
+	}
+
+	if isTerminal(os.Stdin) {
+		stty("-echo")
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+
+	password, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimRight(password, "\r\n")
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HimbeerserverDE/srp"
+)
+
+const (
+	dashboardCookie     = "multiserver_session"
+	dashboardSessionTTL = 12 * time.Hour
+	dashboardMaxEvents  = 100
+	dashboardMaxLines   = 200
+
+	// defaultDashboardUser contains a character that player names
+	// can't contain, so it can't shadow a proxy account
+	defaultDashboardUser = "@admin"
+)
+
+//go:embed web
+var webFS embed.FS
+
+type dashboardSession struct {
+	name    string
+	expires time.Time
+}
+
+var dashboardSessions = make(map[string]*dashboardSession)
+var dashboardSessionsMu sync.Mutex
+
+type dashboardEvent struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Player string    `json:"player"`
+	Server string    `json:"server"`
+}
+
+var dashboardEvents []dashboardEvent
+var dashboardEventsMu sync.Mutex
+
+func addDashboardEvent(typ string, c *Conn, server string) {
+	dashboardEventsMu.Lock()
+	defer dashboardEventsMu.Unlock()
+
+	dashboardEvents = append(dashboardEvents, dashboardEvent{
+		Time:   time.Now(),
+		Type:   typ,
+		Player: c.Username(),
+		Server: server,
+	})
+
+	if len(dashboardEvents) > dashboardMaxEvents {
+		dashboardEvents = dashboardEvents[len(dashboardEvents)-dashboardMaxEvents:]
+	}
+}
+
+// dashboardLog keeps the most recent log lines for the dashboard
+type dashboardLog struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *dashboardLog) Print(lines []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines = append(l.lines, lines...)
+	if len(l.lines) > dashboardMaxLines {
+		l.lines = l.lines[len(l.lines)-dashboardMaxLines:]
+	}
+}
+
+func (l *dashboardLog) Close() {}
+
+func (l *dashboardLog) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string{}, l.lines...)
+}
+
+var dashboardLogTail = &dashboardLog{}
+
+// checkPassword verifies a password against the SRP verifier
+// of a player by performing both sides of the handshake
+func checkPassword(name, password string) error {
+	v, s, err := Password(name)
+	if err != nil {
+		return err
+	}
+
+	if v == nil || s == nil {
+		return errors.New("unknown player")
+	}
+
+	A, a, err := srp.InitiateHandshake()
+	if err != nil {
+		return err
+	}
+
+	B, _, K, err := srp.Handshake(A, v)
+	if err != nil {
+		return err
+	}
+
+	K2, err := srp.CompleteHandshake(A, a, []byte(strings.ToLower(name)), []byte(password), s, B)
+	if err != nil {
+		return err
+	}
+
+	M := srp.ClientProof([]byte(name), s, A, B, K)
+	M2 := srp.ClientProof([]byte(name), s, A, B, K2)
+	if subtle.ConstantTimeCompare(M, M2) != 1 {
+		return errors.New("wrong password")
+	}
+
+	return nil
+}
+
+// dashboardAdmin returns the name that logs in with dashboard_password
+// or an empty string if dashboard_user is a valid player name
+func dashboardAdmin() string {
+	name, ok := ConfKey("dashboard_user").(string)
+	if !ok || name == "" {
+		return defaultDashboardUser
+	}
+
+	if valid, _ := regexp.MatchString(PlayerNameChars, name); valid {
+		log.Print("dashboard_user must not be a valid player name, dashboard_password is ignored")
+		return ""
+	}
+
+	return name
+}
+
+// dashboardLogin checks the credentials of a dashboard user
+func dashboardLogin(name, password string) error {
+	if adminpw, ok := ConfKey("dashboard_password").(string); ok && adminpw != "" {
+		if admin := dashboardAdmin(); admin != "" && name == admin {
+			if subtle.ConstantTimeCompare([]byte(password), []byte(adminpw)) != 1 {
+				return errors.New("wrong password")
+			}
+
+			return nil
+		}
+	}
+
+	if err := checkPassword(name, password); err != nil {
+		return err
+	}
+
+	priv, ok := ConfKey("dashboard_priv").(string)
+	if !ok {
+		priv = "dashboard"
+	}
+
+	allow, err := CheckPrivs(name, map[string]bool{priv: true})
+	if err != nil {
+		return err
+	}
+
+	if !allow {
+		return errors.New("missing the " + priv + " privilege")
+	}
+
+	return nil
+}
+
+// dashboardUser returns the name of the user the request
+// has a valid dashboard session for
+func dashboardUser(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(dashboardCookie)
+	if err != nil {
+		return "", false
+	}
+
+	dashboardSessionsMu.Lock()
+	defer dashboardSessionsMu.Unlock()
+
+	s, ok := dashboardSessions[cookie.Value]
+	if !ok {
+		return "", false
+	}
+
+	if time.Now().After(s.expires) {
+		delete(dashboardSessions, cookie.Value)
+		return "", false
+	}
+
+	return s.name, true
+}
+
+func apiLogin(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	rq := struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}{}
+
+	if !decodeJSON(w, r, &rq) {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if wait := loginBackoff(host); wait > 0 {
+		LogWarn(LogFields{"remote": r.RemoteAddr, "player": rq.Name}, "Dashboard login rejected, retry allowed in ", wait.Round(time.Second))
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		apiError(w, http.StatusTooManyRequests, "too many failed logins, try again later")
+		return
+	}
+
+	if err := dashboardLogin(rq.Name, rq.Password); err != nil {
+		LogWarn(LogFields{"remote": r.RemoteAddr, "player": rq.Name}, "Dashboard login failed: ", err)
+		loginFailed(host)
+
+		// Slow down concurrent attempts as well
+		time.Sleep(loginBaseBackoff)
+		apiError(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+
+	loginSucceeded(host)
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		log.Print(err)
+		apiError(w, http.StatusInternalServerError, "could not create session")
+		return
+	}
+
+	id := hex.EncodeToString(token)
+	expires := time.Now().Add(dashboardSessionTTL)
+
+	dashboardSessionsMu.Lock()
+	for id, s := range dashboardSessions {
+		if time.Now().After(s.expires) {
+			delete(dashboardSessions, id)
+		}
+	}
+
+	dashboardSessions[id] = &dashboardSession{name: rq.Name, expires: expires}
+	dashboardSessionsMu.Unlock()
+
+	LogInfo(LogFields{"remote": r.RemoteAddr, "player": rq.Name}, rq.Name, " logged in to the dashboard")
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	writeJSON(w, http.StatusOK, map[string]string{"name": rq.Name})
+}
+
+func apiLogout(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	if cookie, err := r.Cookie(dashboardCookie); err == nil {
+		dashboardSessionsMu.Lock()
+		delete(dashboardSessions, cookie.Value)
+		dashboardSessionsMu.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   dashboardCookie,
+		Path:   "/",
+		MaxAge: -1,
+	})
+
+	apiOK(w)
+}
+
+func apiDashboard(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	dashboardEventsMu.Lock()
+	events := append([]dashboardEvent{}, dashboardEvents...)
+	dashboardEventsMu.Unlock()
+
+	name, _ := dashboardUser(r)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user":   name,
+		"uptime": Uptime(),
+		"events": events,
+		"log":    dashboardLogTail.Lines(),
+	})
+}
+
+// dashboardHandler returns the handler that serves the web dashboard
+func dashboardHandler() http.Handler {
+	sub, err := fs.Sub(webFS, "web")
+	if err != nil {
+		panic(err)
+	}
+
+	return http.FileServer(http.FS(sub))
+}
+
+func init() {
+	RegisterOnJoinPlayer(func(c *Conn) {
+		addDashboardEvent("join", c, c.ServerName())
+	})
+
+	RegisterOnLeavePlayer(func(c *Conn) {
+		addDashboardEvent("leave", c, c.ServerName())
+	})
+
+	RegisterOnRedirectDone(func(c *Conn, newsrv string, success bool) {
+		if !success {
+			addDashboardEvent("redirect_failed", c, newsrv)
+		}
+	})
+
+	go func() {
+		<-LogReady()
+		logger.AddFrontend(dashboardLogTail)
+	}()
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"time"
 
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
@@ -73,6 +74,8 @@ func (db *DB) Exec(sql string, values ...interface{}) (sql.Result, error) {
 
 		sql = r.ReplaceAllString(sql, "?")
 	}
+
+	defer metricDBQueries.ObserveSince(time.Now(), "exec")
 	return db.DB.Exec(sql, values...)
 }
 
@@ -86,5 +89,22 @@ func (db *DB) QueryRow(sql string, values ...interface{}) *sql.Row {
 
 		sql = r.ReplaceAllString(sql, "?")
 	}
+
+	defer metricDBQueries.ObserveSince(time.Now(), "query")
 	return db.DB.QueryRow(sql, values...)
 }
+
+// Query executes a SQL statement that returns rows
+func (db *DB) Query(sql string, values ...interface{}) (*sql.Rows, error) {
+	if db.Type() == DBTypeSQLite3 {
+		r, err := regexp.Compile("\\$+[0-9]")
+		if err != nil {
+			return nil, err
+		}
+
+		sql = r.ReplaceAllString(sql, "?")
+	}
+
+	defer metricDBQueries.ObserveSince(time.Now(), "query")
+	return db.DB.Query(sql, values...)
+}
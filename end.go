@@ -4,24 +4,42 @@ import (
 	"log"
 	"os"
 	"time"
-
-	"github.com/tncardoso/gocurses"
 )
 
 // End disconnects (from) all Peers and stops the process
 func End(crash, reconnect bool) {
+	end(crash, reconnect, "")
+}
+
+// end kicks all clients with a custom message and stops the process
+func end(crash, reconnect bool, custom string) {
 	log.Print("Ending")
 
+	kickAll(crash, reconnect, custom)
+	exit(crash, true)
+}
+
+// kickAll disconnects all clients
+func kickAll(crash, reconnect bool, custom string) {
 	var reason uint8 = AccessDeniedShutdown
 	if crash {
 		reason = AccessDeniedCrash
 	}
 
 	for _, clt := range Conns() {
-		clt.CloseWith(reason, "", reconnect)
+		clt.CloseWith(reason, custom, reconnect)
+	}
+}
+
+// exit gives the servers shutdown_grace_period seconds to save
+// and stops the process
+func exit(crash, announce bool) {
+	grace, ok := ConfKey("shutdown_grace_period").(int)
+	if !ok || grace < 1 {
+		grace = 1
 	}
 
-	time.Sleep(time.Second)
+	time.Sleep(time.Duration(grace) * time.Second)
 
 	rpcSrvMu.Lock()
 	for srv := range rpcSrvs {
@@ -29,10 +47,11 @@ func End(crash, reconnect bool) {
 	}
 	rpcSrvMu.Unlock()
 
-	Announce(AnnounceDelete)
+	if announce {
+		Announce(AnnounceDelete)
+	}
 
-	log.Writer().(*Logger).Close()
-	gocurses.End()
+	logger.Close()
 
 	if crash {
 		os.Exit(1)
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/anon55555/mt/rudp"
+)
+
+const helpFormName = "multiserver:help"
+
+// ShowFormspec shows a formspec to a Conn if it isn't a server
+func (c *Conn) ShowFormspec(formname, formspec string) {
+	if c.IsSrv() {
+		return
+	}
+
+	w := bytes.NewBuffer([]byte{0x00, ToClientShowFormspec})
+	WriteBytes32(w, []byte(formspec))
+	WriteBytes16(w, []byte(formname))
+
+	ack, err := c.Send(rudp.Pkt{Reader: w})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	<-ack
+}
+
+// FormspecEscape escapes the characters that have a special meaning
+// in formspecs
+func FormspecEscape(s string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\",
+		"[", "\\[",
+		"]", "\\]",
+		";", "\\;",
+		",", "\\,",
+	).Replace(s)
+}
+
+// normalizeHelp joins a multi-line help string into a single line
+func normalizeHelp(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// availableCommands returns the sorted names of the commands
+// a Conn is allowed to run
+func (c *Conn) availableCommands() []string {
+	var r []string
+	for _, name := range ChatCommandNames() {
+		has, err := c.CheckPrivs(chatCommands[name].RequiredPrivs())
+		if err != nil {
+			log.Print(err)
+			return nil
+		}
+
+		if has {
+			r = append(r, name)
+		}
+	}
+
+	return r
+}
+
+// showHelpForm shows a searchable list of all commands
+// the Conn is allowed to run
+func (c *Conn) showHelpForm(filter string, selected int) {
+	c.helpCmds = []string{}
+	for _, name := range c.availableCommands() {
+		cmd := chatCommands[name]
+
+		text := strings.ToLower(name + " " + strings.Join(cmd.Aliases, " ") + " " + cmd.Help)
+		if strings.Contains(text, strings.ToLower(filter)) {
+			c.helpCmds = append(c.helpCmds, name)
+		}
+	}
+
+	var items []string
+	for _, name := range c.helpCmds {
+		items = append(items, FormspecEscape(ChatCommandPrefix+name))
+	}
+
+	var details string
+	if selected >= 1 && selected <= len(c.helpCmds) {
+		cmd := chatCommands[c.helpCmds[selected-1]]
+		details = ChatCommandPrefix + cmd.Name + "\n\n" + normalizeHelp(cmd.HelpText())
+	} else {
+		selected = 0
+		details = strconv.Itoa(len(c.helpCmds)) + " commands available. Select a command to show its help."
+	}
+
+	fs := "size[12,9]" +
+		"field[0.3,0.5;9.2,1;search;;" + FormspecEscape(filter) + "]" +
+		"field_close_on_enter[search;false]" +
+		"button[9.5,0.2;2.5,1;do_search;Search]" +
+		"textlist[0,1.3;4,7.5;commands;" + strings.Join(items, ",") + ";" + strconv.Itoa(selected) + ";false]" +
+		"textarea[4.5,1.3;7.5,8.3;;;" + FormspecEscape(details) + "]"
+
+	c.helpFilter = filter
+	c.ShowFormspec(helpFormName, fs)
+}
+
+// processFormFields handles the fields of formspecs shown by the proxy
+// and reports whether the packet belongs to such a formspec
+func processFormFields(c *Conn, r *bytes.Reader) bool {
+	formname := string(ReadBytes16(r))
+	if !strings.HasPrefix(formname, "multiserver:") {
+		return false
+	}
+
+	fields := make(map[string]string)
+
+	count := ReadUint16(r)
+	for i := uint16(0); i < count; i++ {
+		name := string(ReadBytes16(r))
+		fields[name] = string(ReadBytes32(r))
+	}
+
+	switch formname {
+	case helpFormName:
+		if fields["quit"] == "true" {
+			break
+		}
+
+		if ev := fields["commands"]; strings.HasPrefix(ev, "CHG:") || strings.HasPrefix(ev, "DCL:") {
+			selected, _ := strconv.Atoi(ev[4:])
+			c.showHelpForm(c.helpFilter, selected)
+		} else if _, ok := fields["search"]; ok {
+			c.showHelpForm(fields["search"], 0)
+		}
+	}
+
+	return true
+}
+
+// rpcCommandList encodes the names, required privileges, usage strings
+// and help strings of all commands for RPC, commands are separated
+// by newlines and their properties by tabs
+func rpcCommandList() string {
+	var cmds []string
+	for _, name := range ChatCommandNames() {
+		cmd := chatCommands[name]
+
+		privs := strings.Replace(encodePrivs(cmd.RequiredPrivs()), "|", ",", -1)
+		cmds = append(cmds, strings.Join([]string{
+			cmd.Name,
+			privs,
+			ChatCommandPrefix + cmd.Usage(),
+			normalizeHelp(cmd.Help),
+		}, "\t"))
+	}
+
+	return strings.Join(cmds, "\n")
+}
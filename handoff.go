@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+const handoffGreeting = "MULTISERVER HANDOFF 1\n"
+
+// handoffClosers are the listeners the new process opens again
+var handoffClosers []io.Closer
+var handoffClosersMu sync.Mutex
+
+// closeOnHandoff makes a listener close before a new process
+// is allowed to start so that it can bind the same address
+func closeOnHandoff(c io.Closer) {
+	handoffClosersMu.Lock()
+	defer handoffClosersMu.Unlock()
+
+	handoffClosers = append(handoffClosers, c)
+}
+
+func closeHandoffClosers() {
+	handoffClosersMu.Lock()
+	defer handoffClosersMu.Unlock()
+
+	for _, c := range handoffClosers {
+		c.Close()
+	}
+
+	handoffClosers = nil
+}
+
+// ListenHandoff lets a new proxy process started with -takeover
+// take over the listening socket through the unix socket at handoff_socket
+// Both processes can't read from the socket at the same time,
+// so the clients are kicked with the reconnect flag set
+// and reconnect to the new process
+func ListenHandoff(lc net.PacketConn) {
+	path, ok := ConfKey("handoff_socket").(string)
+	if !ok || path == "" {
+		return
+	}
+
+	udp, ok := lc.(*net.UDPConn)
+	if !ok {
+		log.Print("Socket handoff requires a UDP listener")
+		return
+	}
+
+	os.Remove(path)
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	os.Chmod(path, 0600)
+
+	log.Print("Socket handoff listening on " + path)
+
+	go func() {
+		for {
+			conn, err := l.AcceptUnix()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+
+				log.Print(err)
+				continue
+			}
+
+			if err := handOff(conn, udp); err != nil {
+				log.Print(err)
+				conn.Close()
+				continue
+			}
+
+			log.Print("Handed the listening socket over to a new process")
+
+			// The new process recreates the unix socket
+			l.Close()
+
+			kickAll(false, true, "The proxy is being upgraded, please reconnect.")
+
+			// Release the TCP and admin listeners and the log file
+			// and stop reading from the socket, then let the new process start
+			closeHandoffClosers()
+			logger.closeFile()
+			lc.Close()
+			conn.Close()
+
+			// The new process announces itself to the server list
+			exit(false, false)
+		}
+	}()
+}
+
+func handOff(conn *net.UnixConn, udp *net.UDPConn) error {
+	f, err := udp.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, _, err = conn.WriteMsgUnix([]byte(handoffGreeting), syscall.UnixRights(int(f.Fd())), nil)
+	return err
+}
+
+// takeOver receives the listening socket of the running proxy
+// through handoff_socket and waits until the old process
+// has stopped reading from it
+func takeOver() (net.PacketConn, error) {
+	path, ok := ConfKey("handoff_socket").(string)
+	if !ok || path == "" {
+		return nil, errors.New("handoff_socket is not set")
+	}
+
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, len(handoffGreeting))
+	oob := make([]byte, syscall.CmsgSpace(4))
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(buf[:n]) != handoffGreeting {
+		return nil, errors.New("unexpected handoff greeting")
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msgs) != 1 {
+		return nil, errors.New("no socket received")
+	}
+
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+
+		return nil, errors.New("no socket received")
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "listener")
+	defer f.Close()
+
+	lc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Print("Received the listening socket, waiting for the old process")
+
+	io.Copy(io.Discard, conn)
+	return lc, nil
+}
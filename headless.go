@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// headlessFrontend writes the log to a plain stream
+// and reads console commands line by line
+type headlessFrontend struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newHeadlessFrontend(out io.Writer, in io.Reader) *headlessFrontend {
+	h := &headlessFrontend{out: out}
+
+	go func() {
+		s := bufio.NewScanner(in)
+		for s.Scan() {
+			if s.Text() == "" {
+				continue
+			}
+
+			ExecuteChatCommand(nil, s.Text())
+		}
+
+		if err := s.Err(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	return h
+}
+
+func (h *headlessFrontend) Print(lines []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, line := range lines {
+		fmt.Fprintln(h.out, line)
+	}
+}
+
+func (h *headlessFrontend) Close() {}
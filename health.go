@@ -0,0 +1,226 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ServerHealth is the result of the latest health check of a server
+type ServerHealth struct {
+	Up         bool
+	Latency    time.Duration
+	LastCheck  time.Time
+	LastChange time.Time
+}
+
+var serverHealth = make(map[string]*ServerHealth)
+var serverHealthMu sync.RWMutex
+
+var onServerHealthChange []func(string, bool)
+
+// RegisterOnServerHealthChange registers a callback function that is called
+// when a server goes down or comes back up
+func RegisterOnServerHealthChange(function func(string, bool)) {
+	onServerHealthChange = append(onServerHealthChange, function)
+}
+
+// Health returns the health of a server
+// Servers that haven't been checked yet are considered up
+func Health(server string) ServerHealth {
+	serverHealthMu.RLock()
+	defer serverHealthMu.RUnlock()
+
+	if h, ok := serverHealth[server]; ok {
+		return *h
+	}
+
+	return ServerHealth{Up: true}
+}
+
+// ServerUp reports whether a server passed its latest health check
+func ServerUp(server string) bool {
+	return Health(server).Up
+}
+
+// HealthString returns a short description of the health of a server
+func HealthString(server string) string {
+	h := Health(server)
+	if !h.Up {
+		return "down"
+	}
+
+	if h.LastCheck.IsZero() {
+		return "up"
+	}
+
+	return "up, " + strconv.FormatInt(h.Latency.Milliseconds(), 10) + "ms"
+}
+
+// setServerHealth records the health of a server
+// and runs the callbacks if it has changed
+func setServerHealth(server string, up bool, latency time.Duration) {
+	serverHealthMu.Lock()
+
+	h, ok := serverHealth[server]
+	if !ok {
+		h = &ServerHealth{Up: true}
+		serverHealth[server] = h
+	}
+
+	changed := h.Up != up
+
+	h.Up = up
+	h.Latency = latency
+	h.LastCheck = time.Now()
+	if changed {
+		h.LastChange = h.LastCheck
+	}
+
+	serverHealthMu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	status := "down"
+	if up {
+		status = "up"
+		LogInfo(LogFields{"server": server}, "Server ", server, " is up")
+	} else {
+		LogWarn(LogFields{"server": server}, "Server ", server, " is down")
+	}
+
+	rpcSrvMu.Lock()
+	for srv := range rpcSrvs {
+		go srv.doRPC("->SRVHEALTH "+server+" "+status, "--")
+	}
+	rpcSrvMu.Unlock()
+
+	for i := range onServerHealthChange {
+		onServerHealthChange[i](server, up)
+	}
+}
+
+// markServerDown records a server as down without waiting
+// for the next health check, e.g. after it has shut down
+func markServerDown(server string) {
+	setServerHealth(server, false, 0)
+}
+
+// markServerUp records a server as up after a player has joined it
+// This is the only way for a server to come back up
+// if health checks are disabled
+func markServerUp(server string) {
+	if !ServerUp(server) {
+		setServerHealth(server, true, 0)
+	}
+}
+
+// checkServer probes a server by performing the RUDP handshake
+func checkServer(server string) {
+	straddr, ok := ConfKey("servers:" + server + ":address").(string)
+	if !ok {
+		return
+	}
+
+	srvaddr, err := net.ResolveUDPAddr("udp", straddr)
+	if err != nil {
+		log.Print(err)
+		setServerHealth(server, false, 0)
+		return
+	}
+
+	conn, err := net.DialUDP("udp", nil, srvaddr)
+	if err != nil {
+		log.Print(err)
+		setServerHealth(server, false, 0)
+		return
+	}
+
+	start := time.Now()
+
+	srv, err := Connect(conn)
+	if err != nil {
+		setServerHealth(server, false, 0)
+		return
+	}
+
+	latency := time.Since(start)
+	srv.Close()
+
+	setServerHealth(server, true, latency)
+}
+
+// checkServers probes all servers concurrently
+func checkServers() {
+	var wg sync.WaitGroup
+
+	servers := ConfKey("servers").(map[interface{}]interface{})
+	for server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			checkServer(server)
+		}(server.(string))
+	}
+
+	wg.Wait()
+}
+
+// upServers returns the names of the servers that are up, sorted
+func upServers() []string {
+	var r []string
+
+	servers := ConfKey("servers").(map[interface{}]interface{})
+	for server := range servers {
+		if ServerUp(server.(string)) {
+			r = append(r, server.(string))
+		}
+	}
+
+	sort.Strings(r)
+	return r
+}
+
+// FallbackServer returns the server to send players to
+// if they can't stay on their current server. This is the default
+// server unless it is down or in maintenance mode. Returns an empty
+// string if no server other than exclude is available
+func FallbackServer(exclude string) string {
+	defsrv, ok := ConfKey("default_server").(string)
+	if ok && defsrv != exclude && ServerUp(defsrv) && !inMaintenance(defsrv) {
+		return defsrv
+	}
+
+	for _, srv := range upServers() {
+		if srv != exclude && !inMaintenance(srv) {
+			return srv
+		}
+	}
+
+	return ""
+}
+
+func init() {
+	go func() {
+		<-LogReady()
+
+		interval := 10
+		if i, ok := ConfKey("health_check_interval").(int); ok {
+			interval = i
+		}
+
+		if interval <= 0 {
+			return
+		}
+
+		for {
+			checkServers()
+			time.Sleep(time.Duration(interval) * time.Second)
+		}
+	}()
+}
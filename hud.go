@@ -0,0 +1,49 @@
+package main
+
+import "log"
+
+// IDs of the HUD elements shown by the proxy
+// They are unlikely to be used by a server
+const (
+	shutdownHudID = 0xFFFFFF00 + iota
+	loadingHudID
+)
+
+const (
+	HudTypeImage = iota
+	HudTypeText
+)
+
+// addTextHud shows a text HUD element centered at the relative
+// screen position x, y
+func (c *Conn) addTextHud(id uint32, x, y float32, text string, color uint32) {
+	if _, err := c.SendCmd(&ToCltHUDAdd{
+		ID:     id,
+		Type:   HudTypeText,
+		Pos:    [2]float32{x, y},
+		Name:   "multiserver",
+		Scale:  [2]float32{100, 100},
+		Text:   text,
+		Number: color,
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
+// setHudText changes the text of a HUD element
+func (c *Conn) setHudText(id uint32, text string) {
+	if _, err := c.SendCmd(&ToCltChangeHUD{
+		ID:   id,
+		Stat: HudStatText,
+		Text: text,
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
+// removeHud removes a HUD element
+func (c *Conn) removeHud(id uint32) {
+	if _, err := c.SendCmd(&ToCltRmHUD{ID: id}); err != nil {
+		log.Print(err)
+	}
+}
@@ -28,101 +28,82 @@ func init() {
 		return
 	}
 
-	RegisterChatCommand("help",
-		"Shows the help for a command. Shows the help for all commands if executed without arguments. Usage: help [command]",
-		nil,
-		true,
-		func(c *Conn, param string) {
-			showHelp := func(name string) {
-				cmd := chatCommands[name]
-				if help := cmd.Help(); help != "" {
-					if c != nil {
-						color := "#F00"
-						if has, err := c.CheckPrivs(cmd.privs); (err == nil && has) || cmd.privs == nil {
-							color = "#0F0"
-						}
-
-						c.SendChatMsg(Colorize(name, color) + ": " + help)
-					} else {
-						parts := strings.Split(help, "\n")
-						for _, part := range parts {
-							log.Print(name + ": " + part)
-						}
+	RegisterCommand(&ChatCommand{
+		Name:    "help",
+		Help:    "Shows the help for a command. Shows a searchable list of all commands you can run if executed without arguments",
+		Params:  []ChatCommandParam{{Name: "command", Optional: true}},
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			showHelp := func(cmd *ChatCommand) {
+				if c != nil {
+					color := "#F00"
+					if has, err := c.CheckPrivs(cmd.RequiredPrivs()); err == nil && has {
+						color = "#0F0"
 					}
+
+					c.SendChatMsg(Colorize(cmd.Name, color) + ": " + cmd.HelpText())
 				} else {
-					SendChatMsg(c, "No help available for "+name+".")
+					parts := strings.Split(cmd.HelpText(), "\n")
+					for _, part := range parts {
+						log.Print(cmd.Name + ": " + part)
+					}
 				}
 			}
 
-			if param == "" {
-				for cmd := range chatCommands {
-					showHelp(cmd)
+			if !args.Has("command") {
+				if c != nil {
+					c.showHelpForm("", 0)
+					return
 				}
-			} else {
-				showHelp(param)
-			}
-		})
-
-	RegisterChatCommand("send",
-		"Sends a player to a server. Usage: send <playername> <servername>",
-		privs("send"),
-		true,
-		func(c *Conn, param string) {
-			if param == "" {
-				SendChatMsg(c, "Usage: send <playername> <servername>")
-				return
-			}
 
-			name := strings.Split(param, " ")[0]
-			if name == "" || len(strings.Split(param, " ")) < 2 {
-				SendChatMsg(c, "Usage: send <playername> <servername>")
-				return
-			}
-			tosrv := strings.Split(param, " ")[1]
-			if tosrv == "" {
-				SendChatMsg(c, "Usage: send <playername> <servername>")
+				for _, name := range ChatCommandNames() {
+					showHelp(chatCommands[name])
+				}
 				return
 			}
 
-			servers := ConfKey("servers").(map[interface{}]interface{})
-			if servers[tosrv] == nil {
-				SendChatMsg(c, "Unknown servername "+tosrv)
+			cmd := ChatCommandByName(args.String("command"))
+			if cmd == nil {
+				SendChatMsg(c, "No help available for "+args.String("command")+".")
 				return
 			}
 
-			c2 := ConnByUsername(name)
-			if c2 == nil {
-				SendChatMsg(c, name+" is not online")
-				return
-			}
+			showHelp(cmd)
+		},
+	})
 
-			srv := c2.ServerName()
-			if srv == tosrv {
-				SendChatMsg(c, name+" is already connected to this server!")
+	RegisterCommand(&ChatCommand{
+		Name: "send",
+		Help: "Sends a player to a server",
+		Params: []ChatCommandParam{
+			{Name: "playername", Type: ParamPlayer},
+			{Name: "servername", Type: ParamServer},
+		},
+		Privs:   privs("send"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			c2 := args.Conn("playername")
+			tosrv := args.String("servername")
+
+			if c2.ServerName() == tosrv {
+				SendChatMsg(c, c2.Username()+" is already connected to this server!")
 				return
 			}
 
 			go c2.Redirect(tosrv)
-		})
-
-	RegisterChatCommand("sendcurrent",
-		"Sends all players on the current server to a new server. Usage: sendcurrent <servername>",
-		privs("send"),
-		false,
-		func(c *Conn, param string) {
-			if param == "" {
-				c.SendChatMsg("Usage: sendcurrent <servername>")
-				return
-			}
+		},
+	})
 
-			servers := ConfKey("servers").(map[interface{}]interface{})
-			if servers[param] == nil {
-				c.SendChatMsg("Unknown servername " + param)
-				return
-			}
+	RegisterCommand(&ChatCommand{
+		Name:   "sendcurrent",
+		Help:   "Sends all players on the current server to a new server",
+		Params: []ChatCommandParam{{Name: "servername", Type: ParamServer}},
+		Privs:  privs("send"),
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			tosrv := args.String("servername")
 
 			srv := c.ServerName()
-			if srv == param {
+			if srv == tosrv {
 				c.SendChatMsg("All targets are already connected to this server!")
 				return
 			}
@@ -130,56 +111,54 @@ func init() {
 			go func() {
 				for _, c := range Conns() {
 					if c.ServerName() == srv {
-						go c.Redirect(param)
+						go c.Redirect(tosrv)
 					}
 				}
 			}()
-		})
-
-	RegisterChatCommand("sendall",
-		"Sends all players to a server. Usage: sendall <servername>",
-		privs("send"),
-		true,
-		func(c *Conn, param string) {
-			if param == "" {
-				SendChatMsg(c, "Usage: sendall <servername>")
-				return
-			}
+		},
+	})
 
-			servers := ConfKey("servers").(map[interface{}]interface{})
-			if servers[param] == nil {
-				SendChatMsg(c, "Unknown servername "+param)
-				return
-			}
+	RegisterCommand(&ChatCommand{
+		Name:    "sendall",
+		Help:    "Sends all players to a server",
+		Params:  []ChatCommandParam{{Name: "servername", Type: ParamServer}},
+		Privs:   privs("send"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			tosrv := args.String("servername")
 
 			go func() {
 				for _, c := range Conns() {
-					if psrv := c.ServerName(); psrv != param {
-						go c.Redirect(param)
+					if psrv := c.ServerName(); psrv != tosrv {
+						go c.Redirect(tosrv)
 					}
 				}
 			}()
-		})
-
-	RegisterChatCommand("alert",
-		"Sends a message to all players that are connected to the network. Usage: alert [message]",
-		privs("alert"),
-		true,
-		func(c *Conn, param string) {
-			ChatSendAll("[ALERT] " + param)
-		})
-
-	RegisterChatCommand("server",
-		`Prints your current server and a list of all servers if executed without arguments. 
-		Sends you to a server if executed with arguments and the required privilege. Usage: server [servername]"`,
-		nil,
-		false,
-		func(c *Conn, param string) {
-			if param == "" {
+		},
+	})
+
+	RegisterCommand(&ChatCommand{
+		Name:    "alert",
+		Help:    "Sends a message to all players that are connected to the network",
+		Params:  []ChatCommandParam{{Name: "message", Type: ParamRest}},
+		Privs:   privs("alert"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			ChatSendAll("[ALERT] " + args.String("message"))
+		},
+	})
+
+	RegisterCommand(&ChatCommand{
+		Name: "server",
+		Help: `Prints your current server and a list of all servers if executed without arguments. 
+		Sends you to a server if executed with arguments and the required privilege`,
+		Params: []ChatCommandParam{{Name: "servername", Type: ParamServerOrGroup, Optional: true}},
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			if !args.Has("servername") {
 				var r string
 				servers := ConfKey("servers").(map[interface{}]interface{})
 				for server := range servers {
-					r += server.(string) + " "
+					r += server.(string) + " (" + HealthString(server.(string)) + ") "
 				}
 
 				var r2 string
@@ -191,118 +170,88 @@ func init() {
 				}
 
 				c.SendChatMsg("Current server: " + c.ServerName() + " | All servers: " + r + "| All server groups: " + r2)
-			} else {
-				servers := ConfKey("servers").(map[interface{}]interface{})
-				srv := c.ServerName()
-
-				if srv == param {
-					c.SendChatMsg("You are already connected to this server!")
-					return
-				}
-
-				nogrp := true
-				groups, ok := ConfKey("groups").(map[interface{}]interface{})
-				if ok {
-					for grp := range groups {
-						name, ok := grp.(string)
-						if !ok {
-							continue
-						}
-
-						if name == param {
-							nogrp = false
-						}
-					}
-				}
-
-				if servers[param] == nil && nogrp {
-					c.SendChatMsg("Unknown servername " + param)
-					return
-				}
-
-				reqprivs := make(map[string]bool)
-
-				reqpriv, ok := ConfKey("servers:" + param + ":priv").(string)
-				if ok {
-					reqprivs[reqpriv] = true
-				}
+				return
+			}
 
-				reqpriv, ok = ConfKey("group_privs:" + param).(string)
-				if ok {
-					reqprivs[reqpriv] = true
-				}
+			tosrv := args.String("servername")
+			if c.ServerName() == tosrv {
+				c.SendChatMsg("You are already connected to this server!")
+				return
+			}
 
-				allow, err := c.CheckPrivs(reqprivs)
-				if err != nil {
-					log.Print(err)
-					c.SendChatMsg("An internal error occured while attempting to check your privileges")
-					return
-				}
+			reqprivs := make(map[string]bool)
 
-				if !allow {
-					c.SendChatMsg("You do not have permission to join this server! Required privilege: " + reqpriv)
-					return
-				}
+			reqpriv, ok := ConfKey("servers:" + tosrv + ":priv").(string)
+			if ok {
+				reqprivs[reqpriv] = true
+			}
 
-				go c.Redirect(param)
-				c.SendChatMsg("Redirecting you to " + param)
+			reqpriv, ok = ConfKey("group_privs:" + tosrv).(string)
+			if ok {
+				reqprivs[reqpriv] = true
 			}
-		})
-
-	RegisterChatCommand("find",
-		"Prints the online status and the current server of a player. Usage: find <playername>",
-		privs("find"),
-		true,
-		func(c *Conn, param string) {
-			if param == "" {
-				SendChatMsg(c, "Usage: find <playername>")
+
+			allow, err := c.CheckPrivs(reqprivs)
+			if err != nil {
+				log.Print(err)
+				c.SendChatMsg("An internal error occured while attempting to check your privileges")
 				return
 			}
 
-			c2 := ConnByUsername(param)
-			if c2 == nil {
-				SendChatMsg(c, param+" is not online")
-			} else {
-				srv := c2.ServerName()
-				SendChatMsg(c, param+" is connected to server "+srv)
-			}
-		})
-
-	RegisterChatCommand("addr",
-		"Prints the network address (including the port) of a connected player. Usage: addr <playername>",
-		privs("addr"),
-		true,
-		func(c *Conn, param string) {
-			if param == "" {
-				SendChatMsg(c, "Usage: addr <playername>")
+			if !allow {
+				c.SendChatMsg("You do not have permission to join this server! Required privileges: " + strings.Replace(encodePrivs(reqprivs), "|", " ", -1))
 				return
 			}
 
-			c2 := ConnByUsername(param)
-			if c2 == nil {
-				SendChatMsg(c, param+" is not online")
-			} else {
-				SendChatMsg(c, param+"'s address is "+c2.Addr().String())
-			}
-		})
+			go c.Redirect(tosrv)
+			c.SendChatMsg("Redirecting you to " + tosrv)
+		},
+	})
+
+	RegisterCommand(&ChatCommand{
+		Name:    "find",
+		Help:    "Prints the online status and the current server of a player",
+		Params:  []ChatCommandParam{{Name: "playername", Type: ParamPlayer}},
+		Privs:   privs("find"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			c2 := args.Conn("playername")
+			SendChatMsg(c, c2.Username()+" is connected to server "+c2.ServerName())
+		},
+	})
+
+	RegisterCommand(&ChatCommand{
+		Name:    "addr",
+		Help:    "Prints the network address (including the port) of a connected player",
+		Params:  []ChatCommandParam{{Name: "playername", Type: ParamPlayer}},
+		Privs:   privs("addr"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			c2 := args.Conn("playername")
+			SendChatMsg(c, c2.Username()+"'s address is "+c2.Addr().String())
+		},
+	})
 
-	RegisterChatCommand("end",
-		"Kicks all connected clients and stops the proxy. Usage: end",
-		privs("end"),
-		true,
-		func(c *Conn, param string) {
+	RegisterCommand(&ChatCommand{
+		Name:    "end",
+		Help:    "Kicks all connected clients and stops the proxy",
+		Privs:   privs("end"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
 			End(false, false)
-		})
-
-	RegisterChatCommand("privs",
-		`Prints your privileges if executed without arguments. 
-		Prints a connected player's privileges if executed with arguments. Usage: privs [playername]`,
-		nil,
-		true,
-		func(c *Conn, param string) {
+		},
+	})
+
+	RegisterCommand(&ChatCommand{
+		Name: "privs",
+		Help: `Prints your privileges if executed without arguments. 
+		Prints a player's privileges if executed with arguments`,
+		Params:  []ChatCommandParam{{Name: "playername", Optional: true}},
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
 			var r string
 
-			name := param
+			name := args.String("playername")
 			if name == "" {
 				if c == nil {
 					log.Print("Cannot read privileges of console!")
@@ -325,99 +274,77 @@ func init() {
 			eprivs := encodePrivs(privs)
 
 			SendChatMsg(c, r+strings.Replace(eprivs, "|", " ", -1))
-		})
-
-	RegisterChatCommand("grant",
-		`Grants privileges to a connected player. The privileges need to be comma-seperated. 
-		If the playername is omitted, privileges are granted to you. Usage: grant [playername] <privileges>`,
-		privs("privs"),
-		true,
-		func(c *Conn, param string) {
-			name := strings.Split(param, " ")[0]
-			var privnames string
-
-			if len(strings.Split(param, " ")) < 2 {
-				if c == nil {
-					log.Print("Cannot write privileges of console!")
-					return
-				}
-
-				privnames = name
-				name = c.Username()
-			} else {
-				privnames = strings.Split(param, " ")[1]
-			}
-
-			privs, err := Privs(name)
-			if err != nil {
-				log.Print(err)
-				SendChatMsg(c, "An internal error occured while attempting to get the privileges")
-				return
-			}
-
-			splitprivs := strings.Split(strings.Replace(privnames, " ", "", -1), ",")
-			for i := range splitprivs {
-				privs[splitprivs[i]] = true
-			}
+		},
+	})
 
-			err = SetPrivs(name, privs)
-			if err != nil {
-				log.Print(err)
-				SendChatMsg(c, "An internal error occured while attempting to set the privileges")
+	setPrivs := func(c *Conn, args *ChatCommandArgs, grant bool) {
+		name := args.String("playername")
+		if name == "" {
+			if c == nil {
+				log.Print("Cannot write privileges of console!")
 				return
 			}
 
-			SendChatMsg(c, "Privileges updated")
-		})
-
-	RegisterChatCommand("revoke",
-		`Revokes privileges from a connected player. The privileges need to be comma-seperated. 
-		If the playername is omitted, privileges are revoked from you. Usage: revoke [playername] <privileges>`,
-		privs("privs"),
-		true,
-		func(c *Conn, param string) {
-			name := strings.Split(param, " ")[0]
-			var privnames string
+			name = c.Username()
+		}
 
-			if len(strings.Split(param, " ")) < 2 {
-				if c == nil {
-					log.Print("Cannot write privileges of console!")
-					return
-				}
+		privs, err := Privs(name)
+		if err != nil {
+			log.Print(err)
+			SendChatMsg(c, "An internal error occured while attempting to get the privileges")
+			return
+		}
 
-				privnames = name
-				name = c.Username()
-			} else {
-				privnames = strings.Split(param, " ")[1]
-			}
+		for priv := range args.Privs("privileges") {
+			privs[priv] = grant
+		}
 
-			privs, err := Privs(name)
-			if err != nil {
-				log.Print(err)
-				SendChatMsg(c, "An internal error occured while attempting to get the privileges")
-				return
-			}
+		err = SetPrivs(name, privs)
+		if err != nil {
+			log.Print(err)
+			SendChatMsg(c, "An internal error occured while attempting to set the privileges")
+			return
+		}
 
-			splitprivs := strings.Split(strings.Replace(privnames, " ", "", -1), ",")
-			for i := range splitprivs {
-				privs[splitprivs[i]] = false
-			}
+		SendChatMsg(c, "Privileges updated")
+	}
 
-			err = SetPrivs(name, privs)
-			if err != nil {
-				log.Print(err)
-				SendChatMsg(c, "An internal error occured while attempting to set the privileges")
-				return
-			}
+	RegisterCommand(&ChatCommand{
+		Name: "grant",
+		Help: `Grants privileges to a player. The privileges need to be comma-seperated. 
+		If the playername is omitted, privileges are granted to you`,
+		Params: []ChatCommandParam{
+			{Name: "playername", Optional: true},
+			{Name: "privileges", Type: ParamPrivs},
+		},
+		Privs:   privs("privs"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			setPrivs(c, args, true)
+		},
+	})
 
-			SendChatMsg(c, "Privileges updated")
-		})
+	RegisterCommand(&ChatCommand{
+		Name: "revoke",
+		Help: `Revokes privileges from a player. The privileges need to be comma-seperated. 
+		If the playername is omitted, privileges are revoked from you`,
+		Params: []ChatCommandParam{
+			{Name: "playername", Optional: true},
+			{Name: "privileges", Type: ParamPrivs},
+		},
+		Privs:   privs("privs"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			setPrivs(c, args, false)
+		},
+	})
 
-	RegisterChatCommand("banlist",
-		"Prints the list of banned IP address and associated players. Usage: banlist",
-		privs("ban"),
-		true,
-		func(c *Conn, param string) {
+	RegisterCommand(&ChatCommand{
+		Name:    "banlist",
+		Help:    "Prints the list of banned IP address and associated players",
+		Privs:   privs("ban"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
 			bans, err := BanList()
 			if err != nil {
 				SendChatMsg(c, "An internal error occured while attempting to read the ban list")
@@ -430,44 +357,41 @@ func init() {
 			}
 
 			SendChatMsg(c, msg)
-		})
-
-	RegisterChatCommand("kick",
-		"Kicks a connected player. Usage: kick <playername> [reason]",
-		privs("kick"),
-		true,
-		func(c *Conn, param string) {
-			if param == "" {
-				SendChatMsg(c, "Usage: kick <playername> [reason]")
-				return
-			}
+		},
+	})
 
-			name := strings.Split(param, " ")[0]
-			r := "Kicked. " + strings.Join(strings.Split(param, " ")[1:], " ") + "."
+	RegisterCommand(&ChatCommand{
+		Name: "kick",
+		Help: "Kicks a connected player",
+		Params: []ChatCommandParam{
+			{Name: "playername", Type: ParamPlayer},
+			{Name: "reason", Type: ParamRest, Optional: true},
+		},
+		Privs:   privs("kick"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			c2 := args.Conn("playername")
+			r := "Kicked. " + args.String("reason") + "."
+
+			c2.CloseWith(AccessDeniedCustomString, r, false)
+			SendChatMsg(c, "Kicked "+c2.Username())
+		},
+	})
 
-			if c2 := ConnByUsername(name); c2 != nil {
-				c2.CloseWith(AccessDeniedCustomString, r, false)
-				SendChatMsg(c, "Kicked "+name)
-			} else {
-				SendChatMsg(c, name+" is not online")
-			}
-		})
-
-	RegisterChatCommand("ban",
-		"Bans an IP address or a connected player. Usage: ban <playername | IP address>",
-		privs("ban"),
-		true,
-		func(c *Conn, param string) {
-			if param == "" {
-				SendChatMsg(c, "Usage: ban <playername | IP address>")
-				return
-			}
+	RegisterCommand(&ChatCommand{
+		Name:    "ban",
+		Help:    "Bans an IP address or a connected player",
+		Params:  []ChatCommandParam{{Name: "playername | IP address"}},
+		Privs:   privs("ban"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			target := args.String("playername | IP address")
 
-			err := Ban(param, "not known")
+			err := Ban(target, "not known")
 			if err != nil {
-				c2 := ConnByUsername(param)
+				c2 := ConnByUsername(target)
 				if c2 == nil {
-					SendChatMsg(c, param+" is not online")
+					SendChatMsg(c, target+" is not online")
 					return
 				}
 
@@ -477,34 +401,36 @@ func init() {
 				}
 			}
 
-			SendChatMsg(c, "Banned "+param)
-		})
+			SendChatMsg(c, "Banned "+target)
+		},
+	})
 
-	RegisterChatCommand("unban",
-		"Unbans an IP address or a playername. Usage: unban <playername | IP address>",
-		privs("ban"),
-		true,
-		func(c *Conn, param string) {
-			if param == "" {
-				SendChatMsg(c, "Usage: unban <playername | IP address>")
-				return
-			}
+	RegisterCommand(&ChatCommand{
+		Name:    "unban",
+		Help:    "Unbans an IP address or a playername",
+		Params:  []ChatCommandParam{{Name: "playername | IP address"}},
+		Privs:   privs("ban"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			target := args.String("playername | IP address")
 
-			if err := Unban(param); err != nil {
+			if err := Unban(target); err != nil {
 				SendChatMsg(c, "An internal error occured while attempting to unban the player")
 				return
 			}
 
-			SendChatMsg(c, "Unbanned "+param)
-		})
+			SendChatMsg(c, "Unbanned "+target)
+		},
+	})
 
-	RegisterChatCommand("uptime",
-		"Prints the uptime of the proxy. Usage: uptime",
-		nil,
-		true,
-		func(c *Conn, param string) {
+	RegisterCommand(&ChatCommand{
+		Name:    "uptime",
+		Help:    "Prints the uptime of the proxy",
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
 			SendChatMsg(c, "Uptime: "+strconv.FormatFloat(Uptime(), 'f', -1, 64)+"s")
-		})
+		},
+	})
 
 	RegisterOnRedirectDone(func(c *Conn, newsrv string, success bool) {
 		if success {
@@ -1,11 +1,8 @@
 package main
 
 import (
-	"bytes"
 	"crypto/subtle"
-	"encoding/binary"
 	"errors"
-	"io"
 	"log"
 	"net"
 	"regexp"
@@ -16,31 +13,37 @@ import (
 	"github.com/anon55555/mt/rudp"
 )
 
+// authAccept is sent to clients once they have been authenticated
+func authAccept() *ToCltAuthAccept {
+	return &ToCltAuthAccept{
+		SendInterval:    0.09,
+		SudoAuthMethods: AuthMechSRP,
+	}
+}
+
 // Init completes the initialisation of a connection to a server or client c2
 func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 	defer close(fin)
 
 	if c2.IsSrv() {
 		// We're trying to connect to a server
-		// INIT
-		data := make([]byte, 11+len(c.Username()))
-		data[0] = uint8(0x00)
-		data[1] = uint8(ToServerInit)
-		data[2] = uint8(0x1c)
-		binary.BigEndian.PutUint16(data[3:5], uint16(0x0000))
-		binary.BigEndian.PutUint16(data[5:7], uint16(ProtoMin))
-		binary.BigEndian.PutUint16(data[7:9], uint16(ProtoLatest))
-		binary.BigEndian.PutUint16(data[9:11], uint16(len(c.Username())))
-		copy(data[11:], []byte(c.Username()))
+		// Ask for the protocol version of the client
+		// so that packets don't have to be translated
+		protoMax := uint16(ProtoLatest)
+		if v := c.ProtoVer(); v >= ProtoMin && v < ProtoLatest {
+			protoMax = v
+		}
 
 		time.Sleep(250 * time.Millisecond)
 
-		if _, err := c2.Send(rudp.Pkt{
-			Reader: bytes.NewReader(data),
-			PktInfo: rudp.PktInfo{
-				Channel: 1,
-				Unrel:   true,
-			},
+		if _, err := c2.SendCmdInfo(&ToSrvInit{
+			SerializeVer: SerializeVer,
+			MinProtoVer:  ProtoMin,
+			MaxProtoVer:  protoMax,
+			Username:     c.Username(),
+		}, rudp.PktInfo{
+			Channel: 1,
+			Unrel:   true,
 		}); err != nil {
 			log.Print(err)
 		}
@@ -50,9 +53,9 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 			if err != nil {
 				if errors.Is(err, net.ErrClosed) {
 					if err = c2.WhyClosed(); err != nil {
-						log.Print(c2.Addr().String(), " disconnected with error: ", err)
+						LogWarn(c2.LogFields(), c2.Addr().String(), " disconnected with error: ", err)
 					} else {
-						log.Print(c2.Addr().String(), " disconnected")
+						LogInfo(c2.LogFields(), c2.Addr().String(), " disconnected")
 					}
 
 					return
@@ -66,12 +69,14 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 
 			switch cmd := ReadUint16(r); cmd {
 			case ToClientHello:
-				r.Seek(5, io.SeekStart)
-				c2.protoVer = ReadUint16(r)
-				r.Seek(10, io.SeekStart)
-				authMech := ReadUint8(r)
+				hello := &ToCltHello{}
+				if !decode(hello, r, 0) {
+					continue
+				}
+
+				c2.protoVer = hello.ProtoVer
 
-				if authMech&AuthMechSRP > 0 {
+				if hello.AuthMechs&AuthMechSRP > 0 {
 					// Compute and send SRP_BYTES_A
 					_, _, err := srp.NewClient([]byte(strings.ToLower(c.Username())), passPhrase)
 					if err != nil {
@@ -88,16 +93,10 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 					c.srp_A = A
 					c.srp_a = a
 
-					w := bytes.NewBuffer([]byte{0x00, ToServerSRPBytesA})
-					WriteBytes16(w, c.srp_A)
-					WriteUint8(w, 1)
-
-					ack, err := c2.Send(rudp.Pkt{
-						Reader: w,
-						PktInfo: rudp.PktInfo{
-							Channel: 1,
-						},
-					})
+					ack, err := c2.SendCmdInfo(&ToSrvSRPBytesA{
+						A:      c.srp_A,
+						NoSHA1: true,
+					}, rudp.PktInfo{Channel: 1})
 
 					if err != nil {
 						log.Print(err)
@@ -112,17 +111,10 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 						continue
 					}
 
-					w := bytes.NewBuffer([]byte{0x00, ToServerFirstSRP})
-					WriteBytes16(w, s)
-					WriteBytes16(w, v)
-					WriteUint8(w, 0)
-
-					ack, err := c2.Send(rudp.Pkt{
-						Reader: w,
-						PktInfo: rudp.PktInfo{
-							Channel: 1,
-						},
-					})
+					ack, err := c2.SendCmdInfo(&ToSrvFirstSRP{
+						Salt:     s,
+						Verifier: v,
+					}, rudp.PktInfo{Channel: 1})
 
 					if err != nil {
 						log.Print(err)
@@ -132,10 +124,12 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 				}
 			case ToClientSrpBytesSB:
 				// Compute and send SRP_BYTES_M
-				s := ReadBytes16(r)
-				r.Seek(2, io.SeekCurrent)
-				B := make([]byte, r.Len())
-				r.Read(B)
+				sb := &ToCltSRPBytesSaltB{}
+				if !decode(sb, r, c2.ProtoVer()) {
+					continue
+				}
+
+				s, B := sb.Salt, sb.B
 
 				K, err := srp.CompleteHandshake(c.srp_A, c.srp_a, []byte(strings.ToLower(c.Username())), passPhrase, s, B)
 				if err != nil {
@@ -147,15 +141,7 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 
 				M := srp.ClientProof([]byte(c.Username()), s, c.srp_A, B, c.srp_K)
 
-				w := bytes.NewBuffer([]byte{0x00, ToServerSRPBytesM})
-				WriteBytes16(w, M)
-
-				ack, err := c2.Send(rudp.Pkt{
-					Reader: w,
-					PktInfo: rudp.PktInfo{
-						Channel: 1,
-					},
-				})
+				ack, err := c2.SendCmdInfo(&ToSrvSRPBytesM{M: M}, rudp.PktInfo{Channel: 1})
 
 				if err != nil {
 					log.Print(err)
@@ -173,7 +159,7 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 					}
 				}
 
-				log.Print("access denied by server " + srv)
+				LogWarn(LogFields{"server": srv}, "access denied by server "+srv)
 
 				if noAccessDenied {
 					return
@@ -187,12 +173,7 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 					fin <- c2
 				}()
 
-				ack, err := c2.Send(rudp.Pkt{
-					Reader: bytes.NewReader([]byte{0, ToServerInit2, 0, 0}),
-					PktInfo: rudp.PktInfo{
-						Channel: 1,
-					},
-				})
+				ack, err := c2.SendCmdInfo(&ToSrvInit2{}, rudp.PktInfo{Channel: 1})
 
 				if err != nil {
 					log.Print(err)
@@ -209,21 +190,12 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 					continue
 				}
 
-				v := []byte("5.5.0-dev-83a7b48bb")
-
-				w := bytes.NewBuffer([]byte{0x00, ToServerClientReady})
-				w.Write([]byte{5, 4, 0, 0})
-				WriteBytes16(w, v)
-				if c.FormspecVer() != 1 {
-					WriteUint16(w, c.FormspecVer())
-				}
-
-				_, err := c2.Send(rudp.Pkt{
-					Reader: w,
-					PktInfo: rudp.PktInfo{
-						Channel: 1,
-					},
-				})
+				_, err := c2.SendCmdInfo(&ToSrvCltReady{
+					Major:    5,
+					Minor:    4,
+					Version:  "5.5.0-dev-83a7b48bb",
+					Formspec: c.FormspecVer(),
+				}, rudp.PktInfo{Channel: 1})
 
 				if err != nil {
 					log.Print(err)
@@ -240,15 +212,11 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 			if err != nil {
 				if errors.Is(err, net.ErrClosed) {
 					if err = c2.WhyClosed(); err != nil {
-						log.Print(c2.Addr().String(), " disconnected with error: ", err)
+						LogWarn(c2.LogFields(), c2.Addr().String(), " disconnected with error: ", err)
 					} else {
-						log.Print(c2.Addr().String(), " disconnected")
+						LogInfo(c2.LogFields(), c2.Addr().String(), " disconnected")
 					}
 
-					connectedConnsMu.Lock()
-					connectedConns--
-					connectedConnsMu.Unlock()
-
 					processLeave(c2)
 
 					return
@@ -263,26 +231,30 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 			switch cmd := ReadUint16(r); cmd {
 			case ToServerInit:
 				// Process data
-				r.Seek(9, io.SeekStart)
-				c2.username = string(ReadBytes16(r))
-				r.Seek(5, io.SeekStart)
+				initCmd := &ToSrvInit{}
+				if !decode(initCmd, r, 0) {
+					continue
+				}
+
+				c2.username = initCmd.Username
 
 				// Find protocol version
-				cliProtoMin := ReadUint16(r)
-				cliProtoMax := ReadUint16(r)
+				cliProtoMin := initCmd.MinProtoVer
+				cliProtoMax := initCmd.MaxProtoVer
 
 				var protov uint16
-				if cliProtoMax >= ProtoMin || cliProtoMin <= ProtoLatest {
+				if cliProtoMax >= ProtoMin && cliProtoMin <= ProtoLatest {
 					if cliProtoMax > ProtoLatest {
 						protov = ProtoLatest
 					} else {
-						protov = ProtoLatest
+						protov = cliProtoMax
 					}
 				}
 
 				c2.protoVer = protov
 
 				if strict, ok := ConfKey("force_latest_proto").(bool); (ok && strict) && (protov != ProtoLatest) || protov < ProtoMin || protov > ProtoLatest {
+					metricLogins.Inc("failure", "wrong_version")
 					c2.CloseWith(AccessDeniedWrongVersion, "", false)
 					fin <- c
 					return
@@ -290,11 +262,13 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 
 				msg := c2.Addr().String() + " tried to connect with "
 				if len(c2.Username()) == 0 {
+					metricLogins.Inc("failure", "wrong_name")
 					c2.CloseWith(AccessDeniedWrongName, "", false)
 					fin <- c
 					log.Print(msg + "empty name")
 					return
 				} else if len(c2.Username()) > MaxPlayerNameLength {
+					metricLogins.Inc("failure", "wrong_name")
 					c2.CloseWith(AccessDeniedWrongCharsInName, "", false)
 					fin <- c
 					log.Print(msg + "too long name")
@@ -307,6 +281,7 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 				}
 
 				if !ok || err != nil {
+					metricLogins.Inc("failure", "wrong_name")
 					c2.CloseWith(AccessDeniedWrongCharsInName, "", false)
 					fin <- c
 					log.Print(c2.Addr().String() + " tried to connect with invalid name")
@@ -314,12 +289,11 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 				}
 
 				// Send HELLO
-				data := make([]byte, 13+len(c2.Username()))
-				data[0] = uint8(0x00)
-				data[1] = uint8(ToClientHello)
-				data[2] = uint8(0x1c)
-				binary.BigEndian.PutUint16(data[3:5], uint16(0x0000))
-				binary.BigEndian.PutUint16(data[5:7], uint16(protov))
+				hello := &ToCltHello{
+					SerializeVer: SerializeVer,
+					ProtoVer:     protov,
+					Username:     c2.Username(),
+				}
 
 				// Check if user is banned
 				banned, bname, err := c2.IsBanned()
@@ -329,7 +303,9 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 				}
 
 				if banned {
-					log.Print("Banned user " + bname + " at " + c2.Addr().String() + " tried to connect")
+					LogWarn(c2.LogFields(), "Banned user "+bname+" at "+c2.Addr().String()+" tried to connect")
+
+					metricLogins.Inc("failure", "banned")
 
 					reason := "Your IP address is banned. Banned name is " + bname
 					c2.CloseWith(AccessDeniedCustomString, reason, false)
@@ -339,6 +315,7 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 
 				// Check if user is already connected
 				if IsOnline(c2.Username()) {
+					metricLogins.Inc("failure", "already_connected")
 					c2.CloseWith(AccessDeniedAlreadyConnected, "", false)
 					fin <- c
 					return
@@ -346,11 +323,28 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 
 				// Check if username is reserved for media or RPC
 				if c2.Username() == "media" || c2.Username() == "rpc" {
+					metricLogins.Inc("failure", "wrong_name")
 					c2.CloseWith(AccessDeniedWrongName, "", false)
 					fin <- c
 					return
 				}
 
+				// Don't admit new players if the proxy is about to stop
+				if pending, restart := ShuttingDown(); pending {
+					metricLogins.Inc("failure", "shutting_down")
+					c2.CloseWith(AccessDeniedShutdown, "", restart)
+					fin <- c
+					return
+				}
+
+				// Only staff may join during network-wide maintenance
+				if msg, on := Maintenance(MaintenanceAll); on && !c2.CanBypassMaintenance() {
+					metricLogins.Inc("failure", "maintenance")
+					c2.CloseWith(AccessDeniedCustomString, msg, false)
+					fin <- c
+					return
+				}
+
 				v, s, err := Password(c2.Username())
 				if err != nil {
 					log.Print(err)
@@ -360,17 +354,14 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 				if v == nil || s == nil {
 					// New player
 					c2.authMech = AuthMechFirstSRP
-					binary.BigEndian.PutUint32(data[7:11], uint32(AuthMechFirstSRP))
 				} else {
 					// Existing player
 					c2.authMech = AuthMechSRP
-					binary.BigEndian.PutUint32(data[7:11], uint32(AuthMechSRP))
 				}
 
-				binary.BigEndian.PutUint16(data[11:13], uint16(len(c2.Username())))
-				copy(data[13:], []byte(c2.Username()))
+				hello.AuthMechs = uint32(c2.authMech)
 
-				ack, err := c2.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
+				ack, err := c2.SendCmd(hello)
 				if err != nil {
 					log.Print(err)
 					continue
@@ -382,65 +373,68 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 				if c2.authMech != AuthMechFirstSRP {
 					log.Print(c2.Addr().String() + " used unsupported AuthMechFirstSRP")
 
+					metricLogins.Inc("failure", "unexpected_data")
 					c2.CloseWith(AccessDeniedUnexpectedData, "", false)
 					fin <- c
 					return
 				}
 
 				// This is a new player, save verifier and salt
-				s := ReadBytes16(r)
-				v := ReadBytes16(r)
-
-				empty := ReadUint8(r)
+				firstSRP := &ToSrvFirstSRP{}
+				if !decode(firstSRP, r, c2.ProtoVer()) {
+					continue
+				}
 
 				// Also make sure to check for an empty password
 				disallow, ok := ConfKey("disallow_empty_passwords").(bool)
-				if ok && disallow && empty > 0 {
+				if ok && disallow && firstSRP.EmptyPasswd {
 					log.Print(c2.Addr().String() + " used an empty password but disallow_empty_passwords is true")
 
+					metricLogins.Inc("failure", "empty_password")
 					c2.CloseWith(AccessDeniedEmptyPassword, "", false)
 					fin <- c
 					return
 				}
 
-				if err := CreateUser(c2.Username(), v, s); err != nil {
+				// Check player_limit before creating the account
+				if !admit(c2) {
+					metricLogins.Inc("failure", "too_many_users")
+					c2.CloseWith(AccessDeniedTooManyUsers, "", true)
+					fin <- c
+					return
+				}
+
+				if err := CreateUser(c2.Username(), firstSRP.Verifier, firstSRP.Salt); err != nil {
 					log.Print(err)
 					continue
 				}
 
 				// Send AUTH_ACCEPT
-				data := []byte{
-					0, ToClientAuthAccept,
-					// Position stuff
-					0, 0, 0, 0,
-					0, 0, 0, 0,
-					0, 0, 0, 0,
-					// Map seed
-					0, 0, 0, 0,
-					0, 0, 0, 0,
-					// Send interval
-					0x3D, 0xB8, 0x51, 0xEC,
-					// Sudo mode mechs
-					0, 0, 0, AuthMechSRP,
-				}
-
-				ack, err := c2.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
+				ack, err := c2.SendCmd(authAccept())
 				if err != nil {
 					log.Print(err)
 					continue
 				}
 				<-ack
+
+				metricLogins.Inc("success", "new_player")
 			case ToServerSRPBytesA:
 				// Process data
 				// Make sure the client is allowed to use AuthMechSRP
 				if c2.authMech != AuthMechSRP {
 					log.Print(c2.Addr().String() + " used unsupported AuthMechSRP")
 
+					metricLogins.Inc("failure", "unexpected_data")
 					c2.CloseWith(AccessDeniedUnexpectedData, "", false)
 					return
 				}
 
-				A := ReadBytes16(r)
+				bytesA := &ToSrvSRPBytesA{}
+				if !decode(bytesA, r, c2.ProtoVer()) {
+					continue
+				}
+
+				A := bytesA.A
 
 				v, s, err := Password(c2.Username())
 				if err != nil {
@@ -460,19 +454,7 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 				c2.srp_K = K
 
 				// Send SRP_BYTES_S_B
-				data := make([]byte, 6+len(s)+len(B))
-				data[0] = uint8(0x00)
-				data[1] = uint8(ToClientSrpBytesSB)
-				binary.BigEndian.PutUint16(data[2:4], uint16(len(s)))
-				copy(data[4:4+len(s)], s)
-				binary.BigEndian.PutUint16(data[4+len(s):6+len(s)], uint16(len(B)))
-				copy(data[6+len(s):6+len(s)+len(B)], B)
-
-				w := bytes.NewBuffer([]byte{0x00, ToClientSrpBytesSB})
-				WriteBytes16(w, s)
-				WriteBytes16(w, B)
-
-				ack, err := c2.Send(rudp.Pkt{Reader: w})
+				ack, err := c2.SendCmd(&ToCltSRPBytesSaltB{Salt: s, B: B})
 				if err != nil {
 					log.Print(err)
 					continue
@@ -484,41 +466,45 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 				if c2.authMech != AuthMechSRP {
 					log.Print(c2.Addr().String() + " used unsupported AuthMechSRP")
 
+					metricLogins.Inc("failure", "unexpected_data")
 					c2.CloseWith(AccessDeniedUnexpectedData, "", false)
 					fin <- c
 					return
 				}
 
-				M := ReadBytes16(r)
+				bytesM := &ToSrvSRPBytesM{}
+				if !decode(bytesM, r, c2.ProtoVer()) {
+					continue
+				}
+
 				M2 := srp.ClientProof([]byte(c2.Username()), c2.srp_s, c2.srp_A, c2.srp_B, c2.srp_K)
 
-				if subtle.ConstantTimeCompare(M, M2) == 1 {
+				if subtle.ConstantTimeCompare(bytesM.M, M2) == 1 {
 					// Password is correct
-					// Send AUTH_ACCEPT
-					data := []byte{
-						0, ToClientAuthAccept,
-						// Position stuff
-						0, 0, 0, 0,
-						0, 0, 0, 0,
-						0, 0, 0, 0,
-						// Map seed
-						0, 0, 0, 0,
-						0, 0, 0, 0,
-						// Send interval
-						0x3D, 0xB8, 0x51, 0xEC,
-						// Sudo mode mechs
-						0, 0, 0, AuthMechSRP,
+
+					// Check player_limit now that the player is authenticated
+					// admit may kick an idle player for a reserved slot
+					if !admit(c2) {
+						metricLogins.Inc("failure", "too_many_users")
+						c2.CloseWith(AccessDeniedTooManyUsers, "", true)
+						fin <- c
+						return
 					}
 
-					ack, err := c2.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
+					// Send AUTH_ACCEPT
+					ack, err := c2.SendCmd(authAccept())
 					if err != nil {
 						log.Print(err)
 						continue
 					}
 					<-ack
+
+					metricLogins.Inc("success", "password")
 				} else {
 					// Client supplied wrong password
-					log.Print("User " + c2.Username() + " at " + c2.Addr().String() + " supplied wrong password")
+					LogWarn(c2.LogFields(), "User "+c2.Username()+" at "+c2.Addr().String()+" supplied wrong password")
+
+					metricLogins.Inc("failure", "wrong_password")
 
 					c2.CloseWith(AccessDeniedWrongPassword, "", false)
 					fin <- c
@@ -527,24 +513,31 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 			case ToServerInit2:
 				c2.announceMedia()
 			case ToServerRequestMedia:
-				c2.sendMedia(r)
+				rq := &ToSrvReqMedia{}
+				if decode(rq, r, c2.ProtoVer()) {
+					c2.sendMedia(rq.Files)
+				}
 			case ToServerClientReady:
 				// Second check if user is already connected
 				// This is needed because the INIT packet
 				// doesn't mark a player as online
 				if IsOnline(c2.Username()) {
+					metricLogins.Inc("failure", "already_connected")
 					c2.CloseWith(AccessDeniedAlreadyConnected, "", false)
 					fin <- c
 					return
 				}
 
-				r.Seek(4, io.SeekCurrent)
-				ReadBytes16(r)
-				if r.Len() >= 2 {
-					c2.formspecVer = ReadUint16(r) - 1
+				ready := &ToSrvCltReady{}
+				if decode(ready, r, c2.ProtoVer()) {
+					c2.formspecVer = ready.Formspec - 1
 				}
 
-				defaultSrv := ConfKey("default_server").(string)
+				// Use another server if the default server is down
+				defaultSrv := FallbackServer("")
+				if defaultSrv == "" {
+					defaultSrv = ConfKey("default_server").(string)
+				}
 
 				defSrv := func() *Conn {
 					defaultSrvAddr := ConfKey("servers:" + defaultSrv + ":address").(string)
@@ -589,7 +582,7 @@ func Init(c, c2 *Conn, ignMedia, noAccessDenied bool, fin chan *Conn) {
 					}
 
 					straddr, ok := ConfKey("servers:" + srvname + ":address").(string)
-					if !ok {
+					if !ok || !ServerUp(srvname) || ServerFull(srvname) || !c2.mayJoin(srvname) {
 						go c2.SendChatMsg("Could not connect you to your last server!")
 
 						fin <- defSrv()
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"net"
 	"sync"
 
@@ -9,8 +8,6 @@ import (
 	"github.com/anon55555/mt/rudp"
 )
 
-var ErrPlayerLimitReached = errors.New("player limit reached")
-
 type Listener struct {
 	*rudp.Listener
 }
@@ -39,12 +36,20 @@ func (l *Listener) Accept() (*Conn, error) {
 	conns[clt] = struct{}{}
 	connMu.Unlock()
 
+	connectedConnsMu.Lock()
+	connectedConns++
+	connectedConnsMu.Unlock()
+
 	go func() {
 		<-clt.Closed()
 
 		connMu.Lock()
 		delete(conns, clt)
 		connMu.Unlock()
+
+		connectedConnsMu.Lock()
+		connectedConns--
+		connectedConnsMu.Unlock()
 	}()
 
 	clt.aoIDs = make(map[uint16]bool)
@@ -52,20 +57,8 @@ func (l *Listener) Accept() (*Conn, error) {
 	clt.huds = make(map[uint32]bool)
 	clt.sounds = make(map[int32]bool)
 	clt.inv = &mt.Inv{}
-
-	maxConns, ok := ConfKey("player_limit").(int)
-	if !ok {
-		maxConns = int(^uint(0) >> 1)
-	}
-
-	if ConnCount() >= maxConns {
-		clt.CloseWith(AccessDeniedTooManyUsers, "", true)
-		return nil, ErrPlayerLimitReached
-	}
-
-	connectedConnsMu.Lock()
-	connectedConns++
-	connectedConnsMu.Unlock()
+	clt.state = newClientState()
+	clt.markActive()
 
 	return clt, nil
 }
@@ -1,18 +1,29 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/tncardoso/gocurses"
 )
 
 const MaxLogMSGs = 1024
 
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
 var logReady chan struct{}
+var logger *Logger
 
 func appendPop(max int, a []string, v ...string) []string {
 	if len(a) < max {
@@ -27,50 +38,239 @@ func appendPop(max int, a []string, v ...string) []string {
 	}
 }
 
+// LogFields are structured fields attached to a log entry
+type LogFields map[string]interface{}
+
+// A LogFrontend presents the log output to an operator
+type LogFrontend interface {
+	// Print is called with every batch of new log lines
+	Print(lines []string)
+	// Close is called when the proxy shuts down
+	Close()
+}
+
 type Logger struct {
-	lines  []string
-	all    []byte
-	offset int
+	level int
+	json  bool
+
+	fileMu sync.RWMutex
+	file   *logFile
+
+	frontendMu sync.RWMutex
+	frontends  map[LogFrontend]struct{}
 }
 
 func newLogger() *Logger {
-	l := &Logger{}
-	initCurses(l)
+	l := &Logger{
+		level:     LevelInfo,
+		frontends: make(map[LogFrontend]struct{}),
+	}
+
+	if name, ok := ConfKey("log_level").(string); ok {
+		for level, levelName := range levelNames {
+			if strings.EqualFold(name, levelName) {
+				l.level = level
+			}
+		}
+	}
+
+	if format, ok := ConfKey("log_format").(string); ok && format == "json" {
+		l.json = true
+	}
+
+	// The process that is being taken over still writes to the log file
+	if !takeover {
+		l.openFile()
+	}
+
 	return l
 }
 
+// openFile opens the log file in the log directory
+func (l *Logger) openFile() {
+	maxSize, ok := ConfKey("log_max_size").(int)
+	if !ok {
+		maxSize = 10
+	}
+
+	interval, ok := ConfKey("log_rotate_interval").(int)
+	if !ok {
+		interval = 24
+	}
+
+	maxFiles, ok := ConfKey("log_max_files").(int)
+	if !ok {
+		maxFiles = 10
+	}
+
+	file, err := openLogFile("log", int64(maxSize)<<20, time.Duration(interval)*time.Hour, maxFiles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	l.fileMu.Lock()
+	defer l.fileMu.Unlock()
+
+	l.file = file
+}
+
+// closeFile stops writing to the log file
+func (l *Logger) closeFile() {
+	l.fileMu.Lock()
+	defer l.fileMu.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// AddFrontend makes a LogFrontend receive all future log lines
+func (l *Logger) AddFrontend(f LogFrontend) {
+	l.frontendMu.Lock()
+	defer l.frontendMu.Unlock()
+
+	l.frontends[f] = struct{}{}
+}
+
+// RemoveFrontend stops sending log lines to a LogFrontend
+func (l *Logger) RemoveFrontend(f LogFrontend) {
+	l.frontendMu.Lock()
+	defer l.frontendMu.Unlock()
+
+	delete(l.frontends, f)
+}
+
+// Write logs p at LevelInfo, it is used by the log package
 func (l *Logger) Write(p []byte) (int, error) {
-	rows, _ := gocurses.Getmaxyx()
+	l.Log(LevelInfo, nil, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
 
-	for i, line := range strings.Split(string(p)[:len(p)-1], "\n") {
-		if i > 0 {
-			t := time.Now()
-			date := fmt.Sprintf("%.4d/%.2d/%.2d %.2d:%.2d:%.2d", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
+// Log logs a message with a level and structured fields
+func (l *Logger) Log(level int, fields LogFields, msg string) {
+	if level < l.level {
+		return
+	}
 
-			line = date + " " + line
-		}
+	t := time.Now()
+
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-		l.lines = appendPop(MaxLogMSGs, l.lines, line)
-		if l.offset > 0 {
-			l.offset += 1
+	var suffix string
+	for _, k := range keys {
+		suffix += fmt.Sprintf(" %s=%v", k, fields[k])
+	}
+
+	prefix := t.Format("2006/01/02 15:04:05") + " "
+	if level != LevelInfo {
+		prefix += levelNames[level] + " "
+	}
+
+	parts := strings.Split(msg, "\n")
+
+	var lines []string
+	for i, part := range parts {
+		line := prefix + part
+		if i == len(parts)-1 {
+			line += suffix
 		}
+
+		lines = append(lines, line)
 	}
 
-	start := len(l.lines) - rows + 1 - l.offset
-	if start < 0 {
-		start = 0
+	l.frontendMu.RLock()
+	for f := range l.frontends {
+		f.Print(lines)
 	}
+	l.frontendMu.RUnlock()
 
-	draw(l.lines[start : len(l.lines)-l.offset])
-	l.all = append(l.all, p...)
-	return len(p), nil
+	l.fileMu.RLock()
+	defer l.fileMu.RUnlock()
+
+	if l.file == nil {
+		return
+	}
+
+	if l.json {
+		entry := make(map[string]interface{})
+		for k, v := range fields {
+			entry[k] = v
+		}
+
+		entry["time"] = t.Format(time.RFC3339)
+		entry["level"] = strings.ToLower(levelNames[level])
+		entry["msg"] = msg
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+
+		l.file.Write(append(data, '\n'))
+	} else {
+		l.file.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	}
 }
 
 func (l *Logger) Close() {
-	os.Mkdir("log", 0777)
+	l.frontendMu.Lock()
+	for f := range l.frontends {
+		f.Close()
+	}
+	l.frontends = make(map[LogFrontend]struct{})
+	l.frontendMu.Unlock()
 
-	os.Rename("log/latest.txt", "log/last.txt")
-	os.WriteFile("log/latest.txt", l.all, 0666)
+	l.closeFile()
+}
+
+func logLevel(level int, fields LogFields, v ...interface{}) {
+	msg := fmt.Sprint(v...)
+	if logger == nil {
+		log.Print(msg)
+		return
+	}
+
+	logger.Log(level, fields, msg)
+}
+
+// LogDebug logs a debug message with structured fields
+func LogDebug(fields LogFields, v ...interface{}) { logLevel(LevelDebug, fields, v...) }
+
+// LogInfo logs an informational message with structured fields
+func LogInfo(fields LogFields, v ...interface{}) { logLevel(LevelInfo, fields, v...) }
+
+// LogWarn logs a warning with structured fields
+func LogWarn(fields LogFields, v ...interface{}) { logLevel(LevelWarn, fields, v...) }
+
+// LogError logs an error with structured fields
+func LogError(fields LogFields, v ...interface{}) { logLevel(LevelError, fields, v...) }
+
+// LogFields returns the structured log fields describing a Conn
+func (c *Conn) LogFields() LogFields {
+	fields := LogFields{"addr": c.Addr().String()}
+	if c.IsSrv() {
+		if srv := ServerNameByAddr(c.Addr().String()); srv != "" {
+			fields["server"] = srv
+		}
+
+		return fields
+	}
+
+	if c.Username() != "" {
+		fields["player"] = c.Username()
+	}
+
+	if c.Server() != nil {
+		fields["server"] = c.ServerName()
+	}
+
+	return fields
 }
 
 func LogReady() <-chan struct{} {
@@ -83,6 +283,14 @@ func LogReady() <-chan struct{} {
 
 func init() {
 	l := newLogger()
+	if headless {
+		l.AddFrontend(newHeadlessFrontend(os.Stdout, os.Stdin))
+	} else {
+		l.AddFrontend(newCursesFrontend())
+	}
+
+	logger = l
+	log.SetFlags(0)
 	log.SetOutput(l)
 
 	go func() {
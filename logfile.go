@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const latestLogName = "latest.txt"
+
+// logFile is a log file that is written to as messages are logged
+// and rotated once it exceeds a size or age limit
+type logFile struct {
+	mu sync.Mutex
+
+	dir      string
+	maxSize  int64
+	interval time.Duration
+	maxFiles int
+
+	f       *os.File
+	size    int64
+	created time.Time
+}
+
+func openLogFile(dir string, maxSize int64, interval time.Duration, maxFiles int) (*logFile, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	lf := &logFile{
+		dir:      dir,
+		maxSize:  maxSize,
+		interval: interval,
+		maxFiles: maxFiles,
+	}
+
+	// Archive the log of the previous run
+	if err := lf.rotate(); err != nil {
+		return nil, err
+	}
+
+	return lf, nil
+}
+
+func (lf *logFile) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	if (lf.maxSize > 0 && lf.size+int64(len(p)) > lf.maxSize) || (lf.interval > 0 && time.Since(lf.created) > lf.interval) {
+		if err := lf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+
+	return n, err
+}
+
+func (lf *logFile) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.f == nil {
+		return os.ErrClosed
+	}
+
+	err := lf.f.Close()
+	lf.f = nil
+
+	return err
+}
+
+// rotate archives the current log file, removes old archives
+// and opens a new log file
+// The caller must hold lf.mu unless lf isn't in use yet
+func (lf *logFile) rotate() error {
+	if lf.f != nil {
+		lf.f.Close()
+		lf.f = nil
+	}
+
+	latest := filepath.Join(lf.dir, latestLogName)
+	if fi, err := os.Stat(latest); err == nil && fi.Size() > 0 {
+		base := filepath.Join(lf.dir, fi.ModTime().Format("2006-01-02T15-04-05"))
+
+		archive := base + ".txt"
+		for i := 1; ; i++ {
+			if _, err := os.Stat(archive); os.IsNotExist(err) {
+				break
+			}
+			archive = base + "-" + strconv.Itoa(i) + ".txt"
+		}
+
+		if err := os.Rename(latest, archive); err != nil {
+			return err
+		}
+	}
+
+	lf.prune()
+
+	f, err := os.OpenFile(latest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	lf.f = f
+	lf.size = 0
+	lf.created = time.Now()
+
+	return nil
+}
+
+// prune removes the oldest archives if there are more than maxFiles
+func (lf *logFile) prune() {
+	if lf.maxFiles <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(lf.dir)
+	if err != nil {
+		return
+	}
+
+	var archives []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && name != latestLogName && strings.HasSuffix(name, ".txt") {
+			archives = append(archives, name)
+		}
+	}
+
+	// The names start with the date so they sort chronologically
+	sort.Strings(archives)
+
+	for len(archives) > lf.maxFiles {
+		os.Remove(filepath.Join(lf.dir, archives[0]))
+		archives = archives[1:]
+	}
+}
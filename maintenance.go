@@ -0,0 +1,188 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultMaintenanceMsg = "The server is under maintenance. Please come back later."
+
+// MaintenanceAll is the maintenance target of the whole network
+const MaintenanceAll = "all"
+
+// maintenance caches the maintenance messages stored in the database
+var maintenance = make(map[string]string)
+var maintenanceMu sync.RWMutex
+
+// Maintenance reports whether a server or the whole network (MaintenanceAll)
+// is in maintenance mode and returns the message shown to players
+func Maintenance(target string) (string, bool) {
+	maintenanceMu.RLock()
+	msg, ok := maintenance[target]
+	maintenanceMu.RUnlock()
+
+	if ok {
+		return msg, msg != ""
+	}
+
+	msg, err := StorageKey("maintenance:" + target)
+	if err != nil {
+		log.Print(err)
+		return "", false
+	}
+
+	maintenanceMu.Lock()
+	maintenance[target] = msg
+	maintenanceMu.Unlock()
+
+	return msg, msg != ""
+}
+
+// SetMaintenance enables or disables the maintenance mode
+// of a server or the whole network (MaintenanceAll)
+// Players on a server are sent to the fallback server
+// unless they can bypass the maintenance mode
+func SetMaintenance(target string, on bool, msg string) error {
+	if !on {
+		msg = ""
+	} else if msg == "" {
+		msg = defaultMaintenanceMsg
+	}
+
+	if err := SetStorageKey("maintenance:"+target, msg); err != nil {
+		return err
+	}
+
+	maintenanceMu.Lock()
+	maintenance[target] = msg
+	maintenanceMu.Unlock()
+
+	if !on || target == MaintenanceAll {
+		return nil
+	}
+
+	fallback := FallbackServer(target)
+	for _, c := range ConnsServer(target) {
+		if c.CanBypassMaintenance() {
+			continue
+		}
+
+		c.SendChatMsg(msg)
+		if fallback != "" {
+			go c.Redirect(fallback)
+		}
+	}
+
+	return nil
+}
+
+func inMaintenance(server string) bool {
+	_, on := Maintenance(server)
+	return on
+}
+
+// groupMaintenance returns the maintenance message of a member
+// of a group the Conn can't join because of its maintenance mode
+func (c *Conn) groupMaintenance(group string) (string, bool) {
+	grp, _ := ConfKey("groups:" + group).([]interface{})
+	for _, srv := range grp {
+		if msg, on := Maintenance(srv.(string)); on && !c.CanBypassMaintenance() {
+			return msg, true
+		}
+	}
+
+	return "", false
+}
+
+// mayJoin reports whether the Conn isn't kept away
+// from a server by its maintenance mode
+func (c *Conn) mayJoin(server string) bool {
+	return !inMaintenance(server) || c.CanBypassMaintenance()
+}
+
+// CanBypassMaintenance reports whether the Conn can use servers
+// that are in maintenance mode
+func (c *Conn) CanBypassMaintenance() bool {
+	priv, ok := ConfKey("maintenance_bypass_priv").(string)
+	if !ok {
+		priv = "maintenance"
+	}
+
+	has, err := c.CheckPrivs(map[string]bool{priv: true})
+	return err == nil && has
+}
+
+func init() {
+	disable, ok := ConfKey("disable_builtin").(bool)
+	if ok && disable {
+		return
+	}
+
+	RegisterCommand(&ChatCommand{
+		Name: "maintenance",
+		Help: `Enables or disables the maintenance mode of a server or the whole network.
+		Players are moved away from servers in maintenance mode, network-wide maintenance blocks logins.
+		Prints the servers in maintenance mode if executed without arguments`,
+		Params: []ChatCommandParam{
+			{Name: "servername | all", Optional: true},
+			{Name: "on | off", Optional: true},
+			{Name: "message", Type: ParamRest, Optional: true},
+		},
+		Privs:   privs("maintenance"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			if !args.Has("servername | all") {
+				var r []string
+				if _, on := Maintenance(MaintenanceAll); on {
+					r = append(r, MaintenanceAll)
+				}
+
+				servers := ConfKey("servers").(map[interface{}]interface{})
+				for server := range servers {
+					if _, on := Maintenance(server.(string)); on {
+						r = append(r, server.(string))
+					}
+				}
+				sort.Strings(r)
+
+				if len(r) == 0 {
+					SendChatMsg(c, "No server is in maintenance mode.")
+					return
+				}
+
+				SendChatMsg(c, "In maintenance mode: "+strings.Join(r, ", "))
+				return
+			}
+
+			target := args.String("servername | all")
+			if _, ok := ConfKey("servers:" + target + ":address").(string); !ok && target != MaintenanceAll {
+				SendChatMsg(c, "Unknown server "+target+".")
+				return
+			}
+
+			var on bool
+			switch args.String("on | off") {
+			case "on":
+				on = true
+			case "off":
+			default:
+				SendChatMsg(c, (&UsageError{Cmd: chatCommands["maintenance"], Msg: "Expected on or off"}).Error())
+				return
+			}
+
+			if err := SetMaintenance(target, on, args.String("message")); err != nil {
+				log.Print(err)
+				SendChatMsg(c, "An internal error occured while attempting to set the maintenance mode")
+				return
+			}
+
+			if on {
+				SendChatMsg(c, "Enabled maintenance mode of "+target)
+			} else {
+				SendChatMsg(c, "Disabled maintenance mode of "+target)
+			}
+		},
+	})
+}
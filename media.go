@@ -10,12 +10,19 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync/atomic"
 
 	"github.com/anon55555/mt/rudp"
 )
 
 const BytesPerBunch = 5000
 
+// Media pushes sent by the proxy have this bit set in their token
+// so that the confirmations of the clients aren't forwarded
+const proxyMediaToken = 0x80000000
+
+var mediaPushTokens uint32
+
 var media map[string]*mediaFile
 var nodedefs map[string][]byte
 var itemdefs map[string][]byte
@@ -108,24 +115,7 @@ func (c *Conn) fetchMedia() {
 			}
 
 			// Request the media
-			pktlen := 0
-			for f := range rq {
-				pktlen += 2 + len(rq[f])
-			}
-
-			w := bytes.NewBuffer([]byte{0x00, ToServerRequestMedia})
-			WriteUint16(w, uint16(len(rq)))
-			for f := range rq {
-				WriteBytes16(w, []byte(rq[f]))
-			}
-
-			_, err := c.Send(rudp.Pkt{
-				Reader: w,
-				PktInfo: rudp.PktInfo{
-					Channel: 1,
-				},
-			})
-
+			_, err := c.SendCmdInfo(&ToSrvReqMedia{Files: rq}, rudp.PktInfo{Channel: 1})
 			if err != nil {
 				go func() {
 					<-LogReady()
@@ -134,20 +124,18 @@ func (c *Conn) fetchMedia() {
 				continue
 			}
 		case ToClientMedia:
-			bunchCount := ReadUint16(r)
-			bunchID := ReadUint16(r)
-			fileCount := ReadUint32(r)
-
-			for i := uint32(0); i < fileCount; i++ {
-				name := string(ReadBytes16(r))
-				data := ReadBytes32(r)
+			files := &ToCltMedia{}
+			if !decode(files, r, c.ProtoVer()) {
+				continue
+			}
 
-				if media[name] != nil && len(media[name].data) == 0 {
-					media[name].data = data
+			for _, f := range files.Files {
+				if media[f.Name] != nil && len(media[f.Name].data) == 0 {
+					media[f.Name].data = f.Data
 				}
 			}
 
-			if bunchID >= bunchCount-1 {
+			if files.Bunch >= files.Bunches-1 {
 				c.Close()
 				return
 			}
@@ -246,39 +234,96 @@ func (c *Conn) announceMedia() {
 	<-ack
 }
 
-func (c *Conn) sendMedia(r *bytes.Reader) {
-	count := ReadUint16(r)
+// pushMedia sends a ToCltMediaPush to c
+// Clients using Proto40 or later request the file after the push
+func (c *Conn) pushMedia(name string, f *mediaFile) (<-chan struct{}, error) {
+	return c.SendCmd(&ToCltMediaPush{
+		Digest: f.digest,
+		Name:   name,
+		Cache:  !f.noCache,
+		Token:  proxyMediaToken | atomic.AddUint32(&mediaPushTokens, 1),
+		Data:   f.data,
+	})
+}
 
-	var rq []string
-	for i := uint16(0); i < count; i++ {
-		name := string(ReadBytes16(r))
-		rq = append(rq, name)
+// requestPushedMedia requests a file pushed by the server c
+// for the client clt, which uses a version before Proto40
+// and expects the file itself instead of a token
+func (c *Conn) requestPushedMedia(clt *Conn, push *ToCltMediaPush) {
+	if c.mediaPushes == nil {
+		c.mediaPushes = make(map[string]*ToCltMediaPush)
 	}
 
-	bunches := []map[string]*mediaFile{make(map[string]*mediaFile)}
+	c.mediaPushes[push.Name] = push
+
+	_, err := c.SendCmdInfo(&ToSrvReqMedia{Files: []string{push.Name}}, rudp.PktInfo{Channel: 1})
+	if err != nil {
+		LogWarn(clt.LogFields(), "Dropping pushed file ", push.Name, ": ", err)
+		delete(c.mediaPushes, push.Name)
+	}
+}
+
+// pushRequestedMedia pushes the files requested by requestPushedMedia
+// to the client clt and confirms them to the server c
+// It returns true if all files have been requested by the proxy
+func (c *Conn) pushRequestedMedia(clt *Conn, files *ToCltMedia) bool {
+	have := &ToSrvHaveMedia{}
+	requested := 0
+
+	for _, f := range files.Files {
+		push, ok := c.mediaPushes[f.Name]
+		if !ok {
+			continue
+		}
+
+		delete(c.mediaPushes, f.Name)
+		requested++
+
+		push.Data = f.Data
+		if _, err := clt.SendCmd(push); err != nil {
+			LogWarn(clt.LogFields(), "Dropping pushed file ", f.Name, ": ", err)
+		}
+
+		have.Tokens = append(have.Tokens, push.Token)
+	}
+
+	if len(have.Tokens) > 0 {
+		if _, err := c.SendCmd(have); err != nil {
+			log.Print(err)
+		}
+	}
+
+	return requested == len(files.Files)
+}
+
+// sendMedia sends requested files to c in bunches
+func (c *Conn) sendMedia(rq []string) {
+	bunches := [][]MediaFile{nil}
 	var bunchlen int
-	for _, f := range rq {
-		bunches[len(bunches)-1][f] = media[f]
-		bunchlen += len(media[f].data)
+	for _, name := range rq {
+		bunches[len(bunches)-1] = append(bunches[len(bunches)-1], MediaFile{
+			Name: name,
+			Data: media[name].data,
+		})
+		bunchlen += len(media[name].data)
 
 		if bunchlen >= BytesPerBunch {
-			bunches = append(bunches, make(map[string]*mediaFile))
+			bunches = append(bunches, nil)
 			bunchlen = 0
 		}
 	}
 
 	for i, bunch := range bunches {
-		w := bytes.NewBuffer([]byte{0x00, ToClientMedia})
-		WriteUint16(w, uint16(len(bunches)))
-		WriteUint16(w, uint16(i))
-		WriteUint32(w, uint32(len(bunch)))
-		for f, m := range bunch {
-			WriteBytes16(w, []byte(f))
-			WriteBytes32(w, m.data)
-		}
+		data := EncodeCmd(&ToCltMedia{
+			Bunches: uint16(len(bunches)),
+			Bunch:   uint16(i),
+			Files:   bunch,
+		}, c.ProtoVer())
+
+		metricMediaBytes.Add(float64(len(data)))
 
 		ack, err := c.Send(rudp.Pkt{
-			Reader: w,
+			Reader: bytes.NewReader(data),
 			PktInfo: rudp.PktInfo{
 				Channel: 2,
 			},
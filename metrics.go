@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A metric is exposed in the Prometheus text format
+type metric interface {
+	write(w io.Writer)
+}
+
+var metrics []metric
+
+// counterVec is a set of counters that are distinguished by labels
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	v := &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+
+	metrics = append(metrics, v)
+	return v
+}
+
+// Add adds n to the counter that has the specified label values
+func (v *counterVec) Add(n float64, labelValues ...string) {
+	key := formatLabels(v.labels, labelValues)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.values[key] += n
+}
+
+// Inc increments the counter that has the specified label values
+func (v *counterVec) Inc(labelValues ...string) { v.Add(1, labelValues...) }
+
+func (v *counterVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+
+	var keys []string
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, key, formatFloat(v.values[key]))
+	}
+}
+
+// gaugeFunc is a gauge that is computed when it is scraped
+type gaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	fn     func() map[string]float64
+}
+
+// newGaugeFunc registers a gauge, fn returns the values
+// keyed by the value of the label (if any)
+func newGaugeFunc(name, help string, fn func() map[string]float64, labels ...string) *gaugeFunc {
+	g := &gaugeFunc{
+		name:   name,
+		help:   help,
+		labels: labels,
+		fn:     fn,
+	}
+
+	metrics = append(metrics, g)
+	return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+
+	values := g.fn()
+
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var labels string
+		if len(g.labels) > 0 {
+			labels = formatLabels(g.labels, []string{key})
+		}
+
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labels, formatFloat(values[key]))
+	}
+}
+
+// histogramVec is a set of histograms that are distinguished by labels
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+
+	metrics = append(metrics, h)
+	return h
+}
+
+// Observe adds a sample to the histogram
+// that has the specified label values
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hv.counts[i]++
+		}
+	}
+
+	hv.count++
+	hv.sum += v
+}
+
+// ObserveSince adds the time since t in seconds to the histogram
+func (h *histogramVec) ObserveSince(t time.Time, labelValues ...string) {
+	h.Observe(time.Since(t).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	var keys []string
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hv := h.values[key]
+		labelValues := strings.Split(key, "\xff")
+
+		for i, bound := range h.buckets {
+			labels := formatLabels(append(h.labels, "le"), append(labelValues, formatFloat(bound)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, hv.counts[i])
+		}
+
+		labels := formatLabels(append(h.labels, "le"), append(labelValues, "+Inf"))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, hv.count)
+
+		labels = formatLabels(h.labels, labelValues)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, hv.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	escape := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+	var pairs []string
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+
+		pairs = append(pairs, name+"=\""+escape.Replace(value)+"\"")
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// cmdLabel formats a packet command for use as a label value
+func cmdLabel(cmd uint16) string {
+	return fmt.Sprintf("0x%02X", cmd)
+}
+
+var (
+	metricClients = newGaugeFunc("multiserver_clients",
+		"Number of connected clients",
+		func() map[string]float64 {
+			return map[string]float64{"": float64(ConnCount())}
+		})
+
+	metricServerPlayers = newGaugeFunc("multiserver_server_players",
+		"Number of players connected to each server",
+		func() map[string]float64 {
+			r := make(map[string]float64)
+
+			servers := ConfKey("servers").(map[interface{}]interface{})
+			for server := range servers {
+				r[server.(string)] = 0
+			}
+
+			for _, c := range Conns() {
+				if c.Server() != nil {
+					r[c.ServerName()]++
+				}
+			}
+
+			return r
+		}, "server")
+
+	metricServerUp = newGaugeFunc("multiserver_server_up",
+		"Whether a server passed its latest health check",
+		func() map[string]float64 {
+			r := make(map[string]float64)
+
+			servers := ConfKey("servers").(map[interface{}]interface{})
+			for server := range servers {
+				if ServerUp(server.(string)) {
+					r[server.(string)] = 1
+				} else {
+					r[server.(string)] = 0
+				}
+			}
+
+			return r
+		}, "server")
+
+	metricServerLatency = newGaugeFunc("multiserver_server_latency_seconds",
+		"Handshake latency of the latest health check of a server",
+		func() map[string]float64 {
+			r := make(map[string]float64)
+
+			servers := ConfKey("servers").(map[interface{}]interface{})
+			for server := range servers {
+				r[server.(string)] = Health(server.(string)).Latency.Seconds()
+			}
+
+			return r
+		}, "server")
+
+	metricRedirectAttempts = newCounterVec("multiserver_redirect_attempts_total",
+		"Number of connection attempts to servers during redirects, including retries and alternative servers", "server")
+
+	metricRedirects = newCounterVec("multiserver_redirects_total",
+		"Number of finished redirects by result", "server", "result")
+
+	metricLogins = newCounterVec("multiserver_logins_total",
+		"Number of client logins by result and reason", "result", "reason")
+
+	metricPackets = newCounterVec("multiserver_packets_total",
+		"Number of packets forwarded by direction and command", "direction", "command")
+
+	metricBytes = newCounterVec("multiserver_bytes_total",
+		"Number of bytes forwarded by direction and command", "direction", "command")
+
+	metricRPC = newCounterVec("multiserver_rpc_messages_total",
+		"Number of RPC messages by direction and command", "direction", "command")
+
+	metricMediaBytes = newCounterVec("multiserver_media_bytes_served_total",
+		"Number of media bytes sent to clients")
+
+	metricDBQueries = newHistogramVec("multiserver_db_query_duration_seconds",
+		"Latency of database queries",
+		[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		"type")
+)
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// ListenMetrics starts the Prometheus metrics listener if enabled
+func ListenMetrics() {
+	addr, ok := ConfKey("metrics_listen").(string)
+	if !ok || addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+
+	log.Print("Metrics listening on " + addr)
+
+	serveHTTP(addr, mux)
+}
@@ -0,0 +1,392 @@
+package mttest
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/HimbeerserverDE/srp"
+	"github.com/anon55555/mt/rudp"
+)
+
+// Timeout is how long a Client waits for a packet
+var Timeout = 10 * time.Second
+
+// An AccessDeniedError is returned if a Client is kicked
+type AccessDeniedError struct {
+	Reason    uint8
+	Custom    string
+	Reconnect bool
+}
+
+func (e *AccessDeniedError) Error() string {
+	if e.Custom != "" {
+		return fmt.Sprintf("access denied (reason %d): %s", e.Reason, e.Custom)
+	}
+
+	return fmt.Sprintf("access denied (reason %d)", e.Reason)
+}
+
+// A Client is a fake Minetest client
+type Client struct {
+	*rudp.Conn
+
+	// MaxProtoVer is the highest protocol version sent in the Init command
+	MaxProtoVer uint16
+	// ProtoVer is the protocol version chosen by the server
+	ProtoVer uint16
+
+	// Nodes, Items and Media are received during Login
+	Nodes []string
+	Items []string
+	Media map[string][]byte
+
+	pkts chan *Packet
+}
+
+// Dial connects a Client to a server
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		Conn:        rudp.Connect(conn),
+		MaxProtoVer: protoLatest,
+		Media:       make(map[string][]byte),
+		pkts:        make(chan *Packet, 1024),
+	}
+
+	// Get a peer ID
+	ack, err := c.Conn.Send(rudp.Pkt{Reader: bytes.NewReader([]byte{0, 0})})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ack:
+	case <-time.After(Timeout):
+		c.Close()
+		return nil, errors.New(addr + " is unreachable")
+	}
+
+	go func() {
+		defer close(c.pkts)
+
+		for {
+			pkt, err := c.Conn.Recv()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+
+				continue
+			}
+
+			if cmd, err := readPkt(pkt); err == nil {
+				c.pkts <- cmd
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+// Send sends a packet to the server
+func (c *Client) Send(cmd uint16, body []byte, info rudp.PktInfo) error {
+	w := newWriter(cmd)
+	w.Write(body)
+
+	_, err := c.Conn.Send(w.pkt(info))
+	return err
+}
+
+func (c *Client) send(w *writer) error {
+	_, err := c.Conn.Send(w.pkt(rudp.PktInfo{Channel: 1}))
+	return err
+}
+
+// Recv returns the next packet sent by the server
+func (c *Client) Recv() (*Packet, error) {
+	select {
+	case pkt, ok := <-c.pkts:
+		if !ok {
+			return nil, errClosed
+		}
+
+		return pkt, nil
+	case <-time.After(Timeout):
+		return nil, errors.New("timed out waiting for a packet")
+	}
+}
+
+// Expect skips packets until one with the command cmd is received
+// It returns an AccessDeniedError if the Client is kicked
+func (c *Client) Expect(cmd uint16) (*Packet, error) {
+	deadline := time.After(Timeout)
+	for {
+		select {
+		case pkt, ok := <-c.pkts:
+			if !ok {
+				return nil, errClosed
+			}
+
+			if pkt.Cmd == cmd {
+				return pkt, nil
+			}
+
+			if pkt.Cmd == ToClientAccessDenied {
+				r := newReader(pkt.Body)
+
+				err := &AccessDeniedError{Reason: r.u8()}
+				if r.len() > 0 {
+					err.Custom = r.str16()
+				}
+				if r.len() > 0 {
+					err.Reconnect = r.bool()
+				}
+
+				return nil, err
+			}
+		case <-deadline:
+			return nil, fmt.Errorf("timed out waiting for command 0x%02X", cmd)
+		}
+	}
+}
+
+// Login authenticates the Client, downloads the definitions
+// and the media and joins the game
+func (c *Client) Login(name, password string) error {
+	w := newWriter(ToServerInit)
+	w.u8(serializeVer)
+	w.u16(0)
+	w.u16(protoMin)
+	w.u16(c.MaxProtoVer)
+	w.str16(name)
+
+	if _, err := c.Conn.Send(w.pkt(rudp.PktInfo{Channel: 1, Unrel: true})); err != nil {
+		return err
+	}
+
+	pkt, err := c.Expect(ToClientHello)
+	if err != nil {
+		return err
+	}
+
+	r := newReader(pkt.Body)
+	r.u8()
+	r.u16()
+	c.ProtoVer = r.u16()
+	authMechs := r.u32()
+
+	if authMechs&AuthMechSRP != 0 {
+		A, a, err := srp.InitiateHandshake()
+		if err != nil {
+			return err
+		}
+
+		w := newWriter(ToServerSRPBytesA)
+		w.bytes16(A)
+		w.bool(true)
+		if err := c.send(w); err != nil {
+			return err
+		}
+
+		pkt, err := c.Expect(ToClientSRPBytesSaltB)
+		if err != nil {
+			return err
+		}
+
+		r := newReader(pkt.Body)
+		s, B := r.bytes16(), r.bytes16()
+
+		K, err := srp.CompleteHandshake(A, a, []byte(strings.ToLower(name)), []byte(password), s, B)
+		if err != nil {
+			return err
+		}
+
+		w = newWriter(ToServerSRPBytesM)
+		w.bytes16(srp.ClientProof([]byte(name), s, A, B, K))
+		if err := c.send(w); err != nil {
+			return err
+		}
+	} else {
+		s, v, err := srp.NewClient([]byte(strings.ToLower(name)), []byte(password))
+		if err != nil {
+			return err
+		}
+
+		w := newWriter(ToServerFirstSRP)
+		w.bytes16(s)
+		w.bytes16(v)
+		w.bool(password == "")
+		if err := c.send(w); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.Expect(ToClientAuthAccept); err != nil {
+		return err
+	}
+
+	w = newWriter(ToServerInit2)
+	w.str16("")
+	if err := c.send(w); err != nil {
+		return err
+	}
+
+	if err := c.recvDefs(); err != nil {
+		return err
+	}
+
+	w = newWriter(ToServerClientReady)
+	w.Write([]byte{5, 5, 0, 0})
+	w.str16("mttest")
+	w.u16(4)
+
+	return c.send(w)
+}
+
+// recvDefs receives the definitions and the media
+func (c *Client) recvDefs() error {
+	var rq []string
+	for announced := false; !announced; {
+		pkt, err := c.Recv()
+		if err != nil {
+			return err
+		}
+
+		r := newReader(pkt.Body)
+
+		switch pkt.Cmd {
+		case ToClientAccessDenied:
+			return &AccessDeniedError{Reason: r.u8()}
+		case ToClientNodeDef:
+			mgr, err := decompress(r.bytes32())
+			if err != nil {
+				return err
+			}
+
+			r := newReader(mgr)
+			r.u8()
+			count := r.u16()
+
+			defs := newReader(r.bytes32())
+			for i := uint16(0); i < count; i++ {
+				defs.u16()
+
+				def := newReader(defs.bytes16())
+				def.u8()
+				c.Nodes = append(c.Nodes, def.str16())
+			}
+
+			if defs.err != nil {
+				return defs.err
+			}
+		case ToClientItemDef:
+			mgr, err := decompress(r.bytes32())
+			if err != nil {
+				return err
+			}
+
+			r := newReader(mgr)
+			r.u8()
+			for i := r.u16(); i > 0; i-- {
+				def := newReader(r.bytes16())
+				def.u8()
+				def.u8()
+				c.Items = append(c.Items, def.str16())
+			}
+
+			if r.err != nil {
+				return r.err
+			}
+		case ToClientAnnounceMedia:
+			for i := r.u16(); i > 0; i-- {
+				rq = append(rq, r.str16())
+				r.str16()
+			}
+
+			announced = true
+		}
+	}
+
+	w := newWriter(ToServerRequestMedia)
+	w.u16(uint16(len(rq)))
+	for _, name := range rq {
+		w.str16(name)
+	}
+
+	if err := c.send(w); err != nil {
+		return err
+	}
+
+	for {
+		pkt, err := c.Expect(ToClientMedia)
+		if err != nil {
+			return err
+		}
+
+		r := newReader(pkt.Body)
+		bunches := r.u16()
+		bunch := r.u16()
+
+		for i := r.u32(); i > 0; i-- {
+			name := r.str16()
+			c.Media[name] = r.bytes32()
+		}
+
+		if r.err != nil {
+			return r.err
+		}
+
+		if bunch+1 >= bunches {
+			return nil
+		}
+	}
+}
+
+// JoinModChan joins a mod channel and waits for the answer of the server
+func (c *Client) JoinModChan(ch string) error {
+	w := newWriter(ToServerModChannelJoin)
+	w.str16(ch)
+	if err := c.send(w); err != nil {
+		return err
+	}
+
+	pkt, err := c.Expect(ToClientModChannelSignal)
+	if err != nil {
+		return err
+	}
+
+	if sig := newReader(pkt.Body).u8(); sig != ModChSigJoinOk {
+		return fmt.Errorf("joining mod channel %s failed with signal %d", ch, sig)
+	}
+
+	return nil
+}
+
+// SendModChanMsg sends a mod channel message
+func (c *Client) SendModChanMsg(ch, msg string) error {
+	w := newWriter(ToServerModChannelMsg)
+	w.str16(ch)
+	w.str16(msg)
+
+	return c.send(w)
+}
+
+func decompress(data []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
@@ -0,0 +1,191 @@
+/*
+Package mttest provides a fake Minetest server and client
+for testing multiserver over loopback UDP without Minetest binaries
+*/
+package mttest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/anon55555/mt/rudp"
+)
+
+// Command numbers used by the fake server and client
+const (
+	ToClientHello               = 0x02
+	ToClientAuthAccept          = 0x03
+	ToClientAccessDenied        = 0x0A
+	ToClientBlockdata           = 0x20
+	ToClientCSMRestrictionFlags = 0x2A
+	ToClientChatMessage         = 0x2F
+	ToClientMedia               = 0x38
+	ToClientNodeDef             = 0x3A
+	ToClientAnnounceMedia       = 0x3C
+	ToClientItemDef             = 0x3D
+	ToClientModChannelMsg       = 0x57
+	ToClientModChannelSignal    = 0x58
+	ToClientSRPBytesSaltB       = 0x60
+
+	ToServerInit            = 0x02
+	ToServerInit2           = 0x11
+	ToServerModChannelJoin  = 0x17
+	ToServerModChannelLeave = 0x18
+	ToServerModChannelMsg   = 0x19
+	ToServerChatMessage     = 0x32
+	ToServerRequestMedia    = 0x40
+	ToServerClientReady     = 0x43
+	ToServerFirstSRP        = 0x50
+	ToServerSRPBytesA       = 0x51
+	ToServerSRPBytesM       = 0x52
+)
+
+// Authentication mechanisms
+const (
+	AuthMechSRP      = 2
+	AuthMechFirstSRP = 4
+)
+
+// Mod channel signals
+const (
+	ModChSigJoinOk = iota
+	ModChSigJoinFail
+	ModChSigLeaveOk
+	ModChSigLeaveFail
+	ModChSigChNotRegistered
+	ModChSigSetState
+)
+
+// ContentAir is the content ID of air
+const ContentAir = 126
+
+// AccessDeniedWrongPassword is the reason sent for a wrong password
+const AccessDeniedWrongPassword = 0
+
+const (
+	serializeVer = 0x1C
+	protoMin     = 0x25
+	protoLatest  = 0x2A
+)
+
+// A Packet is a packet received by the fake server or client
+type Packet struct {
+	Cmd  uint16
+	Body []byte
+	rudp.PktInfo
+}
+
+func readPkt(pkt rudp.Pkt) (*Packet, error) {
+	data, err := io.ReadAll(pkt.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return &Packet{
+		Cmd:     binary.BigEndian.Uint16(data),
+		Body:    data[2:],
+		PktInfo: pkt.PktInfo,
+	}, nil
+}
+
+// A writer builds a packet
+type writer struct {
+	bytes.Buffer
+}
+
+func newWriter(cmd uint16) *writer {
+	w := &writer{}
+	w.u16(cmd)
+	return w
+}
+
+func (w *writer) u8(v uint8) { w.WriteByte(v) }
+
+func (w *writer) u16(v uint16) {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	w.Write(b)
+}
+
+func (w *writer) u32(v uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	w.Write(b)
+}
+
+func (w *writer) u64(v uint64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	w.Write(b)
+}
+
+func (w *writer) f32(v float32) { w.u32(math.Float32bits(v)) }
+
+func (w *writer) bool(v bool) {
+	if v {
+		w.u8(1)
+	} else {
+		w.u8(0)
+	}
+}
+
+func (w *writer) bytes16(v []byte) {
+	w.u16(uint16(len(v)))
+	w.Write(v)
+}
+
+func (w *writer) bytes32(v []byte) {
+	w.u32(uint32(len(v)))
+	w.Write(v)
+}
+
+func (w *writer) str16(v string) { w.bytes16([]byte(v)) }
+
+func (w *writer) pkt(info rudp.PktInfo) rudp.Pkt {
+	return rudp.Pkt{Reader: bytes.NewReader(w.Bytes()), PktInfo: info}
+}
+
+// A reader reads the fields of a packet
+// After the first error all reads return zero values
+type reader struct {
+	b   []byte
+	err error
+}
+
+func newReader(b []byte) *reader { return &reader{b: b} }
+
+func (r *reader) read(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+
+		// Numbers are read as zero, strings as empty
+		if n > 8 {
+			return nil
+		}
+		return make([]byte, n)
+	}
+
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) u8() uint8   { return r.read(1)[0] }
+func (r *reader) bool() bool  { return r.u8() != 0 }
+func (r *reader) u16() uint16 { return binary.BigEndian.Uint16(r.read(2)) }
+func (r *reader) u32() uint32 { return binary.BigEndian.Uint32(r.read(4)) }
+
+func (r *reader) bytes16() []byte { return append([]byte(nil), r.read(int(r.u16()))...) }
+func (r *reader) bytes32() []byte { return append([]byte(nil), r.read(int(r.u32()))...) }
+func (r *reader) str16() string   { return string(r.read(int(r.u16()))) }
+
+func (r *reader) len() int { return len(r.b) }
+
+var errClosed = errors.New("connection closed")
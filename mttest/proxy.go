@@ -0,0 +1,164 @@
+package mttest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Proxy is a multiserver process running in a temporary directory
+type Proxy struct {
+	// Addr is the address the Proxy is listening on
+	Addr string
+	// Dir is the working directory of the Proxy
+	Dir string
+
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	mu     sync.Mutex
+	output bytes.Buffer
+}
+
+// StartProxy builds multiserver and starts it in a temporary directory
+// with a configuration containing the Servers. Additional configuration
+// keys can be passed as YAML in config. The Proxy is stopped
+// and its log is printed if the test fails when the test finishes
+func StartProxy(t testing.TB, servers map[string]*Server, defaultSrv, config string) *Proxy {
+	t.Helper()
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "multiserver")
+
+	build := exec.Command("go", "build", "-o", bin, "github.com/HimbeerserverDE/multiserver")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building multiserver failed: %v\n%s", err, out)
+	}
+
+	addr, err := freeAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	conf := &strings.Builder{}
+	fmt.Fprintf(conf, "host: %q\n", addr)
+	fmt.Fprintf(conf, "default_server: %s\n", defaultSrv)
+	fmt.Fprintln(conf, "admin_socket: \"\"")
+	fmt.Fprintln(conf, "servers:")
+	for _, name := range names {
+		fmt.Fprintf(conf, "  %s:\n    address: %q\n", name, servers[name].Addr())
+	}
+	conf.WriteString(config)
+
+	os.Mkdir(filepath.Join(dir, "config"), 0777)
+	if err := os.WriteFile(filepath.Join(dir, "config", "multiserver.yml"), []byte(conf.String()), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Proxy{
+		Addr: addr,
+		Dir:  dir,
+		cmd:  exec.Command(bin, "-headless"),
+	}
+
+	p.cmd.Dir = dir
+	if p.stdin, err = p.cmd.StdinPipe(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := p.cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cmd.Stderr = p.cmd.Stdout
+
+	if err := p.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+
+		if t.Failed() {
+			t.Log("multiserver log:\n" + p.Output())
+		}
+	})
+
+	listening := make(chan struct{})
+	go func() {
+		s := bufio.NewScanner(out)
+		for s.Scan() {
+			p.mu.Lock()
+			p.output.WriteString(s.Text() + "\n")
+			p.mu.Unlock()
+
+			if strings.Contains(s.Text(), "Listening on") {
+				close(listening)
+			}
+		}
+	}()
+
+	select {
+	case <-listening:
+	case <-time.After(30 * time.Second):
+		t.Fatal("multiserver didn't start listening")
+	}
+
+	return p
+}
+
+// Exec runs a console command
+func (p *Proxy) Exec(cmd string) error {
+	_, err := fmt.Fprintln(p.stdin, cmd)
+	return err
+}
+
+// Output returns everything the Proxy has logged so far
+func (p *Proxy) Output() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.output.String()
+}
+
+// WaitOutput waits until the Proxy has logged a line containing s
+func (p *Proxy) WaitOutput(s string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if strings.Contains(p.Output(), s) {
+			return nil
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return fmt.Errorf("multiserver didn't log %q", s)
+}
+
+// freeAddr returns a loopback address with a free UDP port
+func freeAddr() (string, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer pc.Close()
+
+	return pc.LocalAddr().String(), nil
+}
@@ -0,0 +1,245 @@
+package mttest
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, nodes, items []string, media map[string][]byte) *Server {
+	t.Helper()
+
+	s := NewServer()
+	s.Nodes = nodes
+	s.Items = items
+	for name, data := range media {
+		s.Media[name] = data
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func login(t *testing.T, p *Proxy, name, password string) *Client {
+	t.Helper()
+
+	c, err := Dial(p.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	if err := c.Login(name, password); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// rpcPeer returns the connection the proxy uses for RPC with a Server
+// This is a player's connection if one is connected to the Server
+func rpcPeer(t *testing.T, s *Server) *Peer {
+	t.Helper()
+
+	for deadline := time.Now().Add(Timeout); time.Now().Before(deadline); {
+		for _, name := range s.Peers() {
+			p := s.Peer(name)
+			if p == nil || !p.InModChan("multiserver") {
+				continue
+			}
+
+			select {
+			case <-p.Closed():
+			default:
+				return p
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("the proxy didn't join the RPC mod channel")
+	return nil
+}
+
+// rpc sends an RPC request to the proxy and returns the answer
+// The request is repeated in case the proxy has switched connections
+func rpc(t *testing.T, s *Server, rq string) string {
+	t.Helper()
+
+	for id := 1; id <= 10; id++ {
+		prefix := strconv.Itoa(id) + " "
+		if err := rpcPeer(t, s).SendModChanMsg("multiserver", "", prefix+rq); err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.After(time.Second)
+	Wait:
+		for {
+			select {
+			case msg := <-s.ModChanMsgs():
+				if strings.HasPrefix(msg.Msg, prefix) {
+					return strings.TrimPrefix(msg.Msg, prefix)
+				}
+			case <-deadline:
+				break Wait
+			}
+		}
+	}
+
+	t.Fatal("no answer to " + rq)
+	return ""
+}
+
+func TestLogin(t *testing.T) {
+	lobby := startServer(t, []string{"default:stone"}, []string{"default:stone"}, nil)
+	p := StartProxy(t, map[string]*Server{"lobby": lobby}, "lobby", "")
+
+	c := login(t, p, "alice", "secret")
+	if _, err := lobby.WaitJoin("alice", Timeout); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// Known players use SRP instead of registering
+	login(t, p, "bob", "secret").Close()
+
+	c, err := Dial(p.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var denied *AccessDeniedError
+	if err := c.Login("bob", "wrong"); !errors.As(err, &denied) || denied.Reason != AccessDeniedWrongPassword {
+		t.Fatalf("login with a wrong password: got %v, want wrong password", err)
+	}
+}
+
+func TestMediaMultiplexing(t *testing.T) {
+	lobby := startServer(t,
+		[]string{"default:stone", "lobby:portal"},
+		[]string{"default:stone", "lobby:portal"},
+		map[string][]byte{"lobby.png": []byte("lobby texture")})
+
+	game := startServer(t,
+		[]string{"default:stone", "game:chest"},
+		[]string{"default:stone", "game:chest"},
+		map[string][]byte{"game.png": []byte("game texture")})
+
+	p := StartProxy(t, map[string]*Server{"lobby": lobby, "game": game}, "lobby", "")
+	c := login(t, p, "alice", "secret")
+
+	for _, want := range []string{"default:stone", "lobby:portal", "game:chest"} {
+		if !contains(c.Nodes, want) {
+			t.Errorf("node %s is missing, got %v", want, c.Nodes)
+		}
+
+		if !contains(c.Items, want) {
+			t.Errorf("item %s is missing, got %v", want, c.Items)
+		}
+	}
+
+	if n := count(c.Nodes, "default:stone"); n != 1 {
+		t.Errorf("default:stone is defined %d times", n)
+	}
+
+	want := map[string][]byte{
+		"lobby.png": []byte("lobby texture"),
+		"game.png":  []byte("game texture"),
+	}
+
+	if !reflect.DeepEqual(c.Media, want) {
+		t.Errorf("got media %v, want %v", names(c.Media), names(want))
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	lobby := startServer(t, nil, nil, nil)
+	game := startServer(t, nil, nil, nil)
+
+	p := StartProxy(t, map[string]*Server{"lobby": lobby, "game": game}, "lobby", "")
+	login(t, p, "alice", "secret")
+
+	if _, err := lobby.WaitJoin("alice", Timeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// The proxy may move RPC to the connection of the player
+	// at any time, so the request is repeated until it arrives
+	for deadline := time.Now().Add(Timeout); ; {
+		if err := rpcPeer(t, lobby).SendModChanMsg("multiserver", "", "-- <-REDIRECT alice game"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := game.WaitJoin("alice", time.Second); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+
+	// The player joins the new server before the client is switched over
+	if err := p.WaitOutput("redirected to game", Timeout); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := rpc(t, game, "<-GETSRV alice"); got != "->SRV game" {
+		t.Errorf("got %q, want the player on game", got)
+	}
+}
+
+func TestRPC(t *testing.T) {
+	lobby := startServer(t, nil, nil, nil)
+	p := StartProxy(t, map[string]*Server{"lobby": lobby}, "lobby", "")
+
+	if got := rpc(t, lobby, "<-ISONLINE alice"); got != "->ISONLINE false" {
+		t.Errorf("got %q before the login", got)
+	}
+
+	login(t, p, "alice", "secret")
+
+	// The proxy marks the player online after the server has seen it join
+	if err := p.WaitOutput("alice joined", Timeout); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := rpc(t, lobby, "<-ISONLINE alice"); got != "->ISONLINE true" {
+		t.Errorf("got %q after the login", got)
+	}
+
+	if got := rpc(t, lobby, "<-GETDEFSRV"); got != "->DEFSRV lobby" {
+		t.Errorf("got %q, want the default server", got)
+	}
+}
+
+func contains(s []string, v string) bool { return count(s, v) > 0 }
+
+func count(s []string, v string) int {
+	var n int
+	for _, e := range s {
+		if e == v {
+			n++
+		}
+	}
+
+	return n
+}
+
+func names(m map[string][]byte) []string {
+	var r []string
+	for name := range m {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+
+	return r
+}
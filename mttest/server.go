@@ -0,0 +1,536 @@
+package mttest
+
+import (
+	"compress/zlib"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/HimbeerserverDE/srp"
+	"github.com/anon55555/mt/rudp"
+)
+
+// A ModChanMsg is a mod channel message received by a Server
+type ModChanMsg struct {
+	Peer    *Peer
+	Channel string
+	Msg     string
+}
+
+// A Server is a fake Minetest server
+// It authenticates players using SRP, sends its definitions and media
+// and answers mod channel joins. Everything else is ignored
+// unless a handler is registered in Script
+type Server struct {
+	// ProtoVer is the highest protocol version the Server supports
+	ProtoVer uint16
+
+	// Nodes and Items are the names of the registered nodes and items
+	Nodes []string
+	Items []string
+
+	// Media maps the names of the media files to their contents
+	Media map[string][]byte
+
+	// Script contains handlers that replace the builtin handling
+	// of a command. They must be set before the Server is started
+	Script map[uint16]func(p *Peer, pkt *Packet)
+
+	l *rudp.Listener
+
+	mu        sync.Mutex
+	auth      map[string]*srpAuth
+	conns     map[*Peer]bool
+	peers     map[string]*Peer
+	modChMsgs chan ModChanMsg
+}
+
+type srpAuth struct {
+	salt, verifier []byte
+}
+
+// A Peer is a connection to a Server
+type Peer struct {
+	*rudp.Conn
+	srv *Server
+
+	// Name and ProtoVer are set after the Init command
+	Name     string
+	ProtoVer uint16
+
+	authMech         int
+	srpS, srpA, srpB []byte
+	srpK             []byte
+
+	modChMu sync.Mutex
+	modChs  map[string]bool
+}
+
+// NewServer returns a Server that supports the latest protocol version
+func NewServer() *Server {
+	return &Server{
+		ProtoVer:  protoLatest,
+		Media:     make(map[string][]byte),
+		Script:    make(map[uint16]func(p *Peer, pkt *Packet)),
+		auth:      make(map[string]*srpAuth),
+		conns:     make(map[*Peer]bool),
+		peers:     make(map[string]*Peer),
+		modChMsgs: make(chan ModChanMsg, 256),
+	}
+}
+
+// Start makes the Server listen on a random loopback port
+func (s *Server) Start() error {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	s.l = rudp.Listen(pc)
+
+	go func() {
+		for {
+			conn, err := s.l.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+
+				continue
+			}
+
+			p := &Peer{
+				Conn:   conn,
+				srv:    s,
+				modChs: make(map[string]bool),
+			}
+
+			s.mu.Lock()
+			s.conns[p] = true
+			s.mu.Unlock()
+
+			go p.handle()
+		}
+	}()
+
+	return nil
+}
+
+// Addr returns the address the Server is listening on
+func (s *Server) Addr() string { return s.l.Addr().String() }
+
+// Close stops the Server and disconnects all Peers
+// without telling them, like a crashing server
+func (s *Server) Close() error {
+	err := s.l.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for p := range s.conns {
+		p.Close()
+	}
+
+	return err
+}
+
+// Peer returns the Peer of a player that has joined the Server
+func (s *Server) Peer(name string) *Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.peers[name]
+}
+
+// Peers returns the names of the players that have joined the Server
+func (s *Server) Peers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name := range s.peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// WaitJoin waits until a player has joined the Server
+func (s *Server) WaitJoin(name string, timeout time.Duration) (*Peer, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if p := s.Peer(name); p != nil {
+			return p, nil
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil, errors.New(name + " didn't join " + s.Addr())
+}
+
+// ModChanMsgs returns a channel that receives the mod channel messages
+// sent to the Server. Messages are dropped if nobody reads them
+func (s *Server) ModChanMsgs() <-chan ModChanMsg { return s.modChMsgs }
+
+// Send sends a packet to the Peer
+func (p *Peer) Send(cmd uint16, body []byte, info rudp.PktInfo) error {
+	w := newWriter(cmd)
+	w.Write(body)
+
+	_, err := p.Conn.Send(w.pkt(info))
+	return err
+}
+
+// SendModChanMsg sends a mod channel message to the Peer
+func (p *Peer) SendModChanMsg(ch, sender, msg string) error {
+	w := newWriter(ToClientModChannelMsg)
+	w.str16(ch)
+	w.str16(sender)
+	w.str16(msg)
+
+	_, err := p.Conn.Send(w.pkt(rudp.PktInfo{}))
+	return err
+}
+
+// Kick disconnects the Peer with an AccessDenied command
+func (p *Peer) Kick(reason uint8, custom string, reconnect bool) error {
+	w := newWriter(ToClientAccessDenied)
+	w.u8(reason)
+	w.str16(custom)
+	w.bool(reconnect)
+
+	ack, err := p.Conn.Send(w.pkt(rudp.PktInfo{}))
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ack:
+	case <-time.After(time.Second):
+	}
+
+	return p.Close()
+}
+
+// InModChan reports whether the Peer has joined a mod channel
+func (p *Peer) InModChan(ch string) bool {
+	p.modChMu.Lock()
+	defer p.modChMu.Unlock()
+
+	return p.modChs[ch]
+}
+
+func (p *Peer) send(w *writer) {
+	if _, err := p.Conn.Send(w.pkt(rudp.PktInfo{})); err != nil {
+		log.Print(err)
+	}
+}
+
+func (p *Peer) handle() {
+	s := p.srv
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.conns, p)
+		if s.peers[p.Name] == p {
+			delete(s.peers, p.Name)
+		}
+	}()
+
+	for {
+		pkt, err := p.Recv()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			continue
+		}
+
+		cmd, err := readPkt(pkt)
+		if err != nil {
+			continue
+		}
+
+		if handler, ok := s.Script[cmd.Cmd]; ok {
+			handler(p, cmd)
+			continue
+		}
+
+		r := newReader(cmd.Body)
+
+		switch cmd.Cmd {
+		case ToServerInit:
+			r.u8()
+			r.u16()
+			min := r.u16()
+			max := r.u16()
+			p.Name = r.str16()
+
+			if max < protoMin || min > s.ProtoVer {
+				p.Kick(3, "", false)
+				return
+			}
+
+			p.ProtoVer = s.ProtoVer
+			if max < p.ProtoVer {
+				p.ProtoVer = max
+			}
+
+			s.mu.Lock()
+			_, known := s.auth[p.Name]
+			s.mu.Unlock()
+
+			p.authMech = AuthMechFirstSRP
+			if known {
+				p.authMech = AuthMechSRP
+			}
+
+			w := newWriter(ToClientHello)
+			w.u8(serializeVer)
+			w.u16(0)
+			w.u16(p.ProtoVer)
+			w.u32(uint32(p.authMech))
+			w.str16(p.Name)
+			p.send(w)
+		case ToServerFirstSRP:
+			if p.authMech != AuthMechFirstSRP {
+				p.Kick(1, "", false)
+				return
+			}
+
+			auth := &srpAuth{salt: r.bytes16(), verifier: r.bytes16()}
+
+			s.mu.Lock()
+			s.auth[p.Name] = auth
+			s.mu.Unlock()
+
+			p.authAccept()
+		case ToServerSRPBytesA:
+			if p.authMech != AuthMechSRP {
+				p.Kick(1, "", false)
+				return
+			}
+
+			s.mu.Lock()
+			auth := s.auth[p.Name]
+			s.mu.Unlock()
+
+			A := r.bytes16()
+			B, _, K, err := srp.Handshake(A, auth.verifier)
+			if err != nil {
+				p.Kick(1, "", false)
+				return
+			}
+
+			p.srpS, p.srpA, p.srpB, p.srpK = auth.salt, A, B, K
+
+			w := newWriter(ToClientSRPBytesSaltB)
+			w.bytes16(auth.salt)
+			w.bytes16(B)
+			p.send(w)
+		case ToServerSRPBytesM:
+			M := srp.ClientProof([]byte(p.Name), p.srpS, p.srpA, p.srpB, p.srpK)
+			if subtle.ConstantTimeCompare(r.bytes16(), M) != 1 {
+				p.Kick(AccessDeniedWrongPassword, "", false)
+				return
+			}
+
+			p.authAccept()
+		case ToServerInit2:
+			p.sendDefs()
+		case ToServerRequestMedia:
+			var names []string
+			for i := r.u16(); i > 0; i-- {
+				names = append(names, r.str16())
+			}
+
+			p.sendMedia(names)
+		case ToServerClientReady:
+			s.mu.Lock()
+			s.peers[p.Name] = p
+			s.mu.Unlock()
+
+			p.sendSpawnBlock()
+		case ToServerModChannelJoin, ToServerModChannelLeave:
+			join := cmd.Cmd == ToServerModChannelJoin
+			ch := r.str16()
+
+			p.modChMu.Lock()
+			if join {
+				p.modChs[ch] = true
+			} else {
+				delete(p.modChs, ch)
+			}
+			p.modChMu.Unlock()
+
+			w := newWriter(ToClientModChannelSignal)
+			if join {
+				w.u8(ModChSigJoinOk)
+			} else {
+				w.u8(ModChSigLeaveOk)
+			}
+			w.str16(ch)
+			p.send(w)
+		case ToServerModChannelMsg:
+			msg := ModChanMsg{Peer: p, Channel: r.str16(), Msg: r.str16()}
+
+			select {
+			case s.modChMsgs <- msg:
+			default:
+			}
+		}
+	}
+}
+
+func (p *Peer) authAccept() {
+	w := newWriter(ToClientAuthAccept)
+	for i := 0; i < 3; i++ {
+		w.f32(0)
+	}
+	w.u64(0)
+	w.f32(0.09)
+	w.u32(AuthMechSRP)
+	p.send(w)
+}
+
+// sendSpawnBlock sends the MapBlock containing the spawn,
+// the proxy waits for the first MapBlock when redirecting
+func (p *Peer) sendSpawnBlock() {
+	nodes := make([]byte, 4*16*16*16)
+	for i := 0; i < 16*16*16; i++ {
+		binary.BigEndian.PutUint16(nodes[2*i:], ContentAir)
+	}
+
+	w := newWriter(ToClientBlockdata)
+	for i := 0; i < 3; i++ {
+		w.u16(0)
+	}
+	w.u8(0)
+	w.u16(0xFFFF)
+	w.u8(2)
+	w.u8(2)
+	w.Write(compress(nodes))
+	w.Write(compress([]byte{0}))
+	p.send(w)
+}
+
+// sendDefs sends the definitions and the media announcement
+// in the order of Minetest
+func (p *Peer) sendDefs() {
+	s := p.srv
+
+	items := &writer{}
+	items.u8(0)
+	items.u16(uint16(len(s.Items)))
+	for _, name := range s.Items {
+		def := &writer{}
+		def.u8(6)
+		def.u8(1)
+		def.str16(name)
+		def.str16("")
+		def.str16("")
+		def.str16("")
+		for i := 0; i < 3; i++ {
+			def.f32(1)
+		}
+		def.u16(99)
+		def.bool(false)
+		def.bool(false)
+		def.bytes16(nil)
+
+		items.bytes16(def.Bytes())
+	}
+	items.u16(0)
+
+	w := newWriter(ToClientItemDef)
+	w.bytes32(compress(items.Bytes()))
+	p.send(w)
+
+	defs := &writer{}
+	for i, name := range s.Nodes {
+		def := &writer{}
+		def.u8(13)
+		def.str16(name)
+
+		defs.u16(uint16(i))
+		defs.bytes16(def.Bytes())
+	}
+
+	nodes := &writer{}
+	nodes.u8(1)
+	nodes.u16(uint16(len(s.Nodes)))
+	nodes.bytes32(defs.Bytes())
+
+	w = newWriter(ToClientNodeDef)
+	w.bytes32(compress(nodes.Bytes()))
+	p.send(w)
+
+	var names []string
+	for name := range s.Media {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w = newWriter(ToClientAnnounceMedia)
+	w.u16(uint16(len(names)))
+	for _, name := range names {
+		digest := sha1.Sum(s.Media[name])
+
+		w.str16(name)
+		w.str16(base64.StdEncoding.EncodeToString(digest[:]))
+	}
+	w.str16("")
+	p.send(w)
+
+	w = newWriter(ToClientCSMRestrictionFlags)
+	w.u32(0)
+	w.u32(0)
+	w.u32(8)
+	p.send(w)
+}
+
+// sendMedia sends the requested files in a single bunch
+func (p *Peer) sendMedia(names []string) {
+	w := newWriter(ToClientMedia)
+	w.u16(1)
+	w.u16(0)
+
+	var found []string
+	for _, name := range names {
+		if _, ok := p.srv.Media[name]; ok {
+			found = append(found, name)
+		}
+	}
+
+	w.u32(uint32(len(found)))
+	for _, name := range found {
+		w.str16(name)
+		w.bytes32(p.srv.Media[name])
+	}
+
+	if _, err := p.Conn.Send(w.pkt(rudp.PktInfo{Channel: 2})); err != nil {
+		log.Print(err)
+	}
+}
+
+func compress(data []byte) []byte {
+	w := &writer{}
+
+	zw := zlib.NewWriter(w)
+	zw.Write(data)
+	zw.Close()
+
+	return w.Bytes()
+}
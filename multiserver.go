@@ -20,12 +20,25 @@ func main() {
 		log.Fatal("Default server address not set or not a string")
 	}
 
+	if ConfKey("servers:"+MaintenanceAll) != nil {
+		log.Fatal("The server name " + MaintenanceAll + " is reserved for network-wide maintenance")
+	}
+
 	host, ok := ConfKey("host").(string)
 	if !ok {
 		host = "0.0.0.0:33000"
 	}
 
-	lc, err := net.ListenPacket("udp", host)
+	var lc net.PacketConn
+	var err error
+	if takeover {
+		lc, err = takeOver()
+		if err == nil {
+			logger.openFile()
+		}
+	} else {
+		lc, err = net.ListenPacket("udp", host)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -33,6 +46,11 @@ func main() {
 
 	log.Print("Listening on " + host)
 
+	ListenHandoff(lc)
+	ListenAdmin()
+	ListenMetrics()
+	ListenAPI()
+
 	l := Listen(lc)
 
 	Announce(AnnounceStart)
@@ -44,7 +62,7 @@ func main() {
 			continue
 		}
 
-		log.Print(clt.Addr(), " connected")
+		LogInfo(clt.LogFields(), clt.Addr(), " connected")
 
 		fin := make(chan *Conn)
 		go Init(nil, clt, true, false, fin)
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"unicode/utf16"
+
+	"github.com/anon55555/mt/rudp"
+)
+
+// A Cmd is the decoded body of a packet sent to a client or a server
+// Marshal and Unmarshal use the layout of a protocol version
+type Cmd interface {
+	CmdNo() uint16
+	Marshal(w *bytes.Buffer, proto uint16)
+	Unmarshal(r *CmdReader, proto uint16)
+}
+
+// cmdTable maps the command numbers of the Cmds to their constructors
+// The tables are package variables rather than being filled by init functions
+// so that subcommands, which run before them, can decode packets
+func cmdTable(newCmds ...func() Cmd) map[uint16]func() Cmd {
+	m := make(map[uint16]func() Cmd)
+	for _, newCmd := range newCmds {
+		m[newCmd().CmdNo()] = newCmd
+	}
+
+	return m
+}
+
+// EncodeCmd returns a packet containing a Cmd
+// encoded for a protocol version
+func EncodeCmd(cmd Cmd, proto uint16) []byte {
+	w := &bytes.Buffer{}
+	WriteUint16(w, cmd.CmdNo())
+	cmd.Marshal(w, proto)
+
+	return w.Bytes()
+}
+
+// DecodeCmd decodes a packet sent to a client if toClt is true
+// and to a server otherwise. It returns nil and no error
+// if the command has no type
+func DecodeCmd(data []byte, toClt bool, proto uint16) (Cmd, error) {
+	if len(data) < 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	cmds := toSrvCmds
+	if toClt {
+		cmds = toCltCmds
+	}
+
+	newCmd, ok := cmds[binary.BigEndian.Uint16(data)]
+	if !ok {
+		return nil, nil
+	}
+
+	cmd := newCmd()
+
+	r := NewCmdReader(bytes.NewReader(data[2:]))
+	cmd.Unmarshal(r, proto)
+	if r.Err() != nil {
+		return nil, decodeErr(cmd, r.Err())
+	}
+
+	return cmd, nil
+}
+
+// SendCmd encodes a Cmd for the protocol version of the Conn
+// and sends it on channel 0
+func (c *Conn) SendCmd(cmd Cmd) (<-chan struct{}, error) {
+	return c.SendCmdInfo(cmd, rudp.PktInfo{})
+}
+
+// SendCmdInfo is like SendCmd but uses the channel
+// and reliability specified by info
+func (c *Conn) SendCmdInfo(cmd Cmd, info rudp.PktInfo) (<-chan struct{}, error) {
+	return c.Send(rudp.Pkt{
+		Reader:  bytes.NewReader(EncodeCmd(cmd, c.ProtoVer())),
+		PktInfo: info,
+	})
+}
+
+// A CmdReader reads the fields of a Cmd
+// After the first error all reads return zero values
+type CmdReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+// NewCmdReader returns a CmdReader reading from r
+func NewCmdReader(r *bytes.Reader) *CmdReader {
+	return &CmdReader{r: r}
+}
+
+// Err returns the first error that occurred while reading
+func (cr *CmdReader) Err() error { return cr.err }
+
+// Len returns the number of unread bytes
+func (cr *CmdReader) Len() int { return cr.r.Len() }
+
+// read reads n bytes, which are zero after an error
+func (cr *CmdReader) read(n int) []byte {
+	b := make([]byte, n)
+	if cr.err != nil {
+		return b
+	}
+
+	if n > cr.r.Len() {
+		cr.err = io.ErrUnexpectedEOF
+		return b
+	}
+
+	cr.r.Read(b)
+	return b
+}
+
+// readLen reads n bytes of a length-prefixed field
+// without allocating them if they aren't there
+func (cr *CmdReader) readLen(n int) []byte {
+	if cr.err == nil && n > cr.r.Len() {
+		cr.err = io.ErrUnexpectedEOF
+	}
+
+	if cr.err != nil {
+		return nil
+	}
+
+	return cr.read(n)
+}
+
+// Uint8 reads a uint8
+func (cr *CmdReader) Uint8() uint8 { return cr.read(1)[0] }
+
+// Bool reads a bool encoded as a uint8
+func (cr *CmdReader) Bool() bool { return cr.Uint8() != 0 }
+
+// Uint16 reads a big endian uint16
+func (cr *CmdReader) Uint16() uint16 { return binary.BigEndian.Uint16(cr.read(2)) }
+
+// Uint32 reads a big endian uint32
+func (cr *CmdReader) Uint32() uint32 { return binary.BigEndian.Uint32(cr.read(4)) }
+
+// Uint64 reads a big endian uint64
+func (cr *CmdReader) Uint64() uint64 { return binary.BigEndian.Uint64(cr.read(8)) }
+
+// Float32 reads a big endian float32
+func (cr *CmdReader) Float32() float32 { return math.Float32frombits(cr.Uint32()) }
+
+// Vec2 reads 2 float32s
+func (cr *CmdReader) Vec2() [2]float32 {
+	return [2]float32{cr.Float32(), cr.Float32()}
+}
+
+// Vec3 reads 3 float32s
+func (cr *CmdReader) Vec3() [3]float32 {
+	return [3]float32{cr.Float32(), cr.Float32(), cr.Float32()}
+}
+
+// Bytes16 reads a byte slice prefixed with its uint16 length
+func (cr *CmdReader) Bytes16() []byte { return cr.readLen(int(cr.Uint16())) }
+
+// Bytes32 reads a byte slice prefixed with its uint32 length
+func (cr *CmdReader) Bytes32() []byte { return cr.readLen(int(cr.Uint32())) }
+
+// Rest reads all remaining bytes
+func (cr *CmdReader) Rest() []byte { return cr.readLen(cr.r.Len()) }
+
+// Pos reads the position of a MapBlock or node
+func (cr *CmdReader) Pos() [3]int16 {
+	return [3]int16{int16(cr.Uint16()), int16(cr.Uint16()), int16(cr.Uint16())}
+}
+
+// Color reads an ARGB color
+func (cr *CmdReader) Color() Color {
+	var c Color
+	copy(c[:], cr.read(4))
+	return c
+}
+
+// WStr16 reads a UTF-16 string prefixed with its uint16 length
+// in code units
+func (cr *CmdReader) WStr16() string {
+	b := cr.readLen(2 * int(cr.Uint16()))
+
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+
+	return string(utf16.Decode(units))
+}
+
+// Zlib reads a zlib stream and returns the decompressed data
+func (cr *CmdReader) Zlib() []byte {
+	if cr.err != nil {
+		return nil
+	}
+
+	// bytes.Reader is an io.ByteReader, so nothing after
+	// the end of the stream is read
+	zr, err := zlib.NewReader(cr.r)
+	if err != nil {
+		cr.err = err
+		return nil
+	}
+	defer zr.Close()
+
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		cr.err = err
+		return nil
+	}
+
+	return data
+}
+
+// fail makes the following reads return zero values
+// and Err return err unless an error has already occurred
+func (cr *CmdReader) fail(err error) {
+	if cr.err == nil {
+		cr.err = err
+	}
+}
+
+// A Color is an ARGB color
+type Color [4]uint8
+
+func writeBool(w *bytes.Buffer, v bool) {
+	if v {
+		WriteUint8(w, 1)
+	} else {
+		WriteUint8(w, 0)
+	}
+}
+
+func writeVec(w *bytes.Buffer, v ...float32) {
+	for _, f := range v {
+		WriteFloat32(w, f)
+	}
+}
+
+func writePos(w *bytes.Buffer, pos [3]int16) {
+	for _, v := range pos {
+		WriteUint16(w, uint16(v))
+	}
+}
+
+func writeWStr16(w *bytes.Buffer, s string) {
+	units := utf16.Encode([]rune(s))
+
+	WriteUint16(w, uint16(len(units)))
+	for _, u := range units {
+		WriteUint16(w, u)
+	}
+}
+
+func writeZlib(w *bytes.Buffer, data []byte) {
+	zw := zlib.NewWriter(w)
+	zw.Write(data)
+	zw.Close()
+}
+
+// decode unmarshals the rest of a packet into a Cmd
+// and logs the error if it is malformed
+func decode(cmd Cmd, r *bytes.Reader, proto uint16) bool {
+	cr := NewCmdReader(r)
+	cmd.Unmarshal(cr, proto)
+	if cr.Err() != nil {
+		log.Print(decodeErr(cmd, cr.Err()))
+		return false
+	}
+
+	return true
+}
+
+func decodeErr(cmd Cmd, err error) error {
+	return fmt.Errorf("decoding command 0x%02X: %w", cmd.CmdNo(), err)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/anon55555/mt/rudp"
+)
+
+const captureMagic = "MSCAP\x01"
+
+// Capture legs
+const (
+	// CaptureClientLeg is the connection between the client and the proxy
+	CaptureClientLeg uint8 = iota
+	// CaptureServerLeg is the connection between the proxy and the backend
+	CaptureServerLeg
+)
+
+// Capture directions
+const (
+	CaptureToServer uint8 = iota
+	CaptureToClient
+)
+
+// A CaptureRecord is a packet stored in a capture file
+type CaptureRecord struct {
+	Time      time.Time
+	Leg       uint8
+	Direction uint8
+	Channel   uint8
+	Unrel     bool
+	ProtoVer  uint16
+	Server    string
+	Data      []byte
+}
+
+type capture struct {
+	mu   sync.Mutex
+	f    *os.File
+	path string
+}
+
+var captures = make(map[*Conn]*capture)
+var capturesMu sync.RWMutex
+
+// StartCapture starts recording all packets that are proxied
+// for a client Conn and returns the path of the capture file
+func StartCapture(c *Conn) (string, error) {
+	capturesMu.Lock()
+	defer capturesMu.Unlock()
+
+	if cp, ok := captures[c]; ok {
+		return cp.path, nil
+	}
+
+	dir, ok := ConfKey("capture_dir").(string)
+	if !ok {
+		dir = "captures"
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, c.Username()+"-"+time.Now().Format("20060102-150405")+".mscap")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return "", err
+	}
+
+	w := &bytes.Buffer{}
+	w.WriteString(captureMagic)
+	WriteBytes16(w, []byte(c.Username()))
+
+	if _, err := f.Write(w.Bytes()); err != nil {
+		f.Close()
+		return "", err
+	}
+
+	captures[c] = &capture{f: f, path: path}
+	return path, nil
+}
+
+// StopCapture stops recording the packets of a client Conn
+func StopCapture(c *Conn) error {
+	capturesMu.Lock()
+	defer capturesMu.Unlock()
+
+	cp, ok := captures[c]
+	if !ok {
+		return nil
+	}
+
+	delete(captures, c)
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	err := cp.f.Close()
+	cp.f = nil
+
+	return err
+}
+
+// Capturing reports whether the packets of a client Conn are recorded
+func Capturing(c *Conn) bool {
+	capturesMu.RLock()
+	defer capturesMu.RUnlock()
+
+	_, ok := captures[c]
+	return ok
+}
+
+// capturePkt records a packet that has been received from
+// or is about to be sent to c if its player is being captured
+func capturePkt(c, clt *Conn, toClt bool, pkt *rudp.Pkt) {
+	capturesMu.RLock()
+	cp, ok := captures[clt]
+	capturesMu.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	data, err := io.ReadAll(pkt.Reader)
+	pkt.Reader = bytes.NewReader(data)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	rec := &CaptureRecord{
+		Time:     time.Now(),
+		Channel:  uint8(pkt.Channel),
+		Unrel:    pkt.Unrel,
+		ProtoVer: c.ProtoVer(),
+		Server:   clt.ServerName(),
+		Data:     data,
+	}
+
+	if c.IsSrv() {
+		rec.Leg = CaptureServerLeg
+	}
+
+	if toClt {
+		rec.Direction = CaptureToClient
+	}
+
+	w := &bytes.Buffer{}
+	rec.write(w)
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	// The capture may have been stopped in the meantime
+	if cp.f == nil {
+		return
+	}
+
+	if _, err := cp.f.Write(w.Bytes()); err != nil {
+		log.Print(err)
+	}
+}
+
+func (rec *CaptureRecord) write(w *bytes.Buffer) {
+	WriteUint64(w, uint64(rec.Time.UnixNano()))
+	w.Write([]byte{rec.Leg, rec.Direction, rec.Channel})
+	writeBool(w, rec.Unrel)
+	WriteUint16(w, rec.ProtoVer)
+	WriteBytes16(w, []byte(rec.Server))
+	WriteBytes32(w, rec.Data)
+}
+
+// ReadCapture reads a capture file and returns the name
+// of the captured player and the records
+func ReadCapture(path string) (string, []*CaptureRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(captureMagic)) {
+		return "", nil, errors.New(path + " is not a capture file")
+	}
+
+	r := NewCmdReader(bytes.NewReader(data[len(captureMagic):]))
+	name := string(r.Bytes16())
+
+	var recs []*CaptureRecord
+	for r.Err() == nil && r.Len() > 0 {
+		rec := &CaptureRecord{
+			Time:      time.Unix(0, int64(r.Uint64())),
+			Leg:       r.Uint8(),
+			Direction: r.Uint8(),
+			Channel:   r.Uint8(),
+			Unrel:     r.Bool(),
+			ProtoVer:  r.Uint16(),
+			Server:    string(r.Bytes16()),
+			Data:      r.Bytes32(),
+		}
+
+		if r.Err() != nil {
+			// The proxy may have been stopped while writing
+			return name, recs, fmt.Errorf("%s is truncated: %w", path, r.Err())
+		}
+
+		recs = append(recs, rec)
+	}
+
+	return name, recs, r.Err()
+}
+
+func init() {
+	RegisterOnLeavePlayer(func(c *Conn) {
+		if err := StopCapture(c); err != nil {
+			log.Print(err)
+		}
+	})
+
+	disable, ok := ConfKey("disable_builtin").(bool)
+	if ok && disable {
+		return
+	}
+
+	RegisterCommand(&ChatCommand{
+		Name: "capture",
+		Help: `Starts or stops recording all packets of a player to a capture file.
+		Prints whether the player is being captured if executed without on or off`,
+		Params: []ChatCommandParam{
+			{Name: "playername", Type: ParamPlayer},
+			{Name: "on | off", Optional: true},
+		},
+		Privs:   privs("capture"),
+		Console: true,
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			clt := args.Conn("playername")
+
+			switch args.String("on | off") {
+			case "":
+				if Capturing(clt) {
+					SendChatMsg(c, clt.Username()+" is being captured.")
+				} else {
+					SendChatMsg(c, clt.Username()+" is not being captured.")
+				}
+			case "on":
+				path, err := StartCapture(clt)
+				if err != nil {
+					log.Print(err)
+					SendChatMsg(c, "An internal error occured while attempting to start the capture")
+					return
+				}
+
+				SendChatMsg(c, "Capturing "+clt.Username()+" to "+path)
+			case "off":
+				if err := StopCapture(clt); err != nil {
+					log.Print(err)
+				}
+
+				SendChatMsg(c, "Stopped capturing "+clt.Username())
+			default:
+				SendChatMsg(c, (&UsageError{Cmd: chatCommands["capture"], Msg: "Expected on or off"}).Error())
+			}
+		},
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+
+	"github.com/anon55555/mt/rudp"
+)
+
+// A Packet is a packet passed to packet handlers
+// Cmd is the decoded command if the command has a type,
+// otherwise Data contains the body without the command number
+// Handlers may modify Cmd, Data or PktInfo, the packet is only
+// encoded again if they do
+type Packet struct {
+	CmdNo uint16
+	Cmd   Cmd
+	Data  []byte
+	rudp.PktInfo
+}
+
+// A PacketHandler is called with the Conn the packet comes from
+// and the Conn it is going to be sent to
+// Returning true drops the packet. Handlers can inject packets
+// by sending them to either Conn using SendCmd
+type PacketHandler func(src, dst *Conn, pkt *Packet) bool
+
+var onClientPacket = make(map[uint16][]PacketHandler)
+var onServerPacket = make(map[uint16][]PacketHandler)
+
+// RegisterOnClientPacket registers a handler that is called
+// when a client sends a packet with the command number cmd
+func RegisterOnClientPacket(cmd uint16, handler PacketHandler) {
+	onClientPacket[cmd] = append(onClientPacket[cmd], handler)
+}
+
+// RegisterOnServerPacket registers a handler that is called
+// when a server sends a packet with the command number cmd
+func RegisterOnServerPacket(cmd uint16, handler PacketHandler) {
+	onServerPacket[cmd] = append(onServerPacket[cmd], handler)
+}
+
+func processPktHooks(src, dst *Conn, pkt *rudp.Pkt) bool {
+	hooks := onClientPacket
+	if src.IsSrv() {
+		hooks = onServerPacket
+	}
+
+	if len(hooks) == 0 {
+		return false
+	}
+
+	data, err := io.ReadAll(pkt.Reader)
+	if err != nil || len(data) < 2 {
+		pkt.Reader = bytes.NewReader(data)
+		return false
+	}
+
+	handlers := hooks[binary.BigEndian.Uint16(data)]
+	if len(handlers) == 0 {
+		pkt.Reader = bytes.NewReader(data)
+		return false
+	}
+
+	cmdNo := binary.BigEndian.Uint16(data)
+	p := &Packet{
+		CmdNo:   cmdNo,
+		PktInfo: pkt.PktInfo,
+	}
+
+	p.Cmd, err = DecodeCmd(data, src.IsSrv(), src.ProtoVer())
+	if err != nil {
+		log.Print(err)
+	}
+
+	// The codecs don't model every field, e.g. trailing bytes,
+	// so the original data is kept unless a handler changes the packet
+	var encoded []byte
+	if p.Cmd != nil {
+		encoded = EncodeCmd(p.Cmd, src.ProtoVer())
+	} else {
+		p.Data = append([]byte(nil), data[2:]...)
+	}
+
+	for _, handler := range handlers {
+		if handler(src, dst, p) {
+			return true
+		}
+	}
+
+	if p.Cmd != nil {
+		if cmd := EncodeCmd(p.Cmd, src.ProtoVer()); !bytes.Equal(cmd, encoded) {
+			data = cmd
+		}
+	} else if p.CmdNo != cmdNo || !bytes.Equal(p.Data, data[2:]) {
+		data = make([]byte, 2, 2+len(p.Data))
+		binary.BigEndian.PutUint16(data, p.CmdNo)
+		data = append(data, p.Data...)
+	}
+
+	pkt.Reader = bytes.NewReader(data)
+	pkt.PktInfo = p.PktInfo
+	return false
+}
@@ -39,6 +39,8 @@ func processJoin(c *Conn) {
 	}
 	rpcSrvMu.Unlock()
 
+	LogInfo(c.LogFields(), c.Username(), " joined")
+
 	onlinePlayers[c.Username()] = true
 	for i := range onJoinPlayer {
 		onJoinPlayer[i](c)
@@ -57,6 +59,8 @@ func processLeave(c *Conn) {
 	}
 	rpcSrvMu.Unlock()
 
+	LogInfo(c.LogFields(), c.Username(), " left")
+
 	onlinePlayers[c.Username()] = false
 	for i := range onLeavePlayer {
 		onLeavePlayer[i](c)
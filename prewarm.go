@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/anon55555/mt/rudp"
+)
+
+// ErrRedirectCancelled is returned by Conn.Redirect
+// if the redirect has been cancelled while loading
+var ErrRedirectCancelled = errors.New("redirect cancelled")
+
+// Maximum number of packets buffered for a prewarmed connection
+// before the first MapBlocks arrive
+const maxPrewarmPkts = 4096
+
+// How long a redirect waits for the first MapBlocks
+// before switching anyway
+const prewarmReadyTimeout = 10 * time.Second
+
+// A prewarmConn is an authenticated connection to a server
+// that a client hasn't been switched to yet
+// Packets from the server are buffered until the switch
+type prewarmConn struct {
+	server string
+	srv    *Conn
+
+	mu   sync.Mutex
+	pkts []rudp.Pkt
+	clt  *Conn
+
+	ready     chan struct{}
+	readyOnce sync.Once
+	expiry    *time.Timer
+}
+
+// run buffers the packets from the server and
+// forwards them once the client has been attached
+func (p *prewarmConn) run() {
+	for {
+		pkt, err := p.srv.Recv()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				p.mu.Lock()
+				clt := p.clt
+				p.mu.Unlock()
+
+				// Let Proxy handle the disconnect
+				if clt != nil {
+					Proxy(p.srv, clt)
+				}
+
+				return
+			}
+
+			log.Print(err)
+			continue
+		}
+
+		r := ByteReader(pkt)
+		pkt.Reader = r
+
+		p.mu.Lock()
+		if clt := p.clt; clt != nil {
+			p.mu.Unlock()
+
+			forward(p.srv, clt, pkt)
+			Proxy(p.srv, clt)
+			return
+		}
+
+		p.pkts = append(p.pkts, pkt)
+
+		cmd := make([]byte, 2)
+		r.ReadAt(cmd, 0)
+		if cmd[1] == ToClientBlockdata && cmd[0] == 0 {
+			p.readyOnce.Do(func() { close(p.ready) })
+		}
+
+		overflow := len(p.pkts) > maxPrewarmPkts
+		p.mu.Unlock()
+
+		if overflow {
+			log.Print("Too many packets from " + p.server + " while prewarming, closing")
+			p.srv.Close()
+			return
+		}
+	}
+}
+
+// attach sends the buffered packets to the client
+// and makes run forward everything after them
+func (p *prewarmConn) attach(c *Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pkt := range p.pkts {
+		forward(p.srv, c, pkt)
+	}
+
+	p.pkts = nil
+	p.clt = c
+}
+
+// waitReady waits until the server has sent the first MapBlocks
+// while a loading HUD is shown on the client
+func (p *prewarmConn) waitReady(c *Conn, cancel <-chan struct{}) error {
+	c.addTextHud(loadingHudID, 0.5, 0.5, "Connecting to "+p.server+"...", 0xFFFFFF)
+	defer c.removeHud(loadingHudID)
+
+	timeout := time.NewTimer(prewarmReadyTimeout)
+	defer timeout.Stop()
+
+	select {
+	case <-p.ready:
+	case <-timeout.C:
+		LogWarn(c.LogFields(), p.server, " hasn't sent any MapBlocks, switching anyway")
+	case <-cancel:
+		return ErrRedirectCancelled
+	case <-p.srv.Closed():
+		// CancelRedirect closes the connection as well
+		select {
+		case <-cancel:
+			return ErrRedirectCancelled
+		default:
+		}
+
+		return fmt.Errorf("connection to server %s closed while loading", p.server)
+	}
+
+	return nil
+}
+
+// Prewarm authenticates a connection to a server or the first server
+// of a group the Conn is likely to be redirected to, so that
+// the redirect only has to wait for the MapBlocks
+// Note that the player is online on the server from now on
+// The connection is closed if it isn't used within prewarm_timeout seconds
+func (c *Conn) Prewarm(server string) error {
+	c.redirectMu.Lock()
+	defer c.redirectMu.Unlock()
+
+	if _, ok := ConfKey("groups:" + server).([]interface{}); ok {
+		candidates := groupCandidates(c, server)
+		if len(candidates) == 0 {
+			return fmt.Errorf("no server of group %s is available", server)
+		}
+
+		server = candidates[0]
+	}
+
+	if server == c.ServerName() {
+		return fmt.Errorf("already connected to server %s", server)
+	}
+
+	if !c.mayJoin(server) {
+		return fmt.Errorf("server %s is in maintenance mode", server)
+	}
+
+	_, err := c.prewarm(server)
+	return err
+}
+
+// prewarm returns the prewarmed connection to a server,
+// connecting to it if there is none
+// The redirectMu has to be locked
+func (c *Conn) prewarm(server string) (*prewarmConn, error) {
+	c.prewarmMu.Lock()
+	p := c.prewarmed
+	c.prewarmMu.Unlock()
+
+	if p != nil {
+		select {
+		case <-p.srv.Closed():
+		default:
+			if p.server == server {
+				return p, nil
+			}
+		}
+
+		c.dropPrewarm(p)
+	}
+
+	srv, err := c.connectServer(server)
+	if err != nil {
+		return nil, err
+	}
+
+	p = &prewarmConn{
+		server: server,
+		srv:    srv,
+		ready:  make(chan struct{}),
+	}
+
+	timeout, ok := ConfKey("prewarm_timeout").(int)
+	if !ok {
+		timeout = 30
+	}
+
+	p.expiry = time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+		c.dropPrewarm(p)
+	})
+
+	c.prewarmMu.Lock()
+	c.prewarmed = p
+	c.prewarmMu.Unlock()
+
+	go p.run()
+
+	LogInfo(c.LogFields(), "Prewarmed connection of ", c.Username(), " to ", server)
+	return p, nil
+}
+
+// preferPrewarmed moves the server a connection has been
+// prewarmed to to the front of a list of candidates
+func (c *Conn) preferPrewarmed(candidates []string) []string {
+	c.prewarmMu.Lock()
+	defer c.prewarmMu.Unlock()
+
+	if c.prewarmed == nil {
+		return candidates
+	}
+
+	for i, candidate := range candidates {
+		if candidate == c.prewarmed.server {
+			r := append([]string{candidate}, candidates[:i]...)
+			return append(r, candidates[i+1:]...)
+		}
+	}
+
+	return candidates
+}
+
+// takePrewarm removes a prewarmed connection from the Conn
+// so that it can't expire or be cancelled anymore
+func (c *Conn) takePrewarm(p *prewarmConn, cancel <-chan struct{}) error {
+	c.prewarmMu.Lock()
+	defer c.prewarmMu.Unlock()
+
+	select {
+	case <-cancel:
+		return ErrRedirectCancelled
+	default:
+	}
+
+	p.expiry.Stop()
+	if c.prewarmed == p {
+		c.prewarmed = nil
+	}
+
+	return nil
+}
+
+// dropPrewarm closes a prewarmed connection unless it has been taken
+func (c *Conn) dropPrewarm(p *prewarmConn) {
+	c.prewarmMu.Lock()
+	defer c.prewarmMu.Unlock()
+
+	if c.prewarmed != p {
+		return
+	}
+
+	p.expiry.Stop()
+	p.srv.Close()
+	c.prewarmed = nil
+}
+
+// beginRedirect returns a channel that is closed
+// if the redirect is cancelled
+func (c *Conn) beginRedirect() <-chan struct{} {
+	c.prewarmMu.Lock()
+	defer c.prewarmMu.Unlock()
+
+	c.redirectCancel = make(chan struct{})
+	return c.redirectCancel
+}
+
+func (c *Conn) endRedirect() {
+	c.prewarmMu.Lock()
+	defer c.prewarmMu.Unlock()
+
+	c.redirectCancel = nil
+}
+
+// CancelRedirect aborts a redirect that is waiting for the new server
+// and closes the prewarmed connection
+// It returns false if there is nothing to cancel
+func (c *Conn) CancelRedirect() bool {
+	c.prewarmMu.Lock()
+	defer c.prewarmMu.Unlock()
+
+	var cancelled bool
+	if c.redirectCancel != nil {
+		close(c.redirectCancel)
+		c.redirectCancel = nil
+		cancelled = true
+	}
+
+	if p := c.prewarmed; p != nil {
+		p.expiry.Stop()
+		p.srv.Close()
+		c.prewarmed = nil
+		cancelled = true
+	}
+
+	return cancelled
+}
+
+func init() {
+	RegisterOnLeavePlayer(func(c *Conn) {
+		c.prewarmMu.Lock()
+		p := c.prewarmed
+		c.prewarmMu.Unlock()
+
+		if p != nil {
+			c.dropPrewarm(p)
+		}
+	})
+
+	RegisterCommand(&ChatCommand{
+		Name: "cancel",
+		Help: "Cancels a redirect that is still loading",
+		Func: func(c *Conn, args *ChatCommandArgs) {
+			if !c.CancelRedirect() {
+				c.SendChatMsg("No redirect is loading.")
+			}
+		},
+	})
+}
@@ -1,6 +1,27 @@
 package main
 
+// Serialization format version used in the handshake
+const SerializeVer = 0x1C
+
+// Supported protocol versions
+// Packets whose layout depends on the version are encoded
+// according to the ProtoVer of the Conn they are sent to
 const (
-	ProtoMin    = 0x0025
-	ProtoLatest = 0x0027
+	ProtoMin = 0x0025
+
+	// Splits the sun, moon and stars off ToClientSetSky
+	Proto39 = 0x0027
+
+	// Media pushes refer to the file by a token,
+	// HUD elements have a text style
+	Proto40 = 0x0028
+
+	// Adds ToClientSetLighting
+	Proto41 = 0x0029
+
+	// Adds the fog distance to the sky
+	// and exposure settings to the lighting
+	Proto42 = 0x002A
+
+	ProtoLatest = Proto42
 )
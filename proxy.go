@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"log"
 	"net"
+
+	"github.com/anon55555/mt/rudp"
 )
 
 // Proxy processes and forwards packets from src to dst
@@ -27,16 +31,12 @@ func Proxy(src, dst *Conn) {
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				if err = src.WhyClosed(); err != nil {
-					log.Print(src.Addr().String(), " disconnected with error: ", err)
+					LogWarn(src.LogFields(), src.Addr().String(), " disconnected with error: ", err)
 				} else {
-					log.Print(src.Addr().String(), " disconnected")
+					LogInfo(src.LogFields(), src.Addr().String(), " disconnected")
 				}
 
 				if !src.IsSrv() {
-					connectedConnsMu.Lock()
-					connectedConns--
-					connectedConnsMu.Unlock()
-
 					processLeave(src)
 				}
 
@@ -47,16 +47,60 @@ func Proxy(src, dst *Conn) {
 			continue
 		}
 
-		// Process
-		if processPktCommand(src, dst, &pkt) {
-			continue
-		}
+		forward(src, dst, pkt)
+	}
 
-		// Forward
-		if _, err := dst.Send(pkt); err != nil {
-			log.Print(err)
+	dst.Close()
+}
+
+// forward processes a packet from src and sends it to dst
+// Nothing is forwarded once stopForwarding has been called on src
+func forward(src, dst *Conn, pkt rudp.Pkt) {
+	src.pktMu.Lock()
+	defer src.pktMu.Unlock()
+
+	if !src.Forward() {
+		return
+	}
+
+	clt := src
+	if src.IsSrv() {
+		clt = dst
+	}
+
+	// Capture
+	capturePkt(src, clt, src.IsSrv(), &pkt)
+
+	// Process
+	if processPktCommand(src, dst, &pkt) {
+		return
+	}
+
+	// Translate
+	if translate(src, dst, &pkt) {
+		return
+	}
+
+	// Forward
+	if r, ok := pkt.Reader.(*bytes.Reader); ok {
+		cmd := make([]byte, 2)
+		r.ReadAt(cmd, 0)
+
+		direction := "to_server"
+		if src.IsSrv() {
+			direction = "to_client"
 		}
+
+		metricPackets.Inc(direction, cmdLabel(binary.BigEndian.Uint16(cmd)))
+		metricBytes.Add(float64(r.Len()), direction, cmdLabel(binary.BigEndian.Uint16(cmd)))
 	}
 
-	dst.Close()
+	// Conn.Send captures the packets sent to clients
+	if dst.IsSrv() {
+		capturePkt(dst, clt, false, &pkt)
+	}
+
+	if _, err := dst.Send(pkt); err != nil {
+		log.Print(err)
+	}
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrQueued is returned by Conn.Redirect if the target is full
+// and the Conn has been put in its queue instead
+var ErrQueued = errors.New("target is full, added to queue")
+
+type queueEntry struct {
+	c           *Conn
+	target      string
+	priority    bool
+	since       time.Time
+	redirecting bool
+}
+
+// A queueNotice is a chat message to a queued player
+// It is sent after queueMu has been unlocked
+// because SendChatMsg blocks until the client has acknowledged it
+type queueNotice struct {
+	c   *Conn
+	msg string
+}
+
+func sendQueueNotices(notices []queueNotice) {
+	for _, n := range notices {
+		go n.c.SendChatMsg(n.msg)
+	}
+}
+
+// queues contains the players waiting for a server or group, in order
+var queues = make(map[string][]*queueEntry)
+var queueMu sync.Mutex
+
+func queuePriv() string {
+	priv, ok := ConfKey("queue_priority_priv").(string)
+	if !ok {
+		priv = "queue_priority"
+	}
+
+	return priv
+}
+
+// targetFull reports whether none of the servers
+// a Conn could be sent to has a free slot
+func targetFull(c *Conn, target string) bool {
+	if _, ok := ConfKey("servers:" + target + ":address").(string); ok {
+		return ServerFull(target)
+	}
+
+	grp, ok := ConfKey("groups:" + target).([]interface{})
+	if !ok {
+		return false
+	}
+
+	var full bool
+	for _, srv := range grp {
+		name := srv.(string)
+		if name == c.ServerName() || !ServerUp(name) {
+			continue
+		}
+
+		if !ServerFull(name) {
+			return false
+		}
+
+		full = true
+	}
+
+	return full
+}
+
+// QueuePosition returns the target a Conn is waiting for
+// and its position in the queue, starting at 1
+// The position is 0 if the Conn isn't queued
+func (c *Conn) QueuePosition() (string, int) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	return queuePosition(c)
+}
+
+func queuePosition(c *Conn) (string, int) {
+	for target, queue := range queues {
+		for i, e := range queue {
+			if e.c == c {
+				return target, i + 1
+			}
+		}
+	}
+
+	return "", 0
+}
+
+// enqueue adds a Conn to the queue of a server or group,
+// removing it from any other queue
+// Players with the priority privilege are queued
+// behind the other priority players
+func enqueue(c *Conn, target string) {
+	priority, _ := c.CheckPrivs(map[string]bool{queuePriv(): true})
+
+	var notices []queueNotice
+	defer func() { sendQueueNotices(notices) }()
+
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	if t, _ := queuePosition(c); t == target {
+		notices = append(notices, queueNotice{c, target + " is still full. " + queueMsg(c)})
+		return
+	}
+
+	notices = removeQueued(c)
+
+	e := &queueEntry{
+		c:        c,
+		target:   target,
+		priority: priority,
+		since:    time.Now(),
+	}
+
+	queue := queues[target]
+
+	i := len(queue)
+	if priority {
+		for i = 0; i < len(queue) && queue[i].priority; i++ {
+		}
+	}
+
+	queue = append(queue, nil)
+	copy(queue[i+1:], queue[i:])
+	queue[i] = e
+	queues[target] = queue
+
+	LogInfo(c.LogFields(), c.Username(), " is waiting for ", target, " at position ", i+1)
+
+	notices = append(notices, queueNotice{c, target + " is full. " + queueMsg(c)})
+	notices = append(notices, notifyQueue(target, i+1)...)
+}
+
+// dequeue removes a Conn from the queue it is in
+func dequeue(c *Conn) {
+	queueMu.Lock()
+	notices := removeQueued(c)
+	queueMu.Unlock()
+
+	sendQueueNotices(notices)
+}
+
+func removeQueued(c *Conn) []queueNotice {
+	for target, queue := range queues {
+		for i, e := range queue {
+			if e.c == c {
+				queues[target] = append(queue[:i], queue[i+1:]...)
+				return notifyQueue(target, i)
+			}
+		}
+	}
+
+	return nil
+}
+
+func queueMsg(c *Conn) string {
+	target, pos := queuePosition(c)
+	return "You are number " + strconv.Itoa(pos) + " in the queue for " + target + "."
+}
+
+// notifyQueue returns the messages that tell the players at index i
+// and behind it their new position in a queue
+func notifyQueue(target string, i int) []queueNotice {
+	var notices []queueNotice
+
+	queue := queues[target]
+	for ; i < len(queue); i++ {
+		notices = append(notices, queueNotice{queue[i].c, queueMsg(queue[i].c)})
+	}
+
+	return notices
+}
+
+// processQueues moves the next waiting player to a server
+// or a group that contains it if it has a free slot
+func processQueues(server string) {
+	targets := []string{server}
+
+	groups, _ := ConfKey("groups").(map[interface{}]interface{})
+	for group, members := range groups {
+		list, _ := members.([]interface{})
+		for _, srv := range list {
+			if srv.(string) == server {
+				targets = append(targets, group.(string))
+				break
+			}
+		}
+	}
+
+	var notices []queueNotice
+	defer func() { sendQueueNotices(notices) }()
+
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	// The slot is only taken once the redirect has finished,
+	// so move a single player. The next leave frees another slot
+	for _, target := range targets {
+		var e *queueEntry
+		for _, entry := range queues[target] {
+			if !entry.redirecting {
+				e = entry
+				break
+			}
+		}
+
+		if e == nil || targetFull(e.c, target) {
+			continue
+		}
+
+		e.redirecting = true
+
+		notices = append(notices, queueNotice{e.c, "A slot is free, connecting you to " + target + "..."})
+		go e.redirect()
+		return
+	}
+}
+
+// redirect sends a queued Conn to the target of its queue
+// The Conn keeps its place if the slot has been taken in the meantime
+// and leaves the queue if the redirect fails for any other reason
+func (e *queueEntry) redirect() {
+	err := e.c.Redirect(e.target)
+
+	var notices []queueNotice
+	defer func() { sendQueueNotices(notices) }()
+
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	e.redirecting = false
+
+	switch {
+	case err == nil:
+		LogInfo(e.c.LogFields(), e.c.Username(), " left the queue for ", e.target, " after ", time.Since(e.since).Round(time.Second))
+	case !errors.Is(err, ErrQueued):
+		if t, _ := queuePosition(e.c); t == e.target {
+			notices = removeQueued(e.c)
+		}
+
+		LogWarn(e.c.LogFields(), e.c.Username(), " left the queue for ", e.target, ": ", err)
+	}
+}
+
+func init() {
+	RegisterOnLeavePlayer(func(c *Conn) {
+		dequeue(c)
+
+		if srv := c.ServerName(); srv != "" {
+			go processQueues(srv)
+		}
+	})
+
+	RegisterCommand(&ChatCommand{
+		Name: "queue",
+		Help: "Manages your place in the queue for a full server",
+		Subcommands: []*ChatCommand{
+			{
+				Name: "status",
+				Help: "Prints your position in the queue",
+				Func: func(c *Conn, args *ChatCommandArgs) {
+					queueMu.Lock()
+					_, pos := queuePosition(c)
+					msg := queueMsg(c)
+					queueMu.Unlock()
+
+					if pos == 0 {
+						c.SendChatMsg("You are not waiting for any server.")
+						return
+					}
+
+					c.SendChatMsg(msg)
+				},
+			},
+			{
+				Name: "leave",
+				Help: "Stops waiting for a server",
+				Func: func(c *Conn, args *ChatCommandArgs) {
+					if _, pos := c.QueuePosition(); pos == 0 {
+						c.SendChatMsg("You are not waiting for any server.")
+						return
+					}
+
+					dequeue(c)
+					c.SendChatMsg("You left the queue.")
+				},
+			},
+		},
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
 
 	"github.com/anon55555/mt/rudp"
 )
@@ -85,3 +86,11 @@ func WriteBytes32(w io.Writer, v []byte) {
 	WriteUint32(w, uint32(len(v)))
 	w.Write(v)
 }
+
+func ReadFloat32(r io.Reader) float32 {
+	return math.Float32frombits(ReadUint32(r))
+}
+
+func WriteFloat32(w io.Writer, v float32) {
+	WriteUint32(w, math.Float32bits(v))
+}
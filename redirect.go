@@ -2,12 +2,12 @@ package main
 
 import (
 	"bytes"
-	"compress/zlib"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
-	"math"
 	"net"
+	"time"
 
 	"github.com/anon55555/mt/rudp"
 )
@@ -28,6 +28,21 @@ func processRedirectDone(c *Conn, newsrv *string) {
 		successstr = "true"
 	}
 
+	// Anyone who may redirect can make up names,
+	// so only configured servers and groups become labels
+	label := *newsrv
+	_, isSrv := ConfKey("servers:" + label + ":address").(string)
+	_, isGrp := ConfKey("groups:" + label).([]interface{})
+	if !isSrv && !isGrp {
+		label = "unknown"
+	}
+
+	if success {
+		metricRedirects.Inc(label, "success")
+	} else {
+		metricRedirects.Inc(label, "failure")
+	}
+
 	rpcSrvMu.Lock()
 	for srv := range rpcSrvs {
 		srv.doRPC("->REDIRECTED "+c.Username()+" "+*newsrv+" "+successstr, "--")
@@ -39,191 +54,205 @@ func processRedirectDone(c *Conn, newsrv *string) {
 	}
 }
 
-// Redirect sends the Conn to the minetest server named newsrv
-func (c *Conn) Redirect(newsrv string) error {
-	c.redirectMu.Lock()
-	defer c.redirectMu.Unlock()
-
-	defer processRedirectDone(c, &newsrv)
-
-	straddr, ok := ConfKey("servers:" + newsrv + ":address").(string)
+// connectServer connects to a minetest server
+// and initializes the session of the Conn with it
+func (c *Conn) connectServer(server string) (*Conn, error) {
+	straddr, ok := ConfKey("servers:" + server + ":address").(string)
 	if !ok {
-		grp, ok := ConfKey("groups:" + newsrv).([]interface{})
-		if !ok {
-			return fmt.Errorf("server or group %s does not exist", newsrv)
-		}
-
-		smallestCnt := int(^uint(0) >> 1)
-		for _, srv := range grp {
-			cnt := len(ConnsServer(srv.(string)))
-			if cnt < smallestCnt {
-				if c.ServerName() == srv.(string) {
-					return fmt.Errorf("already connected to server %s", srv.(string))
-				}
-
-				smallestCnt = cnt
-				newsrv = srv.(string)
-			}
-		}
-
-		straddr, ok = ConfKey("servers:" + newsrv + ":address").(string)
-		if !ok {
-			return fmt.Errorf("server %s does not exist", newsrv)
-		}
-	}
-
-	if c.ServerName() == newsrv {
-		return fmt.Errorf("already connected to server %s", newsrv)
+		return nil, fmt.Errorf("server %s does not exist", server)
 	}
 
 	srvaddr, err := net.ResolveUDPAddr("udp", straddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	conn, err := net.DialUDP("udp", nil, srvaddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	srv, err := Connect(conn)
 	if err != nil {
-		return err
+		markServerDown(server)
+		return nil, err
 	}
 
+	// Don't kick the client if the server denies access,
+	// it stays on its current server
 	fin := make(chan *Conn)
-	go Init(c, srv, true, false, fin)
+	go Init(c, srv, true, true, fin)
 	initOk := <-fin
 
 	if initOk == nil {
 		srv.Close()
-		return fmt.Errorf("initialization with server %s failed", newsrv)
+		return nil, fmt.Errorf("initialization with server %s failed", server)
 	}
 
-	// Reset formspec style
-	data := []byte{
-		0x00, ToClientFormspecPrepend,
-		0x00, 0x00,
+	return srv, nil
+}
+
+// Redirect sends the Conn to the minetest server or group named newsrv
+// Members of a group are tried in the order of the group's strategy
+// The Conn stays on its current server until the new one has sent
+// the first MapBlocks, a loading HUD is shown in the meantime
+func (c *Conn) Redirect(newsrv string) (err error) {
+	c.redirectMu.Lock()
+	defer c.redirectMu.Unlock()
+
+	defer func() {
+		// Queued players haven't been redirected yet
+		if !errors.Is(err, ErrQueued) {
+			processRedirectDone(c, &newsrv)
+		}
+	}()
+
+	target := newsrv
+	oldsrv := c.ServerName()
+
+	if targetFull(c, target) {
+		enqueue(c, target)
+		return ErrQueued
 	}
 
-	_, err = c.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
+	var candidates []string
+	if _, ok := ConfKey("servers:" + newsrv + ":address").(string); ok {
+		if c.ServerName() == newsrv {
+			return fmt.Errorf("already connected to server %s", newsrv)
+		}
 
-	// Remove active objects
-	data = make([]byte, 6+len(c.aoIDs)*2)
-	data[0] = uint8(0x00)
-	data[1] = uint8(ToClientActiveObjectRemoveAdd)
-	binary.BigEndian.PutUint16(data[2:4], uint16(len(c.aoIDs)))
+		if msg, on := Maintenance(newsrv); on && !c.CanBypassMaintenance() {
+			c.SendChatMsg(msg)
+			return fmt.Errorf("server %s is in maintenance mode: %s", newsrv, msg)
+		}
 
-	si := 4
-	for ao := range c.aoIDs {
-		binary.BigEndian.PutUint16(data[si:2+si], ao)
-		si += 2
+		candidates = []string{newsrv}
+	} else {
+		if _, ok := ConfKey("groups:" + newsrv).([]interface{}); !ok {
+			return fmt.Errorf("server or group %s does not exist", newsrv)
+		}
+
+		candidates = groupCandidates(c, newsrv)
+		if len(candidates) == 0 {
+			// Tell the player why the servers are left out
+			if msg, on := c.groupMaintenance(newsrv); on {
+				c.SendChatMsg(msg)
+			}
+
+			return fmt.Errorf("no server of group %s is available", newsrv)
+		}
 	}
 
-	binary.BigEndian.PutUint16(data[si:2+si], uint16(0))
+	candidates = c.preferPrewarmed(candidates)
+
+	cancel := c.beginRedirect()
+	defer c.endRedirect()
 
-	_, err = c.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
+	// Nothing but the loading HUD is sent to the client
+	// until the new server is ready, a failure
+	// leaves the client untouched on its old server
+	p, err := c.tryCandidates(candidates, cancel)
 	if err != nil {
+		if errors.Is(err, ErrRedirectCancelled) {
+			c.SendChatMsg("Redirect cancelled.")
+		}
+
 		return err
 	}
 
-	c.aoIDs = make(map[uint16]bool)
+	newsrv = p.server
+	srv := p.srv
 
-	// Remove MapBlocks
-	for _, block := range c.blocks {
-		x := block[0]
-		y := block[1]
-		z := block[2]
-
-		blockdata := make([]byte, 5)
-		blockdata[0] = uint8(0)
-		binary.BigEndian.PutUint16(blockdata[1:3], uint16(0xFFFF))
-		blockdata[3] = uint8(2)
-		blockdata[4] = uint8(2)
-
-		nodes := make([]byte, 16384)
-		for i := uint32(0); i < NodeCount; i++ {
-			binary.BigEndian.PutUint16(nodes[2*i:2+2*i], uint16(ContentIgnore))
-			nodes[2*NodeCount+i] = uint8(0)
-			nodes[3*NodeCount+i] = uint8(0)
-		}
+	// The old server must not change the state of the client
+	// while it is reset, so wait for the packet it is forwarding
+	c.Server().stopForwarding()
 
-		var compBuf bytes.Buffer
-		zw := zlib.NewWriter(&compBuf)
-		zw.Write(nodes)
-		zw.Close()
+	// Sending to the client only fails if it has disconnected
+	if err = c.resetForRedirect(newsrv); err != nil {
+		srv.Close()
+		return err
+	}
 
-		compNodes := compBuf.Bytes()
+	c.SetServer(srv)
 
-		w := bytes.NewBuffer([]byte{0x00, ToClientBlockdata})
-		WriteUint16(w, uint16(x))
-		WriteUint16(w, uint16(y))
-		WriteUint16(w, uint16(z))
-		w.Write(blockdata)
-		w.Write(compNodes)
+	go Proxy(c, srv)
+	p.attach(c)
 
-		_, err = c.Send(rudp.Pkt{Reader: w})
-		if err != nil {
-			return err
+	// Rejoin mod channels
+	for ch := range c.modChs {
+		if _, err := srv.SendCmd(&ToSrvJoinModChan{Channel: ch}); err != nil {
+			log.Print(err)
 		}
 	}
 
-	c.blocks = [][3]int16{}
+	LogInfo(c.LogFields(), c.Addr().String()+" redirected to "+newsrv)
+
+	markServerUp(newsrv)
 
-	// Remove HUDs
-	data = []byte{0, ToClientHudSetParam, 0, 1, 0, 4, 0, 0, 0, 8}
+	if queued, _ := c.QueuePosition(); queued == target || queued == newsrv {
+		dequeue(c)
+	}
 
-	_, err = c.Send(rudp.Pkt{
-		Reader: bytes.NewReader(data),
-		PktInfo: rudp.PktInfo{
-			Channel: 1,
-		},
-	})
+	go processQueues(oldsrv)
 
-	if err != nil {
+	return nil
+}
+
+// resetForRedirect removes everything the old server has sent
+// from the client and sends the detached inventories of the new one
+func (c *Conn) resetForRedirect(newsrv string) error {
+	// Reset formspec style
+	if _, err := c.SendCmd(&ToCltFormspecPrepend{}); err != nil {
 		return err
 	}
 
-	data = []byte{0, ToClientHudSetParam, 0, 2, 0, 0}
-
-	_, err = c.Send(rudp.Pkt{
-		Reader: bytes.NewReader(data),
-		PktInfo: rudp.PktInfo{
-			Channel: 1,
-		},
-	})
+	// Remove active objects
+	rm := &ToCltAORmAdd{}
+	for ao := range c.aoIDs {
+		rm.Remove = append(rm.Remove, ao)
+	}
 
-	if err != nil {
+	if _, err := c.SendCmd(rm); err != nil {
 		return err
 	}
 
-	data = []byte{0, ToClientHudSetParam, 0, 3, 0, 0}
+	c.aoIDs = make(map[uint16]bool)
 
-	_, err = c.Send(rudp.Pkt{
-		Reader: bytes.NewReader(data),
-		PktInfo: rudp.PktInfo{
-			Channel: 1,
-		},
-	})
+	// Remove MapBlocks
+	ignore := MapBlk{LightingComplete: 0xFFFF}
+	for i := range ignore.Param0 {
+		ignore.Param0[i] = ContentIgnore
+	}
 
-	if err != nil {
-		return err
+	for _, block := range c.blocks {
+		if _, err := c.SendCmd(&ToCltBlkData{
+			Pos: block,
+			Blk: ignore,
+		}); err != nil {
+			return err
+		}
+	}
+
+	c.blocks = [][3]int16{}
+
+	// Reset the hotbar and remove HUDs
+	hudChannel := rudp.PktInfo{Channel: 1}
+
+	itemCount := make([]byte, 4)
+	binary.BigEndian.PutUint32(itemCount, 8)
+
+	for _, param := range []*ToCltHUDSetParam{
+		{Param: HudParamHotbarItemCount, Value: itemCount},
+		{Param: HudParamHotbarImg},
+		{Param: HudParamHotbarSelImg},
+	} {
+		if _, err := c.SendCmdInfo(param, hudChannel); err != nil {
+			return err
+		}
 	}
 
 	for hud := range c.huds {
-		data = make([]byte, 6)
-		data[0] = uint8(0x00)
-		data[1] = uint8(ToClientHudRM)
-		binary.BigEndian.PutUint32(data[2:6], hud)
-
-		_, err = c.Send(rudp.Pkt{
-			Reader: bytes.NewReader(data),
-			PktInfo: rudp.PktInfo{
-				Channel: 1,
-			},
-		})
-
-		if err != nil {
+		if _, err := c.SendCmdInfo(&ToCltRmHUD{ID: hud}, hudChannel); err != nil {
 			return err
 		}
 	}
@@ -232,168 +261,92 @@ func (c *Conn) Redirect(newsrv string) error {
 
 	// Stop looped sounds
 	for sound := range c.sounds {
-		data = make([]byte, 6)
-		data[0] = uint8(0x00)
-		data[1] = uint8(ToClientStopSound)
-		binary.BigEndian.PutUint32(data[2:6], uint32(sound))
-
-		_, err = c.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
-		if err != nil {
+		if _, err := c.SendCmd(&ToCltStopSound{ID: sound}); err != nil {
 			return err
 		}
 	}
 
 	c.sounds = make(map[int32]bool)
 
-	// Stop day/night ratio override
-	data = []byte{0, 0, 0}
-
-	_, err = c.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
-	if err != nil {
+	// Reset everything else the old server has changed
+	if err := c.resetState(); err != nil {
 		return err
 	}
 
-	// Reset eye offset
-	data = []byte{}
-	for i := 0; i < 24; i++ {
-		data = append(data, uint8(0))
-	}
-
-	_, err = c.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
-	if err != nil {
-		return err
-	}
-
-	// Reset sky
-	switch c.ProtoVer() {
-	case 39:
-		data = []byte{
-			0, ToClientSetSky,
-			0, 0, 0, 0,
-			0, 7, 114, 101, 103, 117, 108, 97, 114,
-			1,
-			255, 255, 255, 255,
-			255, 255, 255, 255,
-			0, 7, 100, 101, 102, 97, 117, 108, 116,
-			255, 97, 181, 245,
-			255, 144, 211, 245,
-			255, 180, 186, 250,
-			255, 186, 193, 240,
-			255, 0, 107, 255,
-			255, 64, 144, 255,
-			255, 100, 100, 100,
-		}
-	default:
-		data = []byte{
-			0, ToClientSetSky,
-			0, 0, 0, 0,
-			0, 7, 114, 101, 103, 117, 108, 97, 114,
-			0, 0,
+	// Update detached inventories
+	for _, inv := range detachedinvs[newsrv] {
+		data := append([]byte{0x00, ToClientDetachedInventory}, inv...)
+		if _, err := c.Send(rudp.Pkt{Reader: bytes.NewReader(data)}); err != nil {
+			return err
 		}
 	}
 
-	_, err = c.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
-	// Reset sun
-	data = []byte{
-		1,
-		0, 7, 115, 117, 110, 46, 112, 110, 103,
-		0, 15, 115, 117, 110, 95, 116, 111, 110, 101, 109, 97, 112, 46, 112, 110, 103,
-		0, 13, 115, 117, 110, 114, 105, 115, 101, 98, 103, 46, 112, 110, 103,
+// tryCandidates connects to the first candidate that accepts the Conn
+// and has sent the first MapBlocks. Every candidate is tried
+// 1 + redirect_retries times, waiting redirect_retry_delay seconds
+// before the first retry and twice as long before every further one
+// Only the first candidate is tried if redirect_try_alternatives is false
+func (c *Conn) tryCandidates(candidates []string, cancel <-chan struct{}) (*prewarmConn, error) {
+	retries, ok := ConfKey("redirect_retries").(int)
+	if !ok || retries < 0 {
+		retries = 0
 	}
-	sunscale := make([]byte, 4)
-	binary.BigEndian.PutUint32(sunscale[0:4], math.Float32bits(1))
-	data = append(data, sunscale...)
 
-	_, err = c.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
-	if err != nil {
-		return err
+	delay, ok := ConfKey("redirect_retry_delay").(int)
+	if !ok || delay < 0 {
+		delay = 1
 	}
 
-	// Reset moon
-	data = []byte{
-		1,
-		0, 8, 109, 111, 111, 110, 46, 112, 110, 103,
-		0, 16, 109, 111, 111, 110, 95, 116, 111, 110, 101, 109, 97, 112, 46, 112, 110, 103,
+	if alt, ok := ConfKey("redirect_try_alternatives").(bool); ok && !alt {
+		candidates = candidates[:1]
 	}
-	moonscale := make([]byte, 4)
-	binary.BigEndian.PutUint32(moonscale, math.Float32bits(1))
-	data = append(data, moonscale...)
 
-	_, err = c.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
-	if err != nil {
-		return err
-	}
+	var err error
+	for _, candidate := range candidates {
+		backoff := time.Duration(delay) * time.Second
+		for attempt := 0; attempt <= retries; attempt++ {
+			metricRedirectAttempts.Inc(candidate)
 
-	// Reset stars
-	data = []byte{
-		1,
-		0, 0, 3, 232,
-		105, 235, 235, 255,
-	}
-	starscale := make([]byte, 4)
-	binary.BigEndian.PutUint32(starscale, math.Float32bits(1))
-	data = append(data, starscale...)
+			if attempt > 0 {
+				LogInfo(c.LogFields(), "Retrying to connect ", c.Username(), " to ", candidate, " in ", backoff)
 
-	_, err = c.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
-	if err != nil {
-		return err
-	}
+				select {
+				case <-time.After(backoff):
+				case <-cancel:
+					return nil, ErrRedirectCancelled
+				}
 
-	// Reset cloud params
-	w := bytes.NewBuffer([]byte{0x00, ToClientCloudParams})
-	WriteUint32(w, math.Float32bits(0))
-	w.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0})
-	WriteUint32(w, math.Float32bits(0))
-	WriteUint32(w, math.Float32bits(0))
-	WriteUint32(w, math.Float32bits(0))
-	WriteUint32(w, math.Float32bits(0))
+				backoff *= 2
+			}
 
-	_, err = c.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
-	if err != nil {
-		return err
-	}
+			var p *prewarmConn
+			p, err = c.prewarm(candidate)
+			if err == nil {
+				err = p.waitReady(c, cancel)
+			}
 
-	// Update detached inventories
-	if len(detachedinvs[newsrv]) > 0 {
-		for i := range detachedinvs[newsrv] {
-			data = make([]byte, 2+len(detachedinvs[newsrv][i]))
-			data[0] = uint8(0x00)
-			data[1] = uint8(ToClientDetachedInventory)
-			copy(data[2:], detachedinvs[newsrv][i])
-
-			_, err = c.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
-			if err != nil {
-				return err
+			if err == nil {
+				err = c.takePrewarm(p, cancel)
 			}
-		}
-	}
 
-	c.Server().stopForwarding()
+			if err == nil {
+				return p, nil
+			}
 
-	c.SetServer(srv)
+			if p != nil {
+				c.dropPrewarm(p)
+			}
 
-	go Proxy(c, srv)
-	go Proxy(srv, c)
+			if errors.Is(err, ErrRedirectCancelled) {
+				return nil, err
+			}
 
-	// Rejoin mod channels
-	for ch := range c.modChs {
-		data := make([]byte, 4+len(ch))
-		data[0] = uint8(0x00)
-		data[1] = uint8(ToServerModChannelJoin)
-		binary.BigEndian.PutUint16(data[2:4], uint16(len(ch)))
-		copy(data[4:], []byte(ch))
-
-		_, err = srv.Send(rudp.Pkt{Reader: bytes.NewReader(data)})
-		if err != nil {
-			log.Print(err)
+			LogWarn(c.LogFields(), "Could not connect ", c.Username(), " to ", candidate, ": ", err)
 		}
 	}
 
-	log.Print(c.Addr().String() + " redirected to " + newsrv)
-
-	return nil
+	return nil, err
 }
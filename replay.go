@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/anon55555/mt/rudp"
+)
+
+// replaySkip contains the commands of the login sequence,
+// replayCapture performs a fresh login instead of sending them
+var replaySkip = map[uint16]bool{
+	ToServerInit:         true,
+	ToServerInit2:        true,
+	ToServerFirstSRP:     true,
+	ToServerSRPBytesA:    true,
+	ToServerSRPBytesM:    true,
+	ToServerRequestMedia: true,
+	ToServerClientReady:  true,
+	ToServerHaveMedia:    true,
+}
+
+// replayMain implements the "multiserver replay" subcommand
+// which prints capture files or replays them against a server
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: multiserver replay [flags] file")
+		fmt.Fprintln(fs.Output(), "Prints the packets of a capture file.")
+		fmt.Fprintln(fs.Output(), "If -server is specified, the packets the proxy sent to the backend are replayed against it instead.")
+		fmt.Fprintln(fs.Output(), "The password is read from MULTISERVER_PASSWORD if set.")
+		fs.PrintDefaults()
+	}
+
+	addr := fs.String("server", "", "Replay the packets sent to the backend against the server at this address")
+	user := fs.String("user", "", "Name of the player to log in as, defaults to the captured player")
+	speed := fs.Float64("speed", 1, "Replay speed, 0 sends all packets at once")
+	leg := fs.String("leg", "all", "Only print packets of this leg (client, server or all)")
+	full := fs.Bool("full", false, "Don't shorten decoded packets")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	name, recs, err := ReadCapture(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if len(recs) == 0 {
+			return 1
+		}
+	}
+
+	if *addr == "" {
+		printCapture(name, recs, *leg, *full)
+		return 0
+	}
+
+	if *user == "" {
+		*user = name
+	}
+
+	password, ok := os.LookupEnv("MULTISERVER_PASSWORD")
+	if !ok {
+		password = readPassword("Password for " + *user + ": ")
+	}
+
+	if err := replayCapture(*addr, *user, password, recs, *speed); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func printCapture(name string, recs []*CaptureRecord, leg string, full bool) {
+	fmt.Println("Capture of", name)
+
+	for _, rec := range recs {
+		legName := "client"
+		if rec.Leg == CaptureServerLeg {
+			legName = "server"
+		}
+
+		if leg != "all" && leg != legName {
+			continue
+		}
+
+		direction := "to_server"
+		if rec.Direction == CaptureToClient {
+			direction = "to_client"
+		}
+
+		reliability := "rel"
+		if rec.Unrel {
+			reliability = "unrel"
+		}
+
+		fmt.Printf("%10.3fs %-6s %-9s ch%d %-5s %-12s %s\n",
+			rec.Time.Sub(recs[0].Time).Seconds(), legName, direction,
+			rec.Channel, reliability, rec.Server, describeRecord(rec, full))
+	}
+}
+
+// describeRecord returns the command number and,
+// if it has a type, the decoded command of a record
+func describeRecord(rec *CaptureRecord, full bool) string {
+	if len(rec.Data) < 2 {
+		return fmt.Sprintf("short packet %x", rec.Data)
+	}
+
+	label := cmdLabel(binary.BigEndian.Uint16(rec.Data))
+
+	cmd, err := DecodeCmd(rec.Data, rec.Direction == CaptureToClient, rec.ProtoVer)
+	if err != nil {
+		return label + " " + err.Error()
+	} else if cmd == nil {
+		return fmt.Sprintf("%s %d bytes", label, len(rec.Data)-2)
+	}
+
+	name := strings.TrimPrefix(fmt.Sprintf("%T", cmd), "*main.")
+	s := label + " " + name + " " + strings.TrimPrefix(fmt.Sprintf("%+v", cmd), "&")
+	if !full && len(s) > 200 {
+		s = s[:197] + "..."
+	}
+
+	return s
+}
+
+// replayCapture logs in to the server at addr and sends it the packets
+// the proxy sent to the backend in the capture, keeping their timing
+// These are the packets of the server leg, chat commands
+// the proxy has handled itself are left out
+func replayCapture(addr, user, password string, recs []*CaptureRecord, speed float64) error {
+	var sent []*CaptureRecord
+	for _, rec := range recs {
+		if rec.Leg != CaptureServerLeg || rec.Direction != CaptureToServer || len(rec.Data) < 2 {
+			continue
+		}
+
+		if !replaySkip[binary.BigEndian.Uint16(rec.Data)] {
+			sent = append(sent, rec)
+		}
+	}
+
+	if len(sent) == 0 {
+		return errors.New("the capture doesn't contain any packets sent to the backend")
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv, err := Connect(conn)
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+
+	clt := &Conn{username: user, protoVer: sent[0].ProtoVer}
+	passPhrase = []byte(password)
+
+	fin := make(chan *Conn)
+	go Init(clt, srv, true, true, fin)
+
+	if _, ok := <-fin; !ok {
+		return errors.New("login to " + addr + " failed")
+	}
+
+	go func() {
+		for {
+			if _, err := srv.Recv(); errors.Is(err, net.ErrClosed) {
+				return
+			}
+		}
+	}()
+
+	for i, rec := range sent {
+		if i > 0 && speed > 0 {
+			time.Sleep(time.Duration(float64(rec.Time.Sub(sent[i-1].Time)) / speed))
+		}
+
+		pkt := rudp.Pkt{
+			Reader: bytes.NewReader(rec.Data),
+			PktInfo: rudp.PktInfo{
+				Channel: rudp.Channel(rec.Channel),
+				Unrel:   rec.Unrel,
+			},
+		}
+
+		if translate(clt, srv, &pkt) {
+			continue
+		}
+
+		if _, err := srv.Send(pkt); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Replayed", len(sent), "packets")
+
+	// Give the server a moment to process the last packets
+	time.Sleep(time.Second)
+	return nil
+}
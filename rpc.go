@@ -74,7 +74,8 @@ func processRPC(c *Conn, r *bytes.Reader) bool {
 
 	rq := strings.Split(msg, " ")[0]
 
-	log.Print("RPC from ", c.Addr().String(), ": ", strings.Join(strings.Split(msg, " ")[1:], " "))
+	LogDebug(c.LogFields(), "RPC from ", c.Addr().String(), ": ", strings.Join(strings.Split(msg, " ")[1:], " "))
+	metricRPC.Inc("in", strings.Split(msg, " ")[1])
 
 	switch cmd := strings.Split(msg, " ")[1]; cmd {
 	case "<-ALERT":
@@ -85,6 +86,15 @@ func processRPC(c *Conn, r *bytes.Reader) bool {
 			return true
 		}
 		go c.doRPC("->DEFSRV "+defsrv, rq)
+	case "<-GETSRVHEALTH":
+		server := strings.Join(strings.Split(msg, " ")[2:], " ")
+
+		status := "down"
+		if ServerUp(server) {
+			status = "up"
+		}
+
+		go c.doRPC("->SRVHEALTH "+server+" "+status, rq)
 	case "<-GETPEERCNT":
 		cnt := strconv.Itoa(ConnCount())
 		go c.doRPC("->PEERCNT "+cnt, rq)
@@ -133,6 +143,17 @@ func processRPC(c *Conn, r *bytes.Reader) bool {
 		if IsOnline(name) {
 			go ConnByUsername(name).Redirect(tosrv)
 		}
+	case "<-PREWARM":
+		name := strings.Split(msg, " ")[2]
+		tosrv := strings.Split(msg, " ")[3]
+		if IsOnline(name) {
+			go ConnByUsername(name).Prewarm(tosrv)
+		}
+	case "<-CANCELREDIRECT":
+		name := strings.Split(msg, " ")[2]
+		if IsOnline(name) {
+			ConnByUsername(name).CancelRedirect()
+		}
 	case "<-GETADDR":
 		name := strings.Split(msg, " ")[2]
 		var addr string
@@ -182,6 +203,8 @@ func processRPC(c *Conn, r *bytes.Reader) bool {
 		srvs = srvs[:len(srvs)-1]
 
 		go c.doRPC("->SRVS "+srvs, rq)
+	case "<-GETCMDS":
+		go c.doRPC("->CMDS "+rpcCommandList(), rq)
 	case "<-MT2MT":
 		msg := strings.Join(strings.Split(msg, " ")[2:], " ")
 		rpcSrvMu.Lock()
@@ -216,7 +239,8 @@ func (c *Conn) doRPC(rpc, rq string) {
 		return
 	}
 
-	log.Print("RPC to ", c.Addr().String(), ": ", rpc)
+	LogDebug(c.LogFields(), "RPC to ", c.Addr().String(), ": ", rpc)
+	metricRPC.Inc("out", strings.Split(rpc, " ")[0])
 
 	msg := rq + " " + rpc
 
@@ -304,6 +328,7 @@ func handleRPC(srv *Conn) {
 				switch sig := ReadUint8(r); sig {
 				case ModChSigJoinOk:
 					srv.SetUseRPC(true)
+					go srv.doRPC("->CMDS "+rpcCommandList(), "--")
 				case ModChSigSetState:
 					if state == ModChStateRO {
 						srv.SetUseRPC(false)
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remaining times at which a shutdown warning is sent to the chat
+var shutdownWarnings = []time.Duration{
+	10 * time.Minute,
+	5 * time.Minute,
+	2 * time.Minute,
+	time.Minute,
+	30 * time.Second,
+	10 * time.Second,
+	5 * time.Second,
+	4 * time.Second,
+	3 * time.Second,
+	2 * time.Second,
+	time.Second,
+}
+
+// defaultShutdownDelay is used if #shutdown or #restart
+// is executed without a delay
+const defaultShutdownDelay = time.Minute
+
+// ErrShutdownPending is returned by Shutdown if a shutdown
+// or restart has already been scheduled
+var ErrShutdownPending = errors.New("shutdown already pending")
+
+type pendingShutdown struct {
+	at      time.Time
+	reason  string
+	restart bool
+	cancel  chan struct{}
+}
+
+var shutdown *pendingShutdown
+var shutdownMu sync.Mutex
+
+// ShuttingDown reports whether a shutdown or restart is pending
+// and whether it is a restart
+func ShuttingDown() (pending, restart bool) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+
+	if shutdown == nil {
+		return false, false
+	}
+
+	return true, shutdown.restart
+}
+
+// Shutdown stops the proxy after a delay, warning the players
+// in the chat and on their HUD. No new players are admitted
+// while the countdown runs. If restart is true the clients
+// are told to reconnect
+func Shutdown(delay time.Duration, reason string, restart bool) error {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+
+	if shutdown != nil {
+		return ErrShutdownPending
+	}
+
+	shutdown = &pendingShutdown{
+		at:      time.Now().Add(delay),
+		reason:  reason,
+		restart: restart,
+		cancel:  make(chan struct{}),
+	}
+
+	go shutdownCountdown(shutdown)
+	return nil
+}
+
+// CancelShutdown aborts a pending shutdown or restart
+// It returns false if there is nothing to cancel
+func CancelShutdown() bool {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+
+	if shutdown == nil {
+		return false
+	}
+
+	close(shutdown.cancel)
+	shutdown = nil
+
+	return true
+}
+
+func (s *pendingShutdown) text(left time.Duration) string {
+	r := "Server shutting down in " + left.String()
+	if s.restart {
+		r = "Server restarting in " + left.String()
+	}
+
+	if s.reason != "" {
+		r += ": " + s.reason
+	}
+
+	return r
+}
+
+// kickMsg returns the message shown to clients
+// when they are disconnected
+func (s *pendingShutdown) kickMsg() string {
+	msg := s.reason
+	if addr, ok := ConfKey("shutdown_redirect_address").(string); ok && addr != "" {
+		msg = strings.TrimSpace(msg + " Please connect to " + addr + " instead.")
+	}
+
+	return msg
+}
+
+func shutdownCountdown(s *pendingShutdown) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	huds := make(map[*Conn]bool)
+	first := true
+
+	for {
+		left := time.Until(s.at).Round(time.Second)
+		if left <= 0 {
+			break
+		}
+
+		text := s.text(left)
+
+		warn := first
+		for _, w := range shutdownWarnings {
+			if left == w {
+				warn = true
+				break
+			}
+		}
+
+		if warn {
+			log.Print(text)
+			ChatSendAll(Colorize(text, "#F00"))
+		}
+		first = false
+
+		for _, c := range Conns() {
+			if c.Server() == nil {
+				continue
+			}
+
+			if huds[c] {
+				go c.setHudText(shutdownHudID, text)
+			} else {
+				huds[c] = true
+				go c.addTextHud(shutdownHudID, 0.5, 0.2, text, 0xFF0000)
+			}
+		}
+
+		select {
+		case <-s.cancel:
+			log.Print("Shutdown cancelled")
+			ChatSendAll(Colorize("Shutdown cancelled", "#0F0"))
+
+			for c := range huds {
+				go c.removeHud(shutdownHudID)
+			}
+
+			return
+		case <-ticker.C:
+		}
+	}
+
+	moveBeforeShutdown()
+	end(false, s.restart, s.kickMsg())
+}
+
+// moveBeforeShutdown redirects all players to shutdown_redirect_server
+// so that they leave the other servers before the proxy kicks them
+func moveBeforeShutdown() {
+	server, ok := ConfKey("shutdown_redirect_server").(string)
+	if !ok || server == "" {
+		return
+	}
+
+	if _, ok := ConfKey("servers:" + server + ":address").(string); !ok {
+		log.Print("shutdown_redirect_server " + server + " does not exist")
+		return
+	}
+
+	log.Print("Moving all players to " + server)
+
+	var wg sync.WaitGroup
+	for _, c := range Conns() {
+		if c.Server() == nil || c.ServerName() == server {
+			continue
+		}
+
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+
+			if err := c.Redirect(server); err != nil {
+				LogWarn(c.LogFields(), "Moving ", c.Username(), " to ", server, " before the shutdown failed: ", err)
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+func init() {
+	disable, ok := ConfKey("disable_builtin").(bool)
+	if ok && disable {
+		return
+	}
+
+	shutdownCmd := func(restart bool) func(*Conn, *ChatCommandArgs) {
+		return func(c *Conn, args *ChatCommandArgs) {
+			delay := defaultShutdownDelay
+			if args.Has("delay") {
+				delay = args.Duration("delay")
+			}
+
+			if delay < 0 {
+				if !CancelShutdown() {
+					SendChatMsg(c, "No shutdown is pending.")
+				}
+				return
+			}
+
+			if err := Shutdown(delay, args.String("reason"), restart); err != nil {
+				SendChatMsg(c, "A shutdown is already pending. Use a negative delay to cancel it.")
+			}
+		}
+	}
+
+	params := []ChatCommandParam{
+		{Name: "delay", Type: ParamDuration, Optional: true},
+		{Name: "reason", Type: ParamRest, Optional: true},
+	}
+
+	RegisterCommand(&ChatCommand{
+		Name: "shutdown",
+		Help: `Stops the proxy after a delay (default 1m), counting down in the chat and on the HUD.
+		New players can't join during the countdown. A negative delay cancels a pending shutdown`,
+		Params:  params,
+		Privs:   privs("end"),
+		Console: true,
+		Func:    shutdownCmd(false),
+	})
+
+	RegisterCommand(&ChatCommand{
+		Name: "restart",
+		Help: `Like shutdown, but tells the clients to reconnect.
+		The proxy has to be restarted by a service manager`,
+		Params:  params,
+		Privs:   privs("end"),
+		Console: true,
+		Func:    shutdownCmd(true),
+	})
+}
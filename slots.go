@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LastActive returns the time the player last moved,
+// interacted, chatted or used the inventory
+func (c *Conn) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActive))
+}
+
+func (c *Conn) markActive() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+func reservedPriv() string {
+	priv, ok := ConfKey("reserved_slots_priv").(string)
+	if !ok {
+		priv = "reserved_slot"
+	}
+
+	return priv
+}
+
+// longestIdle returns the connected player without a reserved slot
+// that has been inactive for the longest time
+func longestIdle() *Conn {
+	var idle *Conn
+	for _, c := range Conns() {
+		if c.Server() == nil {
+			continue
+		}
+
+		if has, err := c.CheckPrivs(map[string]bool{reservedPriv(): true}); err != nil || has {
+			continue
+		}
+
+		if idle == nil || c.LastActive().Before(idle.LastActive()) {
+			idle = c
+		}
+	}
+
+	return idle
+}
+
+// admit decides whether a client may join depending on player_limit
+// Part of the limit can be reserved for players with a privilege
+// If kick_idle_for_reserved is true, players with the privilege
+// are admitted even if the proxy is full by kicking the player
+// without it that has been idle the longest
+func admit(c *Conn) bool {
+	limit, ok := ConfKey("player_limit").(int)
+	if !ok {
+		return true
+	}
+
+	reserved, _ := ConfKey("reserved_slots").(int)
+
+	// ConnCount includes c
+	others := ConnCount() - 1
+	if others < limit-reserved {
+		return true
+	}
+
+	privileged, err := c.CheckPrivs(map[string]bool{reservedPriv(): true})
+	if err != nil || !privileged {
+		return false
+	}
+
+	if others < limit {
+		return true
+	}
+
+	if kick, ok := ConfKey("kick_idle_for_reserved").(bool); !ok || !kick {
+		return false
+	}
+
+	idle := longestIdle()
+	if idle == nil {
+		return false
+	}
+
+	LogInfo(idle.LogFields(), "Kicking ", idle.Username(), " to make room for ", c.Username())
+	idle.CloseWith(AccessDeniedCustomString, "The server is full, you have been kicked to make room for another player.", true)
+
+	return true
+}
@@ -40,7 +40,7 @@ func SetStorageKey(key, value string) error {
 	defer db.Close()
 
 	if value == "" {
-		_, err = db.Exec(`DELETE FROM storage WHERE key = ?;`)
+		_, err = db.Exec(`DELETE FROM storage WHERE key = ?;`, key)
 	} else {
 		_, err = db.Exec(`REPLACE INTO storage (
 			key,
@@ -0,0 +1,1311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// ToCltHello is the answer to ToSrvInit
+type ToCltHello struct {
+	SerializeVer uint8
+	Compression  uint16
+	ProtoVer     uint16
+	AuthMechs    uint32
+	Username     string
+}
+
+func (*ToCltHello) CmdNo() uint16 { return ToClientHello }
+
+func (cmd *ToCltHello) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint8(w, cmd.SerializeVer)
+	WriteUint16(w, cmd.Compression)
+	WriteUint16(w, cmd.ProtoVer)
+	WriteUint32(w, cmd.AuthMechs)
+	WriteBytes16(w, []byte(cmd.Username))
+}
+
+func (cmd *ToCltHello) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.SerializeVer = r.Uint8()
+	cmd.Compression = r.Uint16()
+	cmd.ProtoVer = r.Uint16()
+	cmd.AuthMechs = r.Uint32()
+	cmd.Username = string(r.Bytes16())
+}
+
+// ToCltAuthAccept tells the client that it has been authenticated
+type ToCltAuthAccept struct {
+	PlayerPos       [3]float32
+	MapSeed         uint64
+	SendInterval    float32
+	SudoAuthMethods uint32
+}
+
+func (*ToCltAuthAccept) CmdNo() uint16 { return ToClientAuthAccept }
+
+func (cmd *ToCltAuthAccept) Marshal(w *bytes.Buffer, proto uint16) {
+	writeVec(w, cmd.PlayerPos[:]...)
+	WriteUint64(w, cmd.MapSeed)
+	WriteFloat32(w, cmd.SendInterval)
+	WriteUint32(w, cmd.SudoAuthMethods)
+}
+
+func (cmd *ToCltAuthAccept) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.PlayerPos = r.Vec3()
+	cmd.MapSeed = r.Uint64()
+	cmd.SendInterval = r.Float32()
+	cmd.SudoAuthMethods = r.Uint32()
+}
+
+// ToCltAcceptSudoMode confirms the password of a client in sudo mode
+type ToCltAcceptSudoMode struct{}
+
+func (*ToCltAcceptSudoMode) CmdNo() uint16                         { return ToClientAcceptSudoMode }
+func (*ToCltAcceptSudoMode) Marshal(w *bytes.Buffer, proto uint16) {}
+func (*ToCltAcceptSudoMode) Unmarshal(r *CmdReader, proto uint16)  {}
+
+// ToCltDenySudoMode rejects the password of a client in sudo mode
+type ToCltDenySudoMode struct{}
+
+func (*ToCltDenySudoMode) CmdNo() uint16                         { return ToClientDenySudoMode }
+func (*ToCltDenySudoMode) Marshal(w *bytes.Buffer, proto uint16) {}
+func (*ToCltDenySudoMode) Unmarshal(r *CmdReader, proto uint16)  {}
+
+// ToCltAccessDenied kicks the client
+type ToCltAccessDenied struct {
+	Reason    uint8
+	Custom    string
+	Reconnect bool
+}
+
+func (*ToCltAccessDenied) CmdNo() uint16 { return ToClientAccessDenied }
+
+func (cmd *ToCltAccessDenied) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint8(w, cmd.Reason)
+	WriteBytes16(w, []byte(cmd.Custom))
+	writeBool(w, cmd.Reconnect)
+}
+
+func (cmd *ToCltAccessDenied) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Reason = r.Uint8()
+	if r.Len() == 0 {
+		return
+	}
+
+	cmd.Custom = string(r.Bytes16())
+	if r.Len() > 0 {
+		cmd.Reconnect = r.Bool()
+	}
+}
+
+// A MapBlk is a MapBlock serialized for the network
+// Only the nodes are decoded, the node metadata
+// and everything after it is kept as it is in Rest
+type MapBlk struct {
+	Flags            uint8
+	LightingComplete uint16
+	Param0           [NodeCount]uint16
+	Param1           [NodeCount]uint8
+	Param2           [NodeCount]uint8
+	Rest             []byte
+}
+
+func (blk *MapBlk) marshal(w *bytes.Buffer) {
+	WriteUint8(w, blk.Flags)
+	WriteUint16(w, blk.LightingComplete)
+
+	// Content and param width
+	WriteUint8(w, 2)
+	WriteUint8(w, 2)
+
+	nodes := &bytes.Buffer{}
+	for _, id := range blk.Param0 {
+		WriteUint16(nodes, id)
+	}
+	nodes.Write(blk.Param1[:])
+	nodes.Write(blk.Param2[:])
+
+	writeZlib(w, nodes.Bytes())
+	w.Write(blk.Rest)
+}
+
+func (blk *MapBlk) unmarshal(r *CmdReader) {
+	blk.Flags = r.Uint8()
+	blk.LightingComplete = r.Uint16()
+
+	if cw, pw := r.Uint8(), r.Uint8(); r.Err() == nil && (cw != 2 || pw != 2) {
+		r.fail(fmt.Errorf("unsupported content width %d and param width %d", cw, pw))
+	}
+
+	nodes := r.Zlib()
+	if r.Err() == nil && len(nodes) != 4*NodeCount {
+		r.fail(fmt.Errorf("MapBlock contains %d bytes of nodes", len(nodes)))
+	}
+
+	if r.Err() != nil {
+		return
+	}
+
+	for i := range blk.Param0 {
+		blk.Param0[i] = binary.BigEndian.Uint16(nodes[2*i:])
+	}
+	copy(blk.Param1[:], nodes[2*NodeCount:])
+	copy(blk.Param2[:], nodes[3*NodeCount:])
+
+	blk.Rest = r.Rest()
+}
+
+// ToCltBlkData sends a MapBlock
+type ToCltBlkData struct {
+	Pos [3]int16
+	Blk MapBlk
+}
+
+func (*ToCltBlkData) CmdNo() uint16 { return ToClientBlockdata }
+
+func (cmd *ToCltBlkData) Marshal(w *bytes.Buffer, proto uint16) {
+	writePos(w, cmd.Pos)
+	cmd.Blk.marshal(w)
+}
+
+func (cmd *ToCltBlkData) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Pos = r.Pos()
+	cmd.Blk.unmarshal(r)
+}
+
+// A MapNode is a node of a MapBlock
+type MapNode struct {
+	Param0 uint16
+	Param1 uint8
+	Param2 uint8
+}
+
+// ToCltAddNode places a node
+type ToCltAddNode struct {
+	Pos      [3]int16
+	Node     MapNode
+	KeepMeta bool
+}
+
+func (*ToCltAddNode) CmdNo() uint16 { return ToClientAddNode }
+
+func (cmd *ToCltAddNode) Marshal(w *bytes.Buffer, proto uint16) {
+	writePos(w, cmd.Pos)
+	WriteUint16(w, cmd.Node.Param0)
+	WriteUint8(w, cmd.Node.Param1)
+	WriteUint8(w, cmd.Node.Param2)
+	writeBool(w, cmd.KeepMeta)
+}
+
+func (cmd *ToCltAddNode) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Pos = r.Pos()
+	cmd.Node.Param0 = r.Uint16()
+	cmd.Node.Param1 = r.Uint8()
+	cmd.Node.Param2 = r.Uint8()
+	if r.Len() > 0 {
+		cmd.KeepMeta = r.Bool()
+	}
+}
+
+// ToCltMediaPush sends a file to clients that are already playing
+// Since Proto40 the client requests the file using the Token
+type ToCltMediaPush struct {
+	Digest []byte
+	Name   string
+	Cache  bool
+	Token  uint32
+	Data   []byte
+}
+
+func (*ToCltMediaPush) CmdNo() uint16 { return ToClientMediaPush }
+
+func (cmd *ToCltMediaPush) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteBytes16(w, cmd.Digest)
+	WriteBytes16(w, []byte(cmd.Name))
+	writeBool(w, cmd.Cache)
+
+	if proto >= Proto40 {
+		WriteUint32(w, cmd.Token)
+	} else {
+		WriteBytes32(w, cmd.Data)
+	}
+}
+
+func (cmd *ToCltMediaPush) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Digest = r.Bytes16()
+	cmd.Name = string(r.Bytes16())
+	cmd.Cache = r.Bool()
+
+	if proto >= Proto40 {
+		cmd.Token = r.Uint32()
+	} else {
+		cmd.Data = r.Bytes32()
+	}
+}
+
+// An AOAdd is an active object added by ToCltAORmAdd
+type AOAdd struct {
+	ID       uint16
+	Type     uint8
+	InitData []byte
+}
+
+// ToCltAORmAdd removes and adds active objects
+type ToCltAORmAdd struct {
+	Remove []uint16
+	Add    []AOAdd
+}
+
+func (*ToCltAORmAdd) CmdNo() uint16 { return ToClientActiveObjectRemoveAdd }
+
+func (cmd *ToCltAORmAdd) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint16(w, uint16(len(cmd.Remove)))
+	for _, id := range cmd.Remove {
+		WriteUint16(w, id)
+	}
+
+	WriteUint16(w, uint16(len(cmd.Add)))
+	for _, ao := range cmd.Add {
+		WriteUint16(w, ao.ID)
+		WriteUint8(w, ao.Type)
+		WriteBytes32(w, ao.InitData)
+	}
+}
+
+func (cmd *ToCltAORmAdd) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Remove = make([]uint16, r.Uint16())
+	for i := range cmd.Remove {
+		cmd.Remove[i] = r.Uint16()
+	}
+
+	n := r.Uint16()
+	for i := uint16(0); i < n && r.Err() == nil; i++ {
+		cmd.Add = append(cmd.Add, AOAdd{
+			ID:       r.Uint16(),
+			Type:     r.Uint8(),
+			InitData: r.Bytes32(),
+		})
+	}
+}
+
+// An AOMsg is a message to an active object
+type AOMsg struct {
+	ID  uint16
+	Msg []byte
+}
+
+// ToCltAOMsgs sends messages to active objects
+type ToCltAOMsgs struct {
+	Msgs []AOMsg
+}
+
+func (*ToCltAOMsgs) CmdNo() uint16 { return ToClientActiveObjectMessages }
+
+func (cmd *ToCltAOMsgs) Marshal(w *bytes.Buffer, proto uint16) {
+	for _, msg := range cmd.Msgs {
+		WriteUint16(w, msg.ID)
+		WriteBytes16(w, msg.Msg)
+	}
+}
+
+func (cmd *ToCltAOMsgs) Unmarshal(r *CmdReader, proto uint16) {
+	for r.Len() >= 4 && r.Err() == nil {
+		cmd.Msgs = append(cmd.Msgs, AOMsg{
+			ID:  r.Uint16(),
+			Msg: r.Bytes16(),
+		})
+	}
+}
+
+// ToCltPlaySound starts a sound
+type ToCltPlaySound struct {
+	ID        int32
+	Name      string
+	Gain      float32
+	SrcType   uint8
+	Pos       [3]float32
+	SrcAOID   uint16
+	Loop      bool
+	Fade      float32
+	Pitch     float32
+	Ephemeral bool
+}
+
+func (*ToCltPlaySound) CmdNo() uint16 { return ToClientPlaySound }
+
+func (cmd *ToCltPlaySound) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint32(w, uint32(cmd.ID))
+	WriteBytes16(w, []byte(cmd.Name))
+	WriteFloat32(w, cmd.Gain)
+	WriteUint8(w, cmd.SrcType)
+	writeVec(w, cmd.Pos[:]...)
+	WriteUint16(w, cmd.SrcAOID)
+	writeBool(w, cmd.Loop)
+	WriteFloat32(w, cmd.Fade)
+	WriteFloat32(w, cmd.Pitch)
+	writeBool(w, cmd.Ephemeral)
+}
+
+func (cmd *ToCltPlaySound) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.ID = int32(r.Uint32())
+	cmd.Name = string(r.Bytes16())
+	cmd.Gain = r.Float32()
+	cmd.SrcType = r.Uint8()
+	cmd.Pos = r.Vec3()
+	cmd.SrcAOID = r.Uint16()
+	cmd.Loop = r.Bool()
+	cmd.Fade = r.Float32()
+	cmd.Pitch = r.Float32()
+	if r.Len() > 0 {
+		cmd.Ephemeral = r.Bool()
+	}
+}
+
+// ToCltStopSound stops a sound
+type ToCltStopSound struct {
+	ID int32
+}
+
+func (*ToCltStopSound) CmdNo() uint16 { return ToClientStopSound }
+
+func (cmd *ToCltStopSound) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint32(w, uint32(cmd.ID))
+}
+
+func (cmd *ToCltStopSound) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.ID = int32(r.Uint32())
+}
+
+// ToCltAddParticleSpawner adds a particle spawner
+// Only the fields up to the attached active object are decoded,
+// everything after them is kept as it is in Rest
+type ToCltAddParticleSpawner struct {
+	Amount      uint16
+	Duration    float32
+	Pos         [2][3]float32
+	Vel         [2][3]float32
+	Acc         [2][3]float32
+	ExpTime     [2]float32
+	Size        [2]float32
+	Collide     bool
+	Texture     string
+	ID          uint32
+	Vertical    bool
+	CollisionRm bool
+	AttachedAO  uint16
+	Rest        []byte
+}
+
+func (*ToCltAddParticleSpawner) CmdNo() uint16 { return ToClientAddParticleSpawner }
+
+func (cmd *ToCltAddParticleSpawner) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint16(w, cmd.Amount)
+	WriteFloat32(w, cmd.Duration)
+	for _, v := range [][2][3]float32{cmd.Pos, cmd.Vel, cmd.Acc} {
+		writeVec(w, v[0][:]...)
+		writeVec(w, v[1][:]...)
+	}
+	writeVec(w, cmd.ExpTime[:]...)
+	writeVec(w, cmd.Size[:]...)
+	writeBool(w, cmd.Collide)
+	WriteBytes32(w, []byte(cmd.Texture))
+	WriteUint32(w, cmd.ID)
+	writeBool(w, cmd.Vertical)
+	writeBool(w, cmd.CollisionRm)
+	WriteUint16(w, cmd.AttachedAO)
+	w.Write(cmd.Rest)
+}
+
+func (cmd *ToCltAddParticleSpawner) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Amount = r.Uint16()
+	cmd.Duration = r.Float32()
+	for _, v := range []*[2][3]float32{&cmd.Pos, &cmd.Vel, &cmd.Acc} {
+		v[0] = r.Vec3()
+		v[1] = r.Vec3()
+	}
+	cmd.ExpTime = r.Vec2()
+	cmd.Size = r.Vec2()
+	cmd.Collide = r.Bool()
+	cmd.Texture = string(r.Bytes32())
+	cmd.ID = r.Uint32()
+	cmd.Vertical = r.Bool()
+	cmd.CollisionRm = r.Bool()
+	cmd.AttachedAO = r.Uint16()
+	cmd.Rest = r.Rest()
+}
+
+// ToCltHUDAdd adds a HUD element
+// Style is sent since Proto40
+type ToCltHUDAdd struct {
+	ID       uint32
+	Type     uint8
+	Pos      [2]float32
+	Name     string
+	Scale    [2]float32
+	Text     string
+	Number   uint32
+	Item     uint32
+	Dir      uint32
+	Align    [2]float32
+	Offset   [2]float32
+	WorldPos [3]float32
+	Size     [2]int32
+	ZIndex   int16
+	Text2    string
+	Style    uint32
+}
+
+func (*ToCltHUDAdd) CmdNo() uint16 { return ToClientHudAdd }
+
+func (cmd *ToCltHUDAdd) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint32(w, cmd.ID)
+	WriteUint8(w, cmd.Type)
+	writeVec(w, cmd.Pos[:]...)
+	WriteBytes16(w, []byte(cmd.Name))
+	writeVec(w, cmd.Scale[:]...)
+	WriteBytes16(w, []byte(cmd.Text))
+	WriteUint32(w, cmd.Number)
+	WriteUint32(w, cmd.Item)
+	WriteUint32(w, cmd.Dir)
+	writeVec(w, cmd.Align[:]...)
+	writeVec(w, cmd.Offset[:]...)
+	writeVec(w, cmd.WorldPos[:]...)
+	WriteUint32(w, uint32(cmd.Size[0]))
+	WriteUint32(w, uint32(cmd.Size[1]))
+	WriteUint16(w, uint16(cmd.ZIndex))
+	WriteBytes16(w, []byte(cmd.Text2))
+
+	if proto >= Proto40 {
+		WriteUint32(w, cmd.Style)
+	}
+}
+
+func (cmd *ToCltHUDAdd) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.ID = r.Uint32()
+	cmd.Type = r.Uint8()
+	cmd.Pos = r.Vec2()
+	cmd.Name = string(r.Bytes16())
+	cmd.Scale = r.Vec2()
+	cmd.Text = string(r.Bytes16())
+	cmd.Number = r.Uint32()
+	cmd.Item = r.Uint32()
+	cmd.Dir = r.Uint32()
+	cmd.Align = r.Vec2()
+	cmd.Offset = r.Vec2()
+	cmd.WorldPos = r.Vec3()
+	cmd.Size = [2]int32{int32(r.Uint32()), int32(r.Uint32())}
+	cmd.ZIndex = int16(r.Uint16())
+	cmd.Text2 = string(r.Bytes16())
+
+	if proto >= Proto40 && r.Len() >= 4 {
+		cmd.Style = r.Uint32()
+	}
+}
+
+// ToCltRmHUD removes a HUD element
+type ToCltRmHUD struct {
+	ID uint32
+}
+
+func (*ToCltRmHUD) CmdNo() uint16 { return ToClientHudRM }
+
+func (cmd *ToCltRmHUD) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint32(w, cmd.ID)
+}
+
+func (cmd *ToCltRmHUD) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.ID = r.Uint32()
+}
+
+// ToCltChangeHUD changes a field of a HUD element
+// Only the text fields are decoded, the values of the others
+// are kept as they are in Data
+type ToCltChangeHUD struct {
+	ID   uint32
+	Stat uint8
+	Text string
+	Data []byte
+}
+
+// HUD fields that contain text
+const (
+	HudStatName  = 1
+	HudStatText  = 3
+	HudStatText2 = 12
+)
+
+func (*ToCltChangeHUD) CmdNo() uint16 { return ToClientHudChange }
+
+func (cmd *ToCltChangeHUD) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint32(w, cmd.ID)
+	WriteUint8(w, cmd.Stat)
+
+	switch cmd.Stat {
+	case HudStatName, HudStatText, HudStatText2:
+		WriteBytes16(w, []byte(cmd.Text))
+	default:
+		w.Write(cmd.Data)
+	}
+}
+
+func (cmd *ToCltChangeHUD) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.ID = r.Uint32()
+	cmd.Stat = r.Uint8()
+
+	switch cmd.Stat {
+	case HudStatName, HudStatText, HudStatText2:
+		cmd.Text = string(r.Bytes16())
+	default:
+		cmd.Data = r.Rest()
+	}
+}
+
+// HUD parameters
+const (
+	HudParamHotbarItemCount = 1 + iota
+	HudParamHotbarImg
+	HudParamHotbarSelImg
+)
+
+// ToCltHUDSetParam changes a parameter of the builtin HUD
+type ToCltHUDSetParam struct {
+	Param uint16
+	Value []byte
+}
+
+func (*ToCltHUDSetParam) CmdNo() uint16 { return ToClientHudSetParam }
+
+func (cmd *ToCltHUDSetParam) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint16(w, cmd.Param)
+	WriteBytes16(w, cmd.Value)
+}
+
+func (cmd *ToCltHUDSetParam) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Param = r.Uint16()
+	cmd.Value = r.Bytes16()
+}
+
+// ToCltModChanSig signals a change of a mod channel
+// State is only sent with ModChSigSetState
+type ToCltModChanSig struct {
+	Signal  uint8
+	Channel string
+	State   uint8
+}
+
+func (*ToCltModChanSig) CmdNo() uint16 { return ToClientModChannelSignal }
+
+func (cmd *ToCltModChanSig) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint8(w, cmd.Signal)
+	WriteBytes16(w, []byte(cmd.Channel))
+	if cmd.Signal == ModChSigSetState {
+		WriteUint8(w, cmd.State)
+	}
+}
+
+func (cmd *ToCltModChanSig) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Signal = r.Uint8()
+	cmd.Channel = string(r.Bytes16())
+	if r.Len() > 0 {
+		cmd.State = r.Uint8()
+	}
+}
+
+// ToCltSRPBytesSaltB is the answer to ToSrvSRPBytesA
+type ToCltSRPBytesSaltB struct {
+	Salt []byte
+	B    []byte
+}
+
+func (*ToCltSRPBytesSaltB) CmdNo() uint16 { return ToClientSrpBytesSB }
+
+func (cmd *ToCltSRPBytesSaltB) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteBytes16(w, cmd.Salt)
+	WriteBytes16(w, cmd.B)
+}
+
+func (cmd *ToCltSRPBytesSaltB) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Salt = r.Bytes16()
+	cmd.B = r.Bytes16()
+}
+
+// ToCltFormspecPrepend sets the formspec elements
+// prepended to every formspec
+type ToCltFormspecPrepend struct {
+	Prepend string
+}
+
+func (*ToCltFormspecPrepend) CmdNo() uint16 { return ToClientFormspecPrepend }
+
+func (cmd *ToCltFormspecPrepend) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteBytes16(w, []byte(cmd.Prepend))
+}
+
+func (cmd *ToCltFormspecPrepend) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Prepend = string(r.Bytes16())
+}
+
+// Chat message types
+const (
+	ChatMsgRaw = iota
+	ChatMsgNormal
+	ChatMsgAnnounce
+	ChatMsgSystem
+)
+
+// ToCltChatMsg sends a chat message
+type ToCltChatMsg struct {
+	Type      uint8
+	Sender    string
+	Text      string
+	Timestamp int64
+}
+
+func (*ToCltChatMsg) CmdNo() uint16 { return ToClientChatMessage }
+
+func (cmd *ToCltChatMsg) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint8(w, 1) // version
+	WriteUint8(w, cmd.Type)
+	writeWStr16(w, cmd.Sender)
+	writeWStr16(w, cmd.Text)
+	WriteUint64(w, uint64(cmd.Timestamp))
+}
+
+func (cmd *ToCltChatMsg) Unmarshal(r *CmdReader, proto uint16) {
+	r.Uint8() // version
+	cmd.Type = r.Uint8()
+	cmd.Sender = r.WStr16()
+	cmd.Text = r.WStr16()
+	cmd.Timestamp = int64(r.Uint64())
+}
+
+// A MediaFile is a file sent by ToCltMedia
+type MediaFile struct {
+	Name string
+	Data []byte
+}
+
+// ToCltMedia sends one of the bunches of requested files
+type ToCltMedia struct {
+	Bunches uint16
+	Bunch   uint16
+	Files   []MediaFile
+}
+
+func (*ToCltMedia) CmdNo() uint16 { return ToClientMedia }
+
+func (cmd *ToCltMedia) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint16(w, cmd.Bunches)
+	WriteUint16(w, cmd.Bunch)
+	WriteUint32(w, uint32(len(cmd.Files)))
+	for _, f := range cmd.Files {
+		WriteBytes16(w, []byte(f.Name))
+		WriteBytes32(w, f.Data)
+	}
+}
+
+func (cmd *ToCltMedia) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Bunches = r.Uint16()
+	cmd.Bunch = r.Uint16()
+
+	n := r.Uint32()
+	for i := uint32(0); i < n && r.Err() == nil; i++ {
+		cmd.Files = append(cmd.Files, MediaFile{
+			Name: string(r.Bytes16()),
+			Data: r.Bytes32(),
+		})
+	}
+}
+
+// ToCltShowFormspec shows a formspec, an empty one
+// closes the formspec with the same name
+type ToCltShowFormspec struct {
+	Formspec string
+	Name     string
+}
+
+func (*ToCltShowFormspec) CmdNo() uint16 { return ToClientShowFormspec }
+
+func (cmd *ToCltShowFormspec) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteBytes32(w, []byte(cmd.Formspec))
+	WriteBytes16(w, []byte(cmd.Name))
+}
+
+func (cmd *ToCltShowFormspec) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Formspec = string(r.Bytes32())
+	cmd.Name = string(r.Bytes16())
+}
+
+// ToCltInvFormspec sets the formspec of the inventory
+type ToCltInvFormspec struct {
+	Formspec string
+}
+
+func (*ToCltInvFormspec) CmdNo() uint16 { return ToClientInventoryFormspec }
+
+func (cmd *ToCltInvFormspec) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteBytes32(w, []byte(cmd.Formspec))
+}
+
+func (cmd *ToCltInvFormspec) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Formspec = string(r.Bytes32())
+}
+
+// ToCltFOV overrides the field of view, 0 restores the default
+type ToCltFOV struct {
+	FOV            float32
+	Multiplier     bool
+	TransitionTime float32
+}
+
+func (*ToCltFOV) CmdNo() uint16 { return ToClientFOV }
+
+func (cmd *ToCltFOV) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteFloat32(w, cmd.FOV)
+	writeBool(w, cmd.Multiplier)
+	WriteFloat32(w, cmd.TransitionTime)
+}
+
+func (cmd *ToCltFOV) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.FOV = r.Float32()
+	cmd.Multiplier = r.Bool()
+	if r.Len() >= 4 {
+		cmd.TransitionTime = r.Float32()
+	}
+}
+
+// ToCltBreath sets the breath of the player
+type ToCltBreath struct {
+	Breath uint16
+}
+
+func (*ToCltBreath) CmdNo() uint16 { return ToClientBreath }
+
+func (cmd *ToCltBreath) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint16(w, cmd.Breath)
+}
+
+func (cmd *ToCltBreath) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Breath = r.Uint16()
+}
+
+// ToCltLocalPlayerAnim sets the animations of the player model
+// in third person view, zero frame ranges use the defaults
+type ToCltLocalPlayerAnim struct {
+	Idle, Walk, Dig, WalkDig [2]int32
+	Speed                    float32
+}
+
+func (*ToCltLocalPlayerAnim) CmdNo() uint16 { return ToClientLocalPlayerAnimations }
+
+func (cmd *ToCltLocalPlayerAnim) Marshal(w *bytes.Buffer, proto uint16) {
+	for _, frames := range [][2]int32{cmd.Idle, cmd.Walk, cmd.Dig, cmd.WalkDig} {
+		WriteUint32(w, uint32(frames[0]))
+		WriteUint32(w, uint32(frames[1]))
+	}
+	WriteFloat32(w, cmd.Speed)
+}
+
+func (cmd *ToCltLocalPlayerAnim) Unmarshal(r *CmdReader, proto uint16) {
+	for _, frames := range []*[2]int32{&cmd.Idle, &cmd.Walk, &cmd.Dig, &cmd.WalkDig} {
+		frames[0] = int32(r.Uint32())
+		frames[1] = int32(r.Uint32())
+	}
+	cmd.Speed = r.Float32()
+}
+
+// A MinimapMode is a mode the player can switch the minimap to
+type MinimapMode struct {
+	Type    uint16
+	Label   string
+	Size    uint16
+	Texture string
+	Scale   uint16
+}
+
+// ToCltMinimapModes sets the available minimap modes
+type ToCltMinimapModes struct {
+	Current uint16
+	Modes   []MinimapMode
+}
+
+func (*ToCltMinimapModes) CmdNo() uint16 { return ToClientMinimapModes }
+
+func (cmd *ToCltMinimapModes) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint16(w, uint16(len(cmd.Modes)))
+	WriteUint16(w, cmd.Current)
+	for _, mode := range cmd.Modes {
+		WriteUint16(w, mode.Type)
+		WriteBytes16(w, []byte(mode.Label))
+		WriteUint16(w, mode.Size)
+		WriteBytes16(w, []byte(mode.Texture))
+		WriteUint16(w, mode.Scale)
+	}
+}
+
+func (cmd *ToCltMinimapModes) Unmarshal(r *CmdReader, proto uint16) {
+	n := r.Uint16()
+	cmd.Current = r.Uint16()
+	for i := uint16(0); i < n && r.Err() == nil; i++ {
+		cmd.Modes = append(cmd.Modes, MinimapMode{
+			Type:    r.Uint16(),
+			Label:   string(r.Bytes16()),
+			Size:    r.Uint16(),
+			Texture: string(r.Bytes16()),
+			Scale:   r.Uint16(),
+		})
+	}
+}
+
+// ToCltHUDSetFlags shows or hides the builtin HUD elements
+// whose bits are set in Mask
+type ToCltHUDSetFlags struct {
+	Flags uint32
+	Mask  uint32
+}
+
+func (*ToCltHUDSetFlags) CmdNo() uint16 { return ToClientHudSetFlags }
+
+func (cmd *ToCltHUDSetFlags) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint32(w, cmd.Flags)
+	WriteUint32(w, cmd.Mask)
+}
+
+func (cmd *ToCltHUDSetFlags) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Flags = r.Uint32()
+	cmd.Mask = r.Uint32()
+}
+
+// ToCltOverrideDayNightRatio overrides the brightness
+// of the time of day
+type ToCltOverrideDayNightRatio struct {
+	Override bool
+	Ratio    uint16
+}
+
+func (*ToCltOverrideDayNightRatio) CmdNo() uint16 { return ToClientOverrideDayNightRatio }
+
+func (cmd *ToCltOverrideDayNightRatio) Marshal(w *bytes.Buffer, proto uint16) {
+	writeBool(w, cmd.Override)
+	WriteUint16(w, cmd.Ratio)
+}
+
+func (cmd *ToCltOverrideDayNightRatio) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Override = r.Bool()
+	cmd.Ratio = r.Uint16()
+}
+
+// ToCltEyeOffset moves the camera in first and third person view
+type ToCltEyeOffset struct {
+	First [3]float32
+	Third [3]float32
+}
+
+func (*ToCltEyeOffset) CmdNo() uint16 { return ToClientEyeOffset }
+
+func (cmd *ToCltEyeOffset) Marshal(w *bytes.Buffer, proto uint16) {
+	writeVec(w, cmd.First[:]...)
+	writeVec(w, cmd.Third[:]...)
+}
+
+func (cmd *ToCltEyeOffset) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.First = r.Vec3()
+	cmd.Third = r.Vec3()
+}
+
+// DefaultSkyColors are the colors of the regular sky
+// used by the client if the server doesn't set any:
+// day sky and horizon, dawn sky and horizon,
+// night sky and horizon and indoors
+var DefaultSkyColors = [7]Color{
+	{255, 97, 181, 245},
+	{255, 144, 211, 245},
+	{255, 180, 186, 250},
+	{255, 186, 193, 240},
+	{255, 0, 107, 255},
+	{255, 64, 144, 255},
+	{255, 100, 100, 100},
+}
+
+// ToCltSetSky sets the sky
+// Before Proto39 the sky only has a background color, a type,
+// the textures and the clouds, the defaults of the other fields
+// are used when decoding that layout. Colors is only sent
+// with the "regular" type and Textures with the "skybox" type
+// The fog settings are sent since Proto42, -1 lets the client choose
+type ToCltSetSky struct {
+	BgColor     Color
+	Type        string
+	Clouds      bool
+	SunFogTint  Color
+	MoonFogTint Color
+	FogTintType string
+	Textures    []string
+	Colors      [7]Color
+	FogDistance int16
+	FogStart    float32
+}
+
+func (*ToCltSetSky) CmdNo() uint16 { return ToClientSetSky }
+
+func (cmd *ToCltSetSky) Marshal(w *bytes.Buffer, proto uint16) {
+	w.Write(cmd.BgColor[:])
+	WriteBytes16(w, []byte(cmd.Type))
+
+	if proto < Proto39 {
+		cmd.marshalTextures(w)
+		writeBool(w, cmd.Clouds)
+		return
+	}
+
+	writeBool(w, cmd.Clouds)
+	w.Write(cmd.SunFogTint[:])
+	w.Write(cmd.MoonFogTint[:])
+	WriteBytes16(w, []byte(cmd.FogTintType))
+
+	switch cmd.Type {
+	case "skybox":
+		cmd.marshalTextures(w)
+	case "regular":
+		for _, c := range cmd.Colors {
+			w.Write(c[:])
+		}
+	}
+
+	if proto >= Proto42 {
+		WriteUint16(w, uint16(cmd.FogDistance))
+		WriteFloat32(w, cmd.FogStart)
+	}
+}
+
+func (cmd *ToCltSetSky) marshalTextures(w *bytes.Buffer) {
+	if cmd.Type != "skybox" {
+		WriteUint16(w, 0)
+		return
+	}
+
+	WriteUint16(w, uint16(len(cmd.Textures)))
+	for _, tex := range cmd.Textures {
+		WriteBytes16(w, []byte(tex))
+	}
+}
+
+func (cmd *ToCltSetSky) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.BgColor = r.Color()
+	cmd.Type = string(r.Bytes16())
+
+	cmd.FogDistance = -1
+	cmd.FogStart = -1
+
+	if proto < Proto39 {
+		textures := cmd.unmarshalTextures(r)
+		if cmd.Type == "skybox" {
+			cmd.Textures = textures
+		}
+
+		cmd.Clouds = true
+		if r.Len() > 0 {
+			cmd.Clouds = r.Bool()
+		}
+
+		cmd.SunFogTint = Color{255, 255, 255, 255}
+		cmd.MoonFogTint = Color{255, 255, 255, 255}
+		cmd.FogTintType = "default"
+		if cmd.Type == "regular" {
+			cmd.Colors = DefaultSkyColors
+		}
+
+		return
+	}
+
+	cmd.Clouds = r.Bool()
+	cmd.SunFogTint = r.Color()
+	cmd.MoonFogTint = r.Color()
+	cmd.FogTintType = string(r.Bytes16())
+
+	switch cmd.Type {
+	case "skybox":
+		cmd.Textures = cmd.unmarshalTextures(r)
+	case "regular":
+		for i := range cmd.Colors {
+			cmd.Colors[i] = r.Color()
+		}
+	}
+
+	if proto >= Proto42 && r.Len() >= 6 {
+		cmd.FogDistance = int16(r.Uint16())
+		cmd.FogStart = r.Float32()
+	}
+}
+
+func (cmd *ToCltSetSky) unmarshalTextures(r *CmdReader) []string {
+	var textures []string
+
+	n := r.Uint16()
+	for i := uint16(0); i < n && r.Err() == nil; i++ {
+		textures = append(textures, string(r.Bytes16()))
+	}
+
+	return textures
+}
+
+// ToCltSetSun sets the sun, it is sent since Proto39
+type ToCltSetSun struct {
+	Visible        bool
+	Texture        string
+	ToneMap        string
+	Sunrise        string
+	SunriseVisible bool
+	Scale          float32
+}
+
+func (*ToCltSetSun) CmdNo() uint16 { return ToClientSetSun }
+
+func (cmd *ToCltSetSun) Marshal(w *bytes.Buffer, proto uint16) {
+	writeBool(w, cmd.Visible)
+	WriteBytes16(w, []byte(cmd.Texture))
+	WriteBytes16(w, []byte(cmd.ToneMap))
+	WriteBytes16(w, []byte(cmd.Sunrise))
+	writeBool(w, cmd.SunriseVisible)
+	WriteFloat32(w, cmd.Scale)
+}
+
+func (cmd *ToCltSetSun) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Visible = r.Bool()
+	cmd.Texture = string(r.Bytes16())
+	cmd.ToneMap = string(r.Bytes16())
+	cmd.Sunrise = string(r.Bytes16())
+	cmd.SunriseVisible = r.Bool()
+	cmd.Scale = r.Float32()
+}
+
+// ToCltSetMoon sets the moon, it is sent since Proto39
+type ToCltSetMoon struct {
+	Visible bool
+	Texture string
+	ToneMap string
+	Scale   float32
+}
+
+func (*ToCltSetMoon) CmdNo() uint16 { return ToClientSetMoon }
+
+func (cmd *ToCltSetMoon) Marshal(w *bytes.Buffer, proto uint16) {
+	writeBool(w, cmd.Visible)
+	WriteBytes16(w, []byte(cmd.Texture))
+	WriteBytes16(w, []byte(cmd.ToneMap))
+	WriteFloat32(w, cmd.Scale)
+}
+
+func (cmd *ToCltSetMoon) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Visible = r.Bool()
+	cmd.Texture = string(r.Bytes16())
+	cmd.ToneMap = string(r.Bytes16())
+	cmd.Scale = r.Float32()
+}
+
+// ToCltSetStars sets the stars, it is sent since Proto39
+// Fields added by newer versions are kept as they are in Rest
+type ToCltSetStars struct {
+	Visible bool
+	Count   uint32
+	Color   Color
+	Scale   float32
+	Rest    []byte
+}
+
+func (*ToCltSetStars) CmdNo() uint16 { return ToClientSetStars }
+
+func (cmd *ToCltSetStars) Marshal(w *bytes.Buffer, proto uint16) {
+	writeBool(w, cmd.Visible)
+	WriteUint32(w, cmd.Count)
+	w.Write(cmd.Color[:])
+	WriteFloat32(w, cmd.Scale)
+	w.Write(cmd.Rest)
+}
+
+func (cmd *ToCltSetStars) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Visible = r.Bool()
+	cmd.Count = r.Uint32()
+	cmd.Color = r.Color()
+	cmd.Scale = r.Float32()
+	cmd.Rest = r.Rest()
+}
+
+// ExposureParams configure the automatic exposure of the client
+type ExposureParams struct {
+	LuminanceMin       float32
+	LuminanceMax       float32
+	ExposureCorrection float32
+	SpeedDarkBright    float32
+	SpeedBrightDark    float32
+	CenterWeightPower  float32
+}
+
+// DefaultExposure are the ExposureParams the client uses
+// if the server doesn't set any
+var DefaultExposure = ExposureParams{
+	LuminanceMin:      -3,
+	LuminanceMax:      -3,
+	SpeedDarkBright:   1000,
+	SpeedBrightDark:   1000,
+	CenterWeightPower: 1,
+}
+
+// ToCltSetLighting sets the lighting, it is sent since Proto41
+// Saturation and Exposure are sent since Proto42,
+// the defaults are used when decoding older layouts
+type ToCltSetLighting struct {
+	ShadowIntensity float32
+	Saturation      float32
+	Exposure        ExposureParams
+}
+
+func (*ToCltSetLighting) CmdNo() uint16 { return ToClientSetLighting }
+
+func (cmd *ToCltSetLighting) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteFloat32(w, cmd.ShadowIntensity)
+
+	if proto >= Proto42 {
+		e := cmd.Exposure
+		writeVec(w, cmd.Saturation, e.LuminanceMin, e.LuminanceMax, e.ExposureCorrection,
+			e.SpeedDarkBright, e.SpeedBrightDark, e.CenterWeightPower)
+	}
+}
+
+func (cmd *ToCltSetLighting) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.ShadowIntensity = r.Float32()
+
+	cmd.Saturation = 1
+	cmd.Exposure = DefaultExposure
+
+	if proto >= Proto42 && r.Len() >= 28 {
+		cmd.Saturation = r.Float32()
+		cmd.Exposure = ExposureParams{
+			LuminanceMin:       r.Float32(),
+			LuminanceMax:       r.Float32(),
+			ExposureCorrection: r.Float32(),
+			SpeedDarkBright:    r.Float32(),
+			SpeedBrightDark:    r.Float32(),
+			CenterWeightPower:  r.Float32(),
+		}
+	}
+}
+
+// ToCltCloudParams sets the clouds
+type ToCltCloudParams struct {
+	Density      float32
+	DiffuseColor Color
+	AmbientColor Color
+	Height       float32
+	Thickness    float32
+	Speed        [2]float32
+}
+
+func (*ToCltCloudParams) CmdNo() uint16 { return ToClientCloudParams }
+
+func (cmd *ToCltCloudParams) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteFloat32(w, cmd.Density)
+	w.Write(cmd.DiffuseColor[:])
+	w.Write(cmd.AmbientColor[:])
+	writeVec(w, cmd.Height, cmd.Thickness)
+	writeVec(w, cmd.Speed[:]...)
+}
+
+func (cmd *ToCltCloudParams) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Density = r.Float32()
+	cmd.DiffuseColor = r.Color()
+	cmd.AmbientColor = r.Color()
+	cmd.Height = r.Float32()
+	cmd.Thickness = r.Float32()
+	cmd.Speed = r.Vec2()
+}
+
+// ToCltDeleteParticleSpawner removes a particle spawner
+type ToCltDeleteParticleSpawner struct {
+	ID uint32
+}
+
+func (*ToCltDeleteParticleSpawner) CmdNo() uint16 { return ToClientDeleteParticleSpawner }
+
+func (cmd *ToCltDeleteParticleSpawner) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint32(w, cmd.ID)
+}
+
+func (cmd *ToCltDeleteParticleSpawner) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.ID = r.Uint32()
+}
+
+// Player list update types
+const (
+	PlayerListInit = iota
+	PlayerListAdd
+	PlayerListRemove
+)
+
+// ToCltUpdatePlayerList changes the names the client
+// completes in the chat
+type ToCltUpdatePlayerList struct {
+	Type    uint8
+	Players []string
+}
+
+func (*ToCltUpdatePlayerList) CmdNo() uint16 { return ToClientUpdatePlayerList }
+
+func (cmd *ToCltUpdatePlayerList) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint8(w, cmd.Type)
+	WriteUint16(w, uint16(len(cmd.Players)))
+	for _, name := range cmd.Players {
+		WriteBytes16(w, []byte(name))
+	}
+}
+
+func (cmd *ToCltUpdatePlayerList) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Type = r.Uint8()
+
+	n := r.Uint16()
+	for i := uint16(0); i < n && r.Err() == nil; i++ {
+		cmd.Players = append(cmd.Players, string(r.Bytes16()))
+	}
+}
+
+var toCltCmds = cmdTable(
+	func() Cmd { return &ToCltHello{} },
+	func() Cmd { return &ToCltAuthAccept{} },
+	func() Cmd { return &ToCltAcceptSudoMode{} },
+	func() Cmd { return &ToCltDenySudoMode{} },
+	func() Cmd { return &ToCltAccessDenied{} },
+	func() Cmd { return &ToCltBlkData{} },
+	func() Cmd { return &ToCltAddNode{} },
+	func() Cmd { return &ToCltMediaPush{} },
+	func() Cmd { return &ToCltAORmAdd{} },
+	func() Cmd { return &ToCltAOMsgs{} },
+	func() Cmd { return &ToCltPlaySound{} },
+	func() Cmd { return &ToCltStopSound{} },
+	func() Cmd { return &ToCltAddParticleSpawner{} },
+	func() Cmd { return &ToCltHUDAdd{} },
+	func() Cmd { return &ToCltRmHUD{} },
+	func() Cmd { return &ToCltChangeHUD{} },
+	func() Cmd { return &ToCltHUDSetParam{} },
+	func() Cmd { return &ToCltModChanSig{} },
+	func() Cmd { return &ToCltSRPBytesSaltB{} },
+	func() Cmd { return &ToCltFormspecPrepend{} },
+	func() Cmd { return &ToCltChatMsg{} },
+	func() Cmd { return &ToCltMedia{} },
+	func() Cmd { return &ToCltShowFormspec{} },
+	func() Cmd { return &ToCltInvFormspec{} },
+	func() Cmd { return &ToCltFOV{} },
+	func() Cmd { return &ToCltBreath{} },
+	func() Cmd { return &ToCltLocalPlayerAnim{} },
+	func() Cmd { return &ToCltMinimapModes{} },
+	func() Cmd { return &ToCltHUDSetFlags{} },
+	func() Cmd { return &ToCltOverrideDayNightRatio{} },
+	func() Cmd { return &ToCltEyeOffset{} },
+	func() Cmd { return &ToCltSetSky{} },
+	func() Cmd { return &ToCltSetSun{} },
+	func() Cmd { return &ToCltSetMoon{} },
+	func() Cmd { return &ToCltSetStars{} },
+	func() Cmd { return &ToCltSetLighting{} },
+	func() Cmd { return &ToCltCloudParams{} },
+	func() Cmd { return &ToCltDeleteParticleSpawner{} },
+	func() Cmd { return &ToCltUpdatePlayerList{} },
+)
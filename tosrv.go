@@ -0,0 +1,238 @@
+package main
+
+import "bytes"
+
+// ToSrvInit starts the handshake
+type ToSrvInit struct {
+	SerializeVer uint8
+	Compression  uint16
+	MinProtoVer  uint16
+	MaxProtoVer  uint16
+	Username     string
+}
+
+func (*ToSrvInit) CmdNo() uint16 { return ToServerInit }
+
+func (cmd *ToSrvInit) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint8(w, cmd.SerializeVer)
+	WriteUint16(w, cmd.Compression)
+	WriteUint16(w, cmd.MinProtoVer)
+	WriteUint16(w, cmd.MaxProtoVer)
+	WriteBytes16(w, []byte(cmd.Username))
+}
+
+func (cmd *ToSrvInit) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.SerializeVer = r.Uint8()
+	cmd.Compression = r.Uint16()
+	cmd.MinProtoVer = r.Uint16()
+	cmd.MaxProtoVer = r.Uint16()
+	cmd.Username = string(r.Bytes16())
+}
+
+// ToSrvInit2 requests the definitions and media
+type ToSrvInit2 struct {
+	Lang string
+}
+
+func (*ToSrvInit2) CmdNo() uint16 { return ToServerInit2 }
+
+func (cmd *ToSrvInit2) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteBytes16(w, []byte(cmd.Lang))
+}
+
+func (cmd *ToSrvInit2) Unmarshal(r *CmdReader, proto uint16) {
+	if r.Len() > 0 {
+		cmd.Lang = string(r.Bytes16())
+	}
+}
+
+// ToSrvJoinModChan joins a mod channel
+type ToSrvJoinModChan struct {
+	Channel string
+}
+
+func (*ToSrvJoinModChan) CmdNo() uint16 { return ToServerModChannelJoin }
+
+func (cmd *ToSrvJoinModChan) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteBytes16(w, []byte(cmd.Channel))
+}
+
+func (cmd *ToSrvJoinModChan) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Channel = string(r.Bytes16())
+}
+
+// ToSrvLeaveModChan leaves a mod channel
+type ToSrvLeaveModChan struct {
+	Channel string
+}
+
+func (*ToSrvLeaveModChan) CmdNo() uint16 { return ToServerModChannelLeave }
+
+func (cmd *ToSrvLeaveModChan) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteBytes16(w, []byte(cmd.Channel))
+}
+
+func (cmd *ToSrvLeaveModChan) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Channel = string(r.Bytes16())
+}
+
+// ToSrvFirstSRP sets the password of a new player
+// or changes the password of a player in sudo mode
+type ToSrvFirstSRP struct {
+	Salt        []byte
+	Verifier    []byte
+	EmptyPasswd bool
+}
+
+func (*ToSrvFirstSRP) CmdNo() uint16 { return ToServerFirstSRP }
+
+func (cmd *ToSrvFirstSRP) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteBytes16(w, cmd.Salt)
+	WriteBytes16(w, cmd.Verifier)
+	writeBool(w, cmd.EmptyPasswd)
+}
+
+func (cmd *ToSrvFirstSRP) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Salt = r.Bytes16()
+	cmd.Verifier = r.Bytes16()
+	cmd.EmptyPasswd = r.Bool()
+}
+
+// ToSrvSRPBytesA starts the SRP authentication
+type ToSrvSRPBytesA struct {
+	A      []byte
+	NoSHA1 bool
+}
+
+func (*ToSrvSRPBytesA) CmdNo() uint16 { return ToServerSRPBytesA }
+
+func (cmd *ToSrvSRPBytesA) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteBytes16(w, cmd.A)
+	writeBool(w, cmd.NoSHA1)
+}
+
+func (cmd *ToSrvSRPBytesA) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.A = r.Bytes16()
+	if r.Len() > 0 {
+		cmd.NoSHA1 = r.Bool()
+	}
+}
+
+// ToSrvSRPBytesM completes the SRP authentication
+type ToSrvSRPBytesM struct {
+	M []byte
+}
+
+func (*ToSrvSRPBytesM) CmdNo() uint16 { return ToServerSRPBytesM }
+
+func (cmd *ToSrvSRPBytesM) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteBytes16(w, cmd.M)
+}
+
+func (cmd *ToSrvSRPBytesM) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.M = r.Bytes16()
+}
+
+// ToSrvCltReady tells the server that the client
+// has loaded the media and the definitions
+type ToSrvCltReady struct {
+	Major, Minor, Patch uint8
+	Reserved            uint8
+	Version             string
+	Formspec            uint16
+}
+
+func (*ToSrvCltReady) CmdNo() uint16 { return ToServerClientReady }
+
+func (cmd *ToSrvCltReady) Marshal(w *bytes.Buffer, proto uint16) {
+	w.Write([]byte{cmd.Major, cmd.Minor, cmd.Patch, cmd.Reserved})
+	WriteBytes16(w, []byte(cmd.Version))
+	WriteUint16(w, cmd.Formspec)
+}
+
+func (cmd *ToSrvCltReady) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Major = r.Uint8()
+	cmd.Minor = r.Uint8()
+	cmd.Patch = r.Uint8()
+	cmd.Reserved = r.Uint8()
+	cmd.Version = string(r.Bytes16())
+
+	// Clients before formspec version 2 don't send it
+	cmd.Formspec = 1
+	if r.Len() >= 2 {
+		cmd.Formspec = r.Uint16()
+	}
+}
+
+// ToSrvHaveMedia confirms that a client has received
+// the files pushed with the tokens
+type ToSrvHaveMedia struct {
+	Tokens []uint32
+}
+
+func (*ToSrvHaveMedia) CmdNo() uint16 { return ToServerHaveMedia }
+
+func (cmd *ToSrvHaveMedia) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint8(w, uint8(len(cmd.Tokens)))
+	for _, token := range cmd.Tokens {
+		WriteUint32(w, token)
+	}
+}
+
+func (cmd *ToSrvHaveMedia) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Tokens = make([]uint32, r.Uint8())
+	for i := range cmd.Tokens {
+		cmd.Tokens[i] = r.Uint32()
+	}
+}
+
+// ToSrvChatMsg sends a chat message or command
+type ToSrvChatMsg struct {
+	Msg string
+}
+
+func (*ToSrvChatMsg) CmdNo() uint16 { return ToServerChatMessage }
+
+func (cmd *ToSrvChatMsg) Marshal(w *bytes.Buffer, proto uint16) {
+	writeWStr16(w, cmd.Msg)
+}
+
+func (cmd *ToSrvChatMsg) Unmarshal(r *CmdReader, proto uint16) {
+	cmd.Msg = r.WStr16()
+}
+
+// ToSrvReqMedia requests files announced by ToCltAnnounceMedia
+// or pushed by ToCltMediaPush
+type ToSrvReqMedia struct {
+	Files []string
+}
+
+func (*ToSrvReqMedia) CmdNo() uint16 { return ToServerRequestMedia }
+
+func (cmd *ToSrvReqMedia) Marshal(w *bytes.Buffer, proto uint16) {
+	WriteUint16(w, uint16(len(cmd.Files)))
+	for _, name := range cmd.Files {
+		WriteBytes16(w, []byte(name))
+	}
+}
+
+func (cmd *ToSrvReqMedia) Unmarshal(r *CmdReader, proto uint16) {
+	n := r.Uint16()
+	for i := uint16(0); i < n && r.Err() == nil; i++ {
+		cmd.Files = append(cmd.Files, string(r.Bytes16()))
+	}
+}
+
+var toSrvCmds = cmdTable(
+	func() Cmd { return &ToSrvInit{} },
+	func() Cmd { return &ToSrvInit2{} },
+	func() Cmd { return &ToSrvJoinModChan{} },
+	func() Cmd { return &ToSrvLeaveModChan{} },
+	func() Cmd { return &ToSrvFirstSRP{} },
+	func() Cmd { return &ToSrvSRPBytesA{} },
+	func() Cmd { return &ToSrvSRPBytesM{} },
+	func() Cmd { return &ToSrvCltReady{} },
+	func() Cmd { return &ToSrvHaveMedia{} },
+	func() Cmd { return &ToSrvChatMsg{} },
+	func() Cmd { return &ToSrvReqMedia{} },
+)
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+
+	"github.com/anon55555/mt/rudp"
+)
+
+// A translator rewrites the body of a packet from protocol version
+// from to protocol version to. It returns nil if the packet
+// can't be represented in the target version
+type translator func(cmd uint16, r *bytes.Reader, from, to uint16) []byte
+
+// toClientTranslators handle the commands whose layout differs
+// between the protocol version of a server and its client
+var toClientTranslators = map[uint16]translator{
+	ToClientHudAdd:        reencode,
+	ToClientMediaPush:     reencode,
+	ToClientSetSky:        reencode,
+	ToClientSetSun:        since(Proto39),
+	ToClientSetMoon:       since(Proto39),
+	ToClientSetStars:      since(Proto39),
+	ToClientMovePlayerRel: since(Proto40),
+	ToClientSetLighting: func(cmd uint16, r *bytes.Reader, from, to uint16) []byte {
+		if to < Proto41 {
+			return nil
+		}
+		return reencode(cmd, r, from, to)
+	},
+}
+
+// toServerTranslators handle the commands whose layout differs
+// between the protocol version of a client and its server
+var toServerTranslators = map[uint16]translator{
+	ToServerHaveMedia:        since(Proto40),
+	ToServerUpdateClientInfo: since(Proto42),
+}
+
+// reencode decodes a command sent to a client using the layout
+// of the source version and encodes it for the target version
+func reencode(cmd uint16, r *bytes.Reader, from, to uint16) []byte {
+	c := toCltCmds[cmd]()
+	if !decode(c, r, from) {
+		return nil
+	}
+
+	// Older clients expect pushed files themselves instead of a token,
+	// processPktCommand requests them from the server
+	if push, ok := c.(*ToCltMediaPush); ok && from >= Proto40 && to < Proto40 {
+		log.Print("Dropping pushed file ", push.Name, " for a client using protocol version ", to)
+		return nil
+	}
+
+	return EncodeCmd(c, to)
+}
+
+// since returns a translator that drops a command
+// the target version doesn't know
+func since(proto uint16) translator {
+	return func(cmd uint16, r *bytes.Reader, from, to uint16) []byte {
+		if to < proto {
+			return nil
+		}
+		return copyPkt(cmd, r).Bytes()
+	}
+}
+
+func copyPkt(cmd uint16, r *bytes.Reader) *bytes.Buffer {
+	w := &bytes.Buffer{}
+	WriteUint16(w, cmd)
+	io.Copy(w, r)
+	return w
+}
+
+// translate rewrites a packet from src to dst if they use
+// protocol versions with different layouts for its command
+// It returns true if the packet has to be dropped
+func translate(src, dst *Conn, pkt *rudp.Pkt) bool {
+	from, to := src.ProtoVer(), dst.ProtoVer()
+	if from == to || from == 0 || to == 0 {
+		return false
+	}
+
+	data, err := io.ReadAll(pkt.Reader)
+	if err != nil {
+		log.Print(err)
+		return true
+	}
+
+	pkt.Reader = bytes.NewReader(data)
+	if len(data) < 2 {
+		return false
+	}
+
+	translators := toServerTranslators
+	if src.IsSrv() {
+		translators = toClientTranslators
+	}
+
+	r := bytes.NewReader(data)
+	cmd := ReadUint16(r)
+
+	t, ok := translators[cmd]
+	if !ok {
+		return false
+	}
+
+	translated := t(cmd, r, from, to)
+	if translated == nil {
+		return true
+	}
+
+	pkt.Reader = bytes.NewReader(translated)
+	return false
+}
@@ -5,13 +5,9 @@ import (
 	"time"
 )
 
-var uptime time.Time
+var uptime = time.Now()
 
 // Uptime reports how long the program has been running
 func Uptime() float64 {
 	return math.Floor(time.Since(uptime).Seconds())
 }
-
-func init() {
-	uptime = time.Now()
-}
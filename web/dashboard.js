@@ -0,0 +1,146 @@
+"use strict";
+
+const refreshInterval = 5000;
+
+let refreshTimer = null;
+
+async function api(path, options) {
+	const res = await fetch(path, Object.assign({credentials: "same-origin"}, options));
+	const body = await res.json();
+	if (!res.ok) {
+		const err = new Error(body.error || res.statusText);
+		err.status = res.status;
+		throw err;
+	}
+
+	return body;
+}
+
+function cell(text, className) {
+	const td = document.createElement("td");
+	td.textContent = text;
+	if (className) {
+		td.className = className;
+	}
+
+	return td;
+}
+
+function fillTable(id, rows) {
+	const tbody = document.querySelector("#" + id + " tbody");
+	tbody.replaceChildren(...rows.map(cells => {
+		const tr = document.createElement("tr");
+		tr.append(...cells.map(c => typeof c === "object" ? c : cell(c)));
+		return tr;
+	}));
+}
+
+function formatTime(t) {
+	return new Date(t).toLocaleTimeString();
+}
+
+function formatUptime(s) {
+	const h = Math.floor(s / 3600);
+	const m = Math.floor(s % 3600 / 60);
+	return h + "h " + m + "m";
+}
+
+function showLogin(show) {
+	document.getElementById("login").hidden = !show;
+	document.getElementById("dashboard").hidden = show;
+	document.getElementById("logout").hidden = show;
+}
+
+async function refresh() {
+	let dash, servers, players, bans;
+	try {
+		[dash, servers, players, bans] = await Promise.all([
+			api("/api/dashboard"),
+			api("/api/servers"),
+			api("/api/players"),
+			api("/api/bans"),
+		]);
+	} catch (err) {
+		if (err.status === 401) {
+			clearInterval(refreshTimer);
+			showLogin(true);
+			return;
+		}
+
+		document.getElementById("status").textContent = err.message;
+		return;
+	}
+
+	showLogin(false);
+
+	document.getElementById("status").textContent =
+		dash.user + " | " + players.length + " players | up " + formatUptime(dash.uptime);
+
+	fillTable("servers", servers.servers.map(s => [
+		s.name,
+		s.address,
+		s.online ? cell("up (" + s.latency_ms + "ms)", "up") : cell("down", "down"),
+		String(s.players),
+	]));
+
+	fillTable("players", players.map(p => [p.name, p.server, p.address, String(p.proto_ver)]));
+
+	const events = dash.events.slice().reverse();
+
+	fillTable("joins", events
+		.filter(e => e.type === "join" || e.type === "leave")
+		.map(e => [formatTime(e.time), e.player, e.type, e.server]));
+
+	fillTable("redirects", events
+		.filter(e => e.type === "redirect_failed")
+		.map(e => [formatTime(e.time), e.player, e.server]));
+
+	fillTable("bans", bans.map(b => [b.address, b.name]));
+
+	const log = document.getElementById("log");
+	const atBottom = log.scrollTop + log.clientHeight >= log.scrollHeight - 5;
+
+	log.textContent = dash.log.join("\n");
+	if (atBottom) {
+		log.scrollTop = log.scrollHeight;
+	}
+}
+
+function start() {
+	clearInterval(refreshTimer);
+	refresh();
+	refreshTimer = setInterval(refresh, refreshInterval);
+}
+
+document.getElementById("login").addEventListener("submit", async ev => {
+	ev.preventDefault();
+
+	const form = ev.target;
+	const error = document.getElementById("login-error");
+
+	try {
+		await api("/api/login", {
+			method: "POST",
+			headers: {"Content-Type": "application/json"},
+			body: JSON.stringify({
+				name: form.elements.name.value,
+				password: form.elements.password.value,
+			}),
+		});
+	} catch (err) {
+		error.textContent = err.message;
+		return;
+	}
+
+	error.textContent = "";
+	form.reset();
+	start();
+});
+
+document.getElementById("logout").addEventListener("click", async () => {
+	await api("/api/logout", {method: "POST"});
+	clearInterval(refreshTimer);
+	showLogin(true);
+});
+
+start();